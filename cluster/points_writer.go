@@ -105,6 +105,8 @@ type PointsWriter struct {
 		WriteShard(shardID, ownerID uint64, points []models.Point) error
 	}
 
+	// HintedHandoff queues writes for nodes that can't be reached. An error with
+	// a Queued method returning true means the write was queued, with a warning.
 	HintedHandoff interface {
 		WriteShard(shardID, ownerID uint64, points []models.Point) error
 	}
@@ -333,6 +335,12 @@ func (w *PointsWriter) writeToShard(shard *meta.ShardInfo, database, retentionPo
 				// The remote write failed so queue it via hinted handoff
 				w.statMap.Add(statWritePointReqHH, int64(len(points)))
 				hherr := w.HintedHandoff.WriteShard(shardID, owner.NodeID, points)
+				if e, ok := hherr.(interface {
+					Queued() bool
+				}); ok && e.Queued() {
+					w.Logger.Printf("hinted handoff write for node %d queued: %s", owner.NodeID, hherr)
+					hherr = nil
+				}
 
 				// If the write consistency level is ANY, then a successful hinted handoff can
 				// be considered a successful write so send nil to the response channel
@@ -118,6 +118,10 @@ func (c *Config) Validate() error {
 		return err
 	}
 
+	if err := c.HintedHandoff.Validate(); err != nil {
+		return err
+	}
+
 	for _, g := range c.Graphites {
 		if err := g.Validate(); err != nil {
 			return fmt.Errorf("invalid graphite config: %v", err)
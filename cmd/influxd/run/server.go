@@ -12,6 +12,7 @@ import (
 
 	"github.com/influxdb/enterprise-client/v1"
 	"github.com/influxdb/influxdb/cluster"
+	"github.com/influxdb/influxdb/influxql"
 	"github.com/influxdb/influxdb/meta"
 	"github.com/influxdb/influxdb/monitor"
 	"github.com/influxdb/influxdb/services/admin"
@@ -121,13 +122,14 @@ func NewServer(c *Config, buildInfo *BuildInfo) (*Server, error) {
 	s.QueryExecutor.MonitorStatementExecutor = &monitor.StatementExecutor{Monitor: s.Monitor}
 	s.QueryExecutor.ShardMapper = s.ShardMapper
 	s.QueryExecutor.QueryLogEnabled = c.Data.QueryLogEnabled
+	s.QueryExecutor.QueryTimeout = time.Duration(c.Data.QueryTimeout)
 
 	// Set the shard writer
 	s.ShardWriter = cluster.NewShardWriter(time.Duration(c.Cluster.ShardWriterTimeout))
 	s.ShardWriter.MetaStore = s.MetaStore
 
 	// Create the hinted handoff service
-	s.HintedHandoff = hh.NewService(c.HintedHandoff, s.ShardWriter, s.MetaStore)
+	s.HintedHandoff = hh.NewService(c.HintedHandoff, s.ShardWriter, &hhMetaStore{Store: s.MetaStore, TSDBStore: s.TSDBStore})
 	s.HintedHandoff.Monitor = s.Monitor
 
 	// Create the Subscriber service
@@ -639,6 +641,17 @@ func stopProfile() {
 	}
 }
 
+// hhMetaStore is the meta store of the hinted handoff service. Measurement schemas
+// aren't kept in the meta store, so they are looked up in the local shards.
+type hhMetaStore struct {
+	*meta.Store
+	TSDBStore *tsdb.Store
+}
+
+func (s *hhMetaStore) MeasurementFields(database, name string) (map[string]influxql.DataType, bool) {
+	return s.TSDBStore.MeasurementFields(database, name)
+}
+
 type tcpaddr struct{ host string }
 
 func (a *tcpaddr) Network() string { return "tcp" }
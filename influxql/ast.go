@@ -901,6 +901,15 @@ func (s *SelectStatement) ColumnNames() []string {
 	for _, field := range s.Fields {
 		switch f := field.Expr.(type) {
 		case *Call:
+			if names := f.columnNames(); names != nil {
+				for _, name := range names {
+					if field.Alias != "" {
+						name = field.Alias + "_" + name
+					}
+					columnNames = append(columnNames, name)
+				}
+				continue
+			}
 			if f.Name == "top" || f.Name == "bottom" {
 				if len(f.Args) == 2 {
 					columnNames = append(columnNames, f.Name)
@@ -1049,6 +1058,10 @@ func (s *SelectStatement) validate(tr targetRequirement) error {
 		return err
 	}
 
+	if err := s.validateColumns(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -1069,15 +1082,24 @@ func (s *SelectStatement) validateDimensions() error {
 			// If we already have a duration
 			if expr.Name != "time" {
 				return errors.New("only time() calls allowed in dimensions")
-			} else if len(expr.Args) != 1 {
-				return errors.New("time dimension expected one argument")
+			} else if len(expr.Args) != 1 && len(expr.Args) != 2 {
+				return errors.New("time dimension expected one or two arguments")
 			} else if lit, ok := expr.Args[0].(*DurationLiteral); !ok {
 				return errors.New("time dimension must have one duration argument")
 			} else if dur != 0 {
 				return errors.New("multiple time dimensions not allowed")
+			} else if lit.Val <= 0 {
+				return errors.New("time dimension must have a positive duration")
 			} else {
 				dur = lit.Val
 			}
+
+			// A second duration advances the intervals by less than their size, so they overlap.
+			if len(expr.Args) == 2 {
+				if lit, ok := expr.Args[1].(*DurationLiteral); !ok || lit.Val <= 0 || lit.Val > dur {
+					return errors.New("time dimension step must be a positive duration no longer than the interval")
+				}
+			}
 		case *VarRef:
 			if strings.ToLower(expr.Val) == "time" {
 				return errors.New("time() is a function and expects at least one argument")
@@ -1143,9 +1165,18 @@ func (s *SelectStatement) validateAggregates(tr targetRequirement) error {
 				if err := s.validSelectWithAggregate(); err != nil {
 					return err
 				}
-				if min, max, got := 1, 2, len(expr.Args); got > max || got < min {
+				if min, max, got := 1, 3, len(expr.Args); got > max || got < min {
 					return fmt.Errorf("invalid number of arguments for %s, expected at least %d but no more than %d, got %d", expr.Name, min, max, got)
 				}
+				// Points of a field, not the intervals of an aggregate, can be ordered by another field.
+				if len(expr.Args) == 3 {
+					if _, ok := expr.Args[0].(*VarRef); !ok {
+						return fmt.Errorf("expected field argument in %s() with an ordering field", expr.Name)
+					}
+					if _, ok := expr.Args[2].(*VarRef); !ok {
+						return fmt.Errorf("expected field as third argument in %s(), found %s", expr.Name, expr.Args[2])
+					}
+				}
 				// Validate that if they have grouping by time, they need a sub-call like min/max, etc.
 				groupByInterval, _ := s.GroupByInterval()
 				if groupByInterval > 0 {
@@ -1154,6 +1185,186 @@ func (s *SelectStatement) validateAggregates(tr targetRequirement) error {
 					}
 				}
 
+			case "bucket_delta":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 1, len(expr.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
+				}
+				inner, ok := expr.Args[0].(*Call)
+				if !ok || len(inner.Args) == 0 {
+					return fmt.Errorf("aggregate function required inside the call to %s", expr.Name)
+				}
+				if _, ok := inner.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", inner.Name)
+				}
+				if inner.columnNames() != nil || inner.outputsPoints() {
+					return fmt.Errorf("%s() cannot be used inside the call to %s", inner.Name, expr.Name)
+				}
+				// The differences are between the values of intervals, in the only column.
+				if groupByInterval, _ := s.GroupByInterval(); groupByInterval == 0 {
+					return fmt.Errorf("%s requires a GROUP BY time interval", expr.Name)
+				}
+				if _, ok := f.Expr.(*Call); !ok || len(s.Fields) != 1 {
+					return fmt.Errorf("%s cannot be used with other fields", expr.Name)
+				}
+			case "min_points":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 2, len(expr.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
+				}
+				inner, ok := expr.Args[0].(*Call)
+				if !ok || len(inner.Args) == 0 {
+					return fmt.Errorf("aggregate function required inside the call to %s", expr.Name)
+				}
+				if _, ok := inner.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", inner.Name)
+				}
+				if inner.columnNames() != nil || inner.outputsPoints() || inner.Name == "min_points" {
+					return fmt.Errorf("%s() cannot be used inside the call to %s", inner.Name, expr.Name)
+				}
+				if lit, ok := expr.Args[1].(*NumberLiteral); !ok || lit.Val < 1 || lit.Val != float64(int64(lit.Val)) {
+					return fmt.Errorf("expected positive integer as second argument in %s(), found %s", expr.Name, expr.Args[1])
+				}
+			case "mean":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if min, max, got := 1, 2, len(expr.Args); got > max || got < min {
+					return fmt.Errorf("invalid number of arguments for %s, expected at least %d but no more than %d, got %d", expr.Name, min, max, got)
+				}
+				if _, ok := expr.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", expr.Name)
+				}
+				if len(expr.Args) == 2 {
+					if _, ok := expr.Args[1].(*BooleanLiteral); !ok {
+						return fmt.Errorf("expected boolean as second argument in %s(), found %s", expr.Name, expr.Args[1])
+					}
+				}
+			case "coverage", "active_buckets", "gap_count", "post_gap_first":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 2, len(expr.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
+				}
+				if _, ok := expr.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", expr.Name)
+				}
+				if lit, ok := expr.Args[1].(*DurationLiteral); !ok || lit.Val <= 0 {
+					return fmt.Errorf("expected positive duration as second argument in %s(), found %s", expr.Name, expr.Args[1])
+				}
+			case "first", "last":
+				// The second argument names a field to order points by in place of their time.
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if min, max, got := 1, 2, len(expr.Args); got > max || got < min {
+					return fmt.Errorf("invalid number of arguments for %s, expected at least %d but no more than %d, got %d", expr.Name, min, max, got)
+				}
+				switch fc := expr.Args[0].(type) {
+				case *VarRef:
+				case *Call:
+					if fc.Name != "distinct" {
+						return fmt.Errorf("expected field argument in %s()", expr.Name)
+					}
+				default:
+					return fmt.Errorf("expected field argument in %s()", expr.Name)
+				}
+				if len(expr.Args) == 2 {
+					if _, ok := expr.Args[1].(*VarRef); !ok {
+						return fmt.Errorf("expected field as second argument in %s(), found %s", expr.Name, expr.Args[1])
+					}
+				}
+			case "min_timestamp", "max_timestamp":
+				// Without a field, the time of any of the measurement's points counts.
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if max, got := 1, len(expr.Args); got > max {
+					return fmt.Errorf("invalid number of arguments for %s, expected at most %d, got %d", expr.Name, max, got)
+				}
+				if len(expr.Args) == 1 {
+					if _, ok := expr.Args[0].(*VarRef); !ok {
+						return fmt.Errorf("expected field argument in %s()", expr.Name)
+					}
+				}
+			case "time_above", "nearest", "crossings":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 2, len(expr.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
+				}
+				if _, ok := expr.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", expr.Name)
+				}
+				if _, ok := expr.Args[1].(*NumberLiteral); !ok {
+					return fmt.Errorf("expected number as second argument in %s(), found %s", expr.Name, expr.Args[1])
+				}
+			case "ratio_count":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 2, len(expr.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
+				}
+				var fields []string
+				for _, arg := range expr.Args {
+					cond, ok := arg.(*BinaryExpr)
+					if !ok {
+						return fmt.Errorf("expected comparison of a field with a number in %s(), found %s", expr.Name, arg)
+					}
+					if err := validateCondition(expr.Name, cond); err != nil {
+						return err
+					}
+					fields = append(fields, cond.LHS.(*VarRef).Val)
+				}
+				if fields[0] != fields[1] {
+					return fmt.Errorf("expected conditions of the same field in %s()", expr.Name)
+				}
+			case "nth":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 2, len(expr.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
+				}
+				if _, ok := expr.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", expr.Name)
+				}
+				if lit, ok := expr.Args[1].(*NumberLiteral); !ok || lit.Val != float64(int64(lit.Val)) {
+					return fmt.Errorf("expected integer as second argument in %s(), found %s", expr.Name, expr.Args[1])
+				}
+			case "moving_min", "moving_max":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 2, len(expr.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
+				}
+				if _, ok := expr.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", expr.Name)
+				}
+				if lit, ok := expr.Args[1].(*NumberLiteral); !ok || lit.Val < 1 || lit.Val != float64(int64(lit.Val)) {
+					return fmt.Errorf("expected positive integer as second argument in %s(), found %s", expr.Name, expr.Args[1])
+				}
+			case "ewma":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 2, len(expr.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
+				}
+				if _, ok := expr.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", expr.Name)
+				}
+				if lit, ok := expr.Args[1].(*NumberLiteral); !ok || lit.Val <= 0 || lit.Val > 1 {
+					return fmt.Errorf("expected smoothing factor greater than 0 and at most 1 as second argument in %s(), found %s", expr.Name, expr.Args[1])
+				}
 			case "percentile":
 				if err := s.validSelectWithAggregate(); err != nil {
 					return err
@@ -1161,10 +1372,32 @@ func (s *SelectStatement) validateAggregates(tr targetRequirement) error {
 				if exp, got := 2, len(expr.Args); got != exp {
 					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", expr.Name, exp, got)
 				}
-				_, ok := expr.Args[1].(*NumberLiteral)
+				lit, ok := expr.Args[1].(*NumberLiteral)
 				if !ok {
 					return fmt.Errorf("expected float argument in percentile()")
 				}
+				if lit.Val < 0 || lit.Val > 100 {
+					return fmt.Errorf("percentile must be between 0 and 100, got %s", lit)
+				}
+			case "percentiles":
+				if err := s.validSelectWithAggregate(); err != nil {
+					return err
+				}
+				if exp, got := 2, len(expr.Args); got < exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected at least %d, got %d", expr.Name, exp, got)
+				}
+				if _, ok := expr.Args[0].(*VarRef); !ok {
+					return fmt.Errorf("expected field argument in %s()", expr.Name)
+				}
+				for _, arg := range expr.Args[1:] {
+					lit, ok := arg.(*NumberLiteral)
+					if !ok {
+						return fmt.Errorf("expected float arguments after the field in %s(), found %s", expr.Name, arg)
+					}
+					if lit.Val < 0 || lit.Val > 100 {
+						return fmt.Errorf("percentile must be between 0 and 100, got %s", lit)
+					}
+				}
 			case "top", "bottom":
 				if exp, got := 2, len(expr.Args); got < exp {
 					return fmt.Errorf("invalid number of arguments for %s, expected at least %d, got %d", expr.Name, exp, got)
@@ -1203,6 +1436,13 @@ func (s *SelectStatement) validateAggregates(tr targetRequirement) error {
 					if expr.Name != "count" {
 						return fmt.Errorf("expected field argument in %s()", expr.Name)
 					}
+				case *BinaryExpr:
+					if expr.Name != "count" {
+						return fmt.Errorf("expected field argument in %s()", expr.Name)
+					}
+					if err := validateCondition(expr.Name, fc); err != nil {
+						return err
+					}
 				default:
 					return fmt.Errorf("expected field argument in %s()", expr.Name)
 				}
@@ -1229,6 +1469,17 @@ func (s *SelectStatement) validateAggregates(tr targetRequirement) error {
 	return nil
 }
 
+// validateCondition ensures a condition of a call, such as count(value > 100), compares a
+// field with a number.
+func validateCondition(name string, e *BinaryExpr) error {
+	_, lhsOk := e.LHS.(*VarRef)
+	_, rhsOk := e.RHS.(*NumberLiteral)
+	if !lhsOk || !rhsOk || !e.Op.isComparison() {
+		return fmt.Errorf("expected comparison of a field with a number in %s(), found %s", name, e)
+	}
+	return nil
+}
+
 func (s *SelectStatement) HasDistinct() bool {
 	// determine if we have a call named distinct
 	for _, f := range s.Fields {
@@ -1352,7 +1603,7 @@ func (s *SelectStatement) validateDerivative() error {
 	}
 
 	// If a duration arg is pased, make sure it's a duration
-	if len(derivativeCall.Args) == 2 {
+	if len(derivativeCall.Args) >= 2 {
 		// Second must be a duration .e.g (1h)
 		if _, ok := derivativeCall.Args[1].(*DurationLiteral); !ok {
 			return fmt.Errorf("derivative requires a duration argument")
@@ -1362,6 +1613,29 @@ func (s *SelectStatement) validateDerivative() error {
 	return nil
 }
 
+// validateColumns ensures calls that output several columns, or a value for each point,
+// are the only field of the statement, since the other fields' values are placed by their
+// position.
+func (s *SelectStatement) validateColumns() error {
+	for _, f := range s.Fields {
+		for _, c := range walkFunctionCalls(f.Expr) {
+			if c.outputsPoints() {
+				if _, ok := f.Expr.(*Call); !ok || len(s.Fields) != 1 {
+					return fmt.Errorf("%s() outputs a value for each point and cannot be used with other fields", c.Name)
+				}
+				continue
+			}
+			if c.columnNames() == nil {
+				continue
+			}
+			if _, ok := f.Expr.(*Call); !ok || len(s.Fields) != 1 {
+				return fmt.Errorf("%s() outputs several columns and cannot be used with other fields", c.Name)
+			}
+		}
+	}
+	return nil
+}
+
 // GroupByIterval extracts the time interval, if specified.
 func (s *SelectStatement) GroupByInterval() (time.Duration, error) {
 	// return if we've already pulled it out
@@ -1376,15 +1650,17 @@ func (s *SelectStatement) GroupByInterval() (time.Duration, error) {
 
 	for _, d := range s.Dimensions {
 		if call, ok := d.Expr.(*Call); ok && call.Name == "time" {
-			// Make sure there is exactly one argument.
-			if len(call.Args) != 1 {
-				return 0, errors.New("time dimension expected one argument")
+			// Make sure there is one argument, and at most a step after it.
+			if len(call.Args) != 1 && len(call.Args) != 2 {
+				return 0, errors.New("time dimension expected one or two arguments")
 			}
 
 			// Ensure the argument is a duration.
 			lit, ok := call.Args[0].(*DurationLiteral)
 			if !ok {
 				return 0, errors.New("time dimension must have one duration argument")
+			} else if lit.Val <= 0 {
+				return 0, errors.New("time dimension must have a positive duration")
 			}
 			s.groupByInterval = lit.Val
 			return lit.Val, nil
@@ -1393,6 +1669,26 @@ func (s *SelectStatement) GroupByInterval() (time.Duration, error) {
 	return 0, nil
 }
 
+// GroupByStep returns how far apart the starts of the GROUP BY time intervals are.  It's
+// the interval itself, unless time() has a second duration so the intervals overlap.
+func (s *SelectStatement) GroupByStep() (time.Duration, error) {
+	d, err := s.GroupByInterval()
+	if err != nil || d == 0 {
+		return d, err
+	}
+
+	for _, dim := range s.Dimensions {
+		if call, ok := dim.Expr.(*Call); ok && call.Name == "time" && len(call.Args) == 2 {
+			lit, ok := call.Args[1].(*DurationLiteral)
+			if !ok || lit.Val <= 0 || lit.Val > d {
+				return 0, errors.New("time dimension step must be a positive duration no longer than the interval")
+			}
+			return lit.Val, nil
+		}
+	}
+	return d, nil
+}
+
 // SetTimeRange sets the start and end time of the select statement to [start, end). i.e. start inclusive, end exclusive.
 // This is used commonly for continuous queries so the start and end are in buckets.
 func (s *SelectStatement) SetTimeRange(start, end time.Time) error {
@@ -1556,11 +1852,20 @@ func walkNames(exp Expr) []string {
 		if len(expr.Args) == 0 {
 			return nil
 		}
-		lit, ok := expr.Args[0].(*VarRef)
+		// The field of a condition, such as count(value > 100), is on the left.
+		arg := expr.Args[0]
+		if cond, ok := arg.(*BinaryExpr); ok {
+			arg = cond.LHS
+		}
+		lit, ok := arg.(*VarRef)
 		if !ok {
 			return nil
 		}
 
+		// The field points are ordered by, if not time, is read along with the value.
+		if f := expr.OrderField(); f != "" {
+			return []string{lit.Val, f}
+		}
 		return []string{lit.Val}
 	case *BinaryExpr:
 		var ret []string
@@ -2505,6 +2810,119 @@ func (c *Call) String() string {
 	return fmt.Sprintf("%s(%s)", c.Name, strings.Join(str, ", "))
 }
 
+// columnNames returns the names of the columns output by a call that outputs more than
+// one column, or nil if the call outputs a single column named by the field.
+func (c *Call) columnNames() []string {
+	switch c.Name {
+	case "mean":
+		// mean(value, true) outputs the number of values averaged alongside the mean.
+		if len(c.Args) == 2 {
+			if lit, ok := c.Args[1].(*BooleanLiteral); ok && lit.Val {
+				return []string{"mean", "count"}
+			}
+		}
+	case "summary":
+		return []string{"count", "min", "max", "mean"}
+	case "range_detail":
+		return []string{"min", "min_time", "max", "max_time"}
+	case "trend":
+		return []string{"slope", "intercept", "r2"}
+	case "state_duration":
+		return []string{"state", "duration"}
+	case "percentiles":
+		// percentiles(value, 50, 99.9) outputs columns named p50 and p99.9.
+		var names []string
+		for _, arg := range c.Args[1:] {
+			if lit, ok := arg.(*NumberLiteral); ok {
+				names = append(names, "p"+strconv.FormatFloat(lit.Val, 'f', -1, 64))
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// ColumnSpec is the name and type of a column output by a call.
+type ColumnSpec struct {
+	Name string
+	Type DataType
+}
+
+// OutputColumns returns the columns output by the call: a single column named by the call
+// for most calls, and several for calls like summary().  Names don't include the alias
+// of the field, and types that depend on the type of the field, like that of max(), are
+// Unknown.
+func (c *Call) OutputColumns() []ColumnSpec {
+	names := c.columnNames()
+	if names == nil {
+		return []ColumnSpec{{Name: c.Name, Type: c.outputType()}}
+	}
+
+	columns := make([]ColumnSpec, len(names))
+	for i, name := range names {
+		columns[i] = ColumnSpec{Name: name}
+		switch name {
+		case "count", "min_time", "max_time", "duration":
+			columns[i].Type = Integer
+		case "mean", "slope", "intercept", "r2":
+			columns[i].Type = Float
+		}
+	}
+	return columns
+}
+
+// outputType returns the type of the values of a call outputting a single column, or
+// Unknown if it depends on the type of the field.
+func (c *Call) outputType() DataType {
+	switch c.Name {
+	case "min_points":
+		// min_points(mean(value), 10) outputs the values of the nested call.
+		if inner, ok := c.Args[0].(*Call); ok {
+			return inner.outputType()
+		}
+	case "count", "last_age", "min_timestamp", "max_timestamp", "active_buckets", "resets",
+		"gap_count", "mode_count", "longest_increasing_run", "crossings", "cardinality":
+		return Integer
+	case "mean", "median", "stddev", "coverage", "sample_rate", "linear_regression",
+		"time_above", "ewma", "zscore", "percent_change", "abs_diff_sum", "ratio_count",
+		"entropy", "mad", "iqr", "autocorr", "tw_stddev", "moving_min", "moving_max", "normalize",
+		"null_fraction":
+		return Float
+	}
+	return Unknown
+}
+
+// outputsPoints returns true for calls that output a value for each point, rather than a
+// value for each interval.
+func (c *Call) outputsPoints() bool {
+	switch c.Name {
+	case "ewma", "zscore", "post_gap_first", "moving_min", "moving_max", "normalize":
+		return true
+	}
+	return false
+}
+
+// OrderField returns the name of the field a call orders points by in place of their
+// time, such as seq in first(value, seq) or derivative(value, 1s, seq), or "" if the
+// call orders points by time.
+func (c *Call) OrderField() string {
+	var arg Expr
+	switch c.Name {
+	case "first", "last":
+		if len(c.Args) == 2 {
+			arg = c.Args[1]
+		}
+	case "derivative", "non_negative_derivative":
+		if len(c.Args) == 3 {
+			arg = c.Args[2]
+		}
+	}
+	if ref, ok := arg.(*VarRef); ok {
+		return ref.Val
+	}
+	return ""
+}
+
 // Fields will extract any field names from the call.  Only specific calls support this.
 func (c *Call) Fields() []string {
 	switch c.Name {
@@ -98,19 +98,39 @@ func TestSelectStatement_Substatement(t *testing.T) {
 
 // Ensure the SELECT statement can extract GROUP BY interval.
 func TestSelectStatement_GroupByInterval(t *testing.T) {
-	q := "SELECT sum(value) from foo  where time < now() GROUP BY time(10m)"
-	stmt, err := influxql.NewParser(strings.NewReader(q)).ParseStatement()
-	if err != nil {
-		t.Fatalf("invalid statement: %q: %s", stmt, err)
-	}
+	for _, tt := range []struct {
+		q string
+		d time.Duration
+	}{
+		{q: "SELECT sum(value) from foo  where time < now() GROUP BY time(10m)", d: 10 * time.Minute},
+		{q: "SELECT sum(value) from foo  where time < now() GROUP BY time(1h)", d: time.Hour},
+		{q: "SELECT sum(value) from foo  where time < now() GROUP BY time(500ms)", d: 500 * time.Millisecond},
+	} {
+		stmt, err := influxql.NewParser(strings.NewReader(tt.q)).ParseStatement()
+		if err != nil {
+			t.Fatalf("invalid statement: %q: %s", stmt, err)
+		}
 
-	s := stmt.(*influxql.SelectStatement)
-	d, err := s.GroupByInterval()
-	if d != 10*time.Minute {
-		t.Fatalf("group by interval not equal:\nexp=%s\ngot=%s", 10*time.Minute, d)
+		s := stmt.(*influxql.SelectStatement)
+		d, err := s.GroupByInterval()
+		if d != tt.d {
+			t.Fatalf("group by interval not equal:\nexp=%s\ngot=%s", tt.d, d)
+		}
+		if err != nil {
+			t.Fatalf("error parsing group by interval: %s", err.Error())
+		}
 	}
-	if err != nil {
-		t.Fatalf("error parsing group by interval: %s", err.Error())
+}
+
+// Ensure a statement that skipped validation can't group by a zero or negative interval.
+func TestSelectStatement_GroupByInterval_NotPositive(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Hour} {
+		s := &influxql.SelectStatement{
+			Dimensions: influxql.Dimensions{{Expr: &influxql.Call{Name: "time", Args: []influxql.Expr{&influxql.DurationLiteral{Val: d}}}}},
+		}
+		if _, err := s.GroupByInterval(); err == nil || err.Error() != "time dimension must have a positive duration" {
+			t.Fatalf("%s: unexpected error: %v", d, err)
+		}
 	}
 }
 
@@ -222,6 +242,12 @@ func TestSelect_NamesInSelect(t *testing.T) {
 	if !reflect.DeepEqual(a, []string{"asdf", "bar"}) {
 		t.Fatal("expected names asdf and bar")
 	}
+
+	// The field points are ordered by is read along with the value.
+	s = MustParseSelectStatement("select derivative(value, 1s, seq) from cpu")
+	if a := s.NamesInSelect(); !reflect.DeepEqual(a, []string{"value", "seq"}) {
+		t.Fatalf("exp: value,seq\ngot: %s\n", strings.Join(a, ","))
+	}
 }
 
 // Ensure the idents from the where clause can come out
@@ -233,6 +259,70 @@ func TestSelect_NamesInWhere(t *testing.T) {
 	}
 }
 
+// Ensure the column names of a statement are extracted, including the several columns of
+// a call that outputs more than one.
+func TestSelectStatement_ColumnNames(t *testing.T) {
+	for i, tt := range []struct {
+		stmt    string
+		columns []string
+	}{
+		{stmt: `SELECT mean(value) FROM cpu`, columns: []string{"time", "mean"}},
+		{stmt: `SELECT mean(value, false) FROM cpu`, columns: []string{"time", "mean"}},
+		{stmt: `SELECT mean(value, true) FROM cpu`, columns: []string{"time", "mean", "count"}},
+		{stmt: `SELECT mean(value, true) AS load FROM cpu`, columns: []string{"time", "load_mean", "load_count"}},
+		{stmt: `SELECT summary(value) FROM cpu`, columns: []string{"time", "count", "min", "max", "mean"}},
+		{stmt: `SELECT range_detail(value) FROM cpu`, columns: []string{"time", "min", "min_time", "max", "max_time"}},
+		{stmt: `SELECT percentiles(value, 50, 90, 99.9) FROM cpu`, columns: []string{"time", "p50", "p90", "p99.9"}},
+		{stmt: `SELECT trend(value) FROM cpu`, columns: []string{"time", "slope", "intercept", "r2"}},
+	} {
+		s := MustParseSelectStatement(tt.stmt)
+		if columns := s.ColumnNames(); !reflect.DeepEqual(columns, tt.columns) {
+			t.Errorf("%d. %s: columns mismatch: got %v, exp %v", i, tt.stmt, columns, tt.columns)
+		}
+	}
+}
+
+// Ensure calls report the columns they output.
+func TestCall_OutputColumns(t *testing.T) {
+	for i, tt := range []struct {
+		stmt    string
+		columns []influxql.ColumnSpec
+	}{
+		{stmt: `SELECT count(value) FROM cpu`, columns: []influxql.ColumnSpec{{Name: "count", Type: influxql.Integer}}},
+		{stmt: `SELECT max(value) FROM cpu`, columns: []influxql.ColumnSpec{{Name: "max", Type: influxql.Unknown}}},
+		{stmt: `SELECT mean(value) AS load FROM cpu`, columns: []influxql.ColumnSpec{{Name: "mean", Type: influxql.Float}}},
+		{stmt: `SELECT min_points(count(value), 10) FROM cpu`, columns: []influxql.ColumnSpec{{Name: "min_points", Type: influxql.Integer}}},
+		{
+			stmt: `SELECT summary(value) FROM cpu`,
+			columns: []influxql.ColumnSpec{
+				{Name: "count", Type: influxql.Integer},
+				{Name: "min", Type: influxql.Unknown},
+				{Name: "max", Type: influxql.Unknown},
+				{Name: "mean", Type: influxql.Float},
+			},
+		},
+		{
+			stmt: `SELECT mean(value, true) FROM cpu`,
+			columns: []influxql.ColumnSpec{
+				{Name: "mean", Type: influxql.Float},
+				{Name: "count", Type: influxql.Integer},
+			},
+		},
+		{
+			stmt: `SELECT state_duration(up) FROM cpu`,
+			columns: []influxql.ColumnSpec{
+				{Name: "state", Type: influxql.Unknown},
+				{Name: "duration", Type: influxql.Integer},
+			},
+		},
+	} {
+		call := MustParseSelectStatement(tt.stmt).FunctionCalls()[0]
+		if columns := call.OutputColumns(); !reflect.DeepEqual(columns, tt.columns) {
+			t.Errorf("%d. %s: columns mismatch: got %v, exp %v", i, tt.stmt, columns, tt.columns)
+		}
+	}
+}
+
 func TestSelectStatement_HasWildcard(t *testing.T) {
 	var tests = []struct {
 		stmt     string
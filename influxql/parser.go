@@ -1752,6 +1752,17 @@ type validateField struct {
 }
 
 func (c *validateField) Visit(n Node) Visitor {
+	// Conditional counts, like count(value > 100), compare values in the SELECT clause.
+	if call, ok := n.(*Call); ok && (call.Name == "count" || call.Name == "ratio_count") {
+		for _, arg := range call.Args {
+			if e, ok := arg.(*BinaryExpr); ok && e.Op.isComparison() {
+				continue
+			}
+			Walk(c, arg)
+		}
+		return nil
+	}
+
 	e, ok := n.(*BinaryExpr)
 	if !ok {
 		return c
@@ -296,6 +296,40 @@ func TestParser_ParseStatement(t *testing.T) {
 			},
 		},
 
+		// first() and last() can order points by a field in place of their time.
+		{
+			s: `SELECT first(value, seq) FROM cpu`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: false,
+				Fields: []*influxql.Field{
+					{Expr: &influxql.Call{Name: "first", Args: []influxql.Expr{&influxql.VarRef{Val: "value"}, &influxql.VarRef{Val: "seq"}}}},
+				},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+			},
+		},
+
+		// min_timestamp() and max_timestamp() don't need a field.
+		{
+			s: `SELECT min_timestamp() FROM cpu`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: false,
+				Fields: []*influxql.Field{
+					{Expr: &influxql.Call{Name: "min_timestamp"}},
+				},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+			},
+		},
+		{
+			s: `SELECT max_timestamp(value) FROM cpu`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: false,
+				Fields: []*influxql.Field{
+					{Expr: &influxql.Call{Name: "max_timestamp", Args: []influxql.Expr{&influxql.VarRef{Val: "value"}}}},
+				},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+			},
+		},
+
 		// select top statements
 		{
 			s: `select top("field1", 2) from cpu`,
@@ -377,6 +411,22 @@ func TestParser_ParseStatement(t *testing.T) {
 			},
 		},
 
+		// count of values meeting a condition
+		{
+			s: `select count(value > 100) from cpu`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: false,
+				Fields: []*influxql.Field{
+					{Expr: &influxql.Call{Name: "count", Args: []influxql.Expr{&influxql.BinaryExpr{
+						Op:  influxql.GT,
+						LHS: &influxql.VarRef{Val: "value"},
+						RHS: &influxql.NumberLiteral{Val: 100},
+					}}}},
+				},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+			},
+		},
+
 		{
 			s: `select count(distinct field3), sum(field4) from metrics`,
 			stmt: &influxql.SelectStatement{
@@ -1528,9 +1578,59 @@ func TestParser_ParseStatement(t *testing.T) {
 		{s: `SELECT bottom(field1,host,'server',foo) FROM myseries`, err: `expected integer as last argument in bottom(), found foo`},
 		{s: `SELECT bottom(field1,5,'server',2) FROM myseries`, err: `only fields or tags are allowed in bottom(), found 5.000`},
 		{s: `SELECT bottom(field1,max(foo),'server',2) FROM myseries`, err: `only fields or tags are allowed in bottom(), found max(foo)`},
+		{s: `SELECT mean(field1, 'count') FROM myseries`, err: `expected boolean as second argument in mean(), found 'count'`},
+		{s: `SELECT mean(field1, true, true) FROM myseries`, err: `invalid number of arguments for mean, expected at least 1 but no more than 2, got 3`},
+		{s: `SELECT mean(field1, true), max(field1) FROM myseries`, err: `mean() outputs several columns and cannot be used with other fields`},
+		{s: `SELECT mean(field1, true) * 2 FROM myseries`, err: `mean() outputs several columns and cannot be used with other fields`},
+		{s: `SELECT summary(field1), count(field1) FROM myseries`, err: `summary() outputs several columns and cannot be used with other fields`},
+		{s: `SELECT coverage(field1) FROM myseries`, err: `invalid number of arguments for coverage, expected 2, got 1`},
+		{s: `SELECT coverage(field1, 10) FROM myseries`, err: `expected positive duration as second argument in coverage(), found 10.000`},
+		{s: `SELECT coverage(field1, 0s) FROM myseries`, err: `expected positive duration as second argument in coverage(), found 0s`},
+		{s: `SELECT time_above(field1) FROM myseries`, err: `invalid number of arguments for time_above, expected 2, got 1`},
+		{s: `SELECT time_above(field1, 'a') FROM myseries`, err: `expected number as second argument in time_above(), found 'a'`},
+		{s: `SELECT ratio_count(status >= 500) FROM myseries`, err: `invalid number of arguments for ratio_count, expected 2, got 1`},
+		{s: `SELECT ratio_count(status >= 500, status) FROM myseries`, err: `expected comparison of a field with a number in ratio_count(), found status`},
+		{s: `SELECT ratio_count(status >= 500, 0 <= status) FROM myseries`, err: `expected comparison of a field with a number in ratio_count(), found 0.000 <= status`},
+		{s: `SELECT ratio_count(status >= 500, code >= 0) FROM myseries`, err: `expected conditions of the same field in ratio_count()`},
+		{s: `SELECT nth(field1) FROM myseries`, err: `invalid number of arguments for nth, expected 2, got 1`},
+		{s: `SELECT nth(field1, 1.5) FROM myseries`, err: `expected integer as second argument in nth(), found 1.500`},
+		{s: `SELECT nearest(field1, field2) FROM myseries`, err: `expected number as second argument in nearest(), found field2`},
+		{s: `SELECT first(field1, 1) FROM myseries`, err: `expected field as second argument in first(), found 1.000`},
+		{s: `SELECT last(field1, seq, time) FROM myseries`, err: `invalid number of arguments for last, expected at least 1 but no more than 2, got 3`},
+		{s: `SELECT min_timestamp(field1, field2) FROM myseries`, err: `invalid number of arguments for min_timestamp, expected at most 1, got 2`},
+		{s: `SELECT max_timestamp(1) FROM myseries`, err: `expected field argument in max_timestamp()`},
+		{s: `SELECT crossings(field1) FROM myseries`, err: `invalid number of arguments for crossings, expected 2, got 1`},
+		{s: `SELECT moving_min(field1) FROM myseries`, err: `invalid number of arguments for moving_min, expected 2, got 1`},
+		{s: `SELECT moving_max(field1, 0) FROM myseries`, err: `expected positive integer as second argument in moving_max(), found 0.000`},
+		{s: `SELECT moving_max(field1, 2.5) FROM myseries`, err: `expected positive integer as second argument in moving_max(), found 2.500`},
+		{s: `SELECT bucket_delta(field1) FROM myseries GROUP BY time(1m)`, err: `aggregate function required inside the call to bucket_delta`},
+		{s: `SELECT bucket_delta(mean(field1), 1) FROM myseries GROUP BY time(1m)`, err: `invalid number of arguments for bucket_delta, expected 1, got 2`},
+		{s: `SELECT bucket_delta(summary(field1)) FROM myseries GROUP BY time(1m)`, err: `summary() cannot be used inside the call to bucket_delta`},
+		{s: `SELECT bucket_delta(mean(field1)) FROM myseries`, err: `bucket_delta requires a GROUP BY time interval`},
+		{s: `SELECT bucket_delta(mean(field1)) * 2 FROM myseries GROUP BY time(1m)`, err: `bucket_delta cannot be used with other fields`},
+		{s: `SELECT min_points(field1, 10) FROM myseries`, err: `aggregate function required inside the call to min_points`},
+		{s: `SELECT min_points(mean(field1)) FROM myseries`, err: `invalid number of arguments for min_points, expected 2, got 1`},
+		{s: `SELECT min_points(summary(field1), 10) FROM myseries`, err: `summary() cannot be used inside the call to min_points`},
+		{s: `SELECT min_points(mean(field1), 0) FROM myseries`, err: `expected positive integer as second argument in min_points(), found 0.000`},
+		{s: `SELECT min_points(mean(field1), 2.5) FROM myseries`, err: `expected positive integer as second argument in min_points(), found 2.500`},
+		{s: `SELECT ewma(field1) FROM myseries`, err: `invalid number of arguments for ewma, expected 2, got 1`},
+		{s: `SELECT ewma(field1, 0) FROM myseries`, err: `expected smoothing factor greater than 0 and at most 1 as second argument in ewma(), found 0.000`},
+		{s: `SELECT ewma(field1, 1.5) FROM myseries`, err: `expected smoothing factor greater than 0 and at most 1 as second argument in ewma(), found 1.500`},
+		{s: `SELECT ewma(field1, 0.5), max(field1) FROM myseries`, err: `ewma() outputs a value for each point and cannot be used with other fields`},
+		{s: `SELECT zscore(field1), field2 FROM myseries`, err: `mixing aggregate and non-aggregate queries is not supported`},
+		{s: `SELECT zscore(field1) * 2 FROM myseries`, err: `zscore() outputs a value for each point and cannot be used with other fields`},
+		{s: `SELECT gap_count(field1) FROM myseries`, err: `invalid number of arguments for gap_count, expected 2, got 1`},
+		{s: `SELECT gap_count(field1, 10) FROM myseries`, err: `expected positive duration as second argument in gap_count(), found 10.000`},
+		{s: `SELECT post_gap_first(field1, -1m) FROM myseries`, err: `expected positive duration as second argument in post_gap_first(), found -1m`},
+		{s: `SELECT active_buckets(field1, 'a') FROM myseries`, err: `expected positive duration as second argument in active_buckets(), found 'a'`},
+		{s: `SELECT percentiles(field1) FROM myseries`, err: `invalid number of arguments for percentiles, expected at least 2, got 1`},
+		{s: `SELECT percentiles(field1, 50, foo) FROM myseries`, err: `expected float arguments after the field in percentiles(), found foo`},
+		{s: `SELECT percentiles(field1, 50, 101) FROM myseries`, err: `percentile must be between 0 and 100, got 101.000`},
 		{s: `SELECT percentile() FROM myseries`, err: `invalid number of arguments for percentile, expected 2, got 0`},
 		{s: `SELECT percentile(field1) FROM myseries`, err: `invalid number of arguments for percentile, expected 2, got 1`},
 		{s: `SELECT percentile(field1, foo) FROM myseries`, err: `expected float argument in percentile()`},
+		{s: `SELECT percentile(field1, -1) FROM myseries`, err: `percentile must be between 0 and 100, got -1.000`},
+		{s: `SELECT percentile(field1, 100.5) FROM myseries`, err: `percentile must be between 0 and 100, got 100.500`},
 		{s: `SELECT field1 FROM myseries OFFSET`, err: `found EOF, expected number at line 1, char 36`},
 		{s: `SELECT field1 FROM myseries OFFSET 10.5`, err: `fractional parts not allowed in OFFSET at line 1, char 36`},
 		{s: `SELECT field1 FROM myseries ORDER`, err: `found EOF, expected BY at line 1, char 35`},
@@ -1547,9 +1647,14 @@ func TestParser_ParseStatement(t *testing.T) {
 		{s: `SELECT count(value) FROM foo group by time(1s) where host = 'hosta.influxdb.org'`, err: `aggregate functions with GROUP BY time require a WHERE time clause`},
 		{s: `SELECT count(value) FROM foo group by time`, err: `time() is a function and expects at least one argument`},
 		{s: `SELECT count(value) FROM foo group by 'time'`, err: `only time and tag dimensions allowed`},
-		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time()`, err: `time dimension expected one argument`},
+		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time()`, err: `time dimension expected one or two arguments`},
 		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time(b)`, err: `time dimension must have one duration argument`},
 		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time(1s), time(2s)`, err: `multiple time dimensions not allowed`},
+		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time(0s)`, err: `time dimension must have a positive duration`},
+		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time(1m, 2m)`, err: `time dimension step must be a positive duration no longer than the interval`},
+		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time(1m, 0s)`, err: `time dimension step must be a positive duration no longer than the interval`},
+		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time(1m, 1m, 1m)`, err: `time dimension expected one or two arguments`},
+		{s: `SELECT count(value) FROM foo where time > now() and time < now() group by time(-1h)`, err: `time dimension must have a positive duration`},
 		{s: `SELECT field1 FROM 12`, err: `found 12, expected identifier at line 1, char 20`},
 		{s: `SELECT 1000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000 FROM myseries`, err: `unable to parse number at line 1, char 8`},
 		{s: `SELECT 10.5h FROM myseries`, err: `found h, expected FROM at line 1, char 12`},
@@ -1564,17 +1669,25 @@ func TestParser_ParseStatement(t *testing.T) {
 		{s: `select count(distinct(too, many, arguments)) from myseries`, err: `count(distinct <field>) can only have one argument`},
 		{s: `select count() from myseries`, err: `invalid number of arguments for count, expected 1, got 0`},
 		{s: `SELECT derivative(), field1 FROM myseries`, err: `mixing aggregate and non-aggregate queries is not supported`},
-		{s: `select derivative() from myseries`, err: `invalid number of arguments for derivative, expected at least 1 but no more than 2, got 0`},
-		{s: `select derivative(mean(value), 1h, 3) from myseries`, err: `invalid number of arguments for derivative, expected at least 1 but no more than 2, got 3`},
+		{s: `select derivative() from myseries`, err: `invalid number of arguments for derivative, expected at least 1 but no more than 3, got 0`},
+		{s: `select derivative(mean(value), 1h, 3) from myseries`, err: `expected field argument in derivative() with an ordering field`},
+		{s: `select derivative(value, 1h, 3) from myseries`, err: `expected field as third argument in derivative(), found 3.000`},
+		{s: `select derivative(value, 1h, seq, 3) from myseries`, err: `invalid number of arguments for derivative, expected at least 1 but no more than 3, got 4`},
 		{s: `SELECT derivative(value) FROM myseries group by time(1h)`, err: `aggregate function required inside the call to derivative`},
 		{s: `SELECT non_negative_derivative(), field1 FROM myseries`, err: `mixing aggregate and non-aggregate queries is not supported`},
-		{s: `select non_negative_derivative() from myseries`, err: `invalid number of arguments for non_negative_derivative, expected at least 1 but no more than 2, got 0`},
-		{s: `select non_negative_derivative(mean(value), 1h, 3) from myseries`, err: `invalid number of arguments for non_negative_derivative, expected at least 1 but no more than 2, got 3`},
+		{s: `select non_negative_derivative() from myseries`, err: `invalid number of arguments for non_negative_derivative, expected at least 1 but no more than 3, got 0`},
+		{s: `select non_negative_derivative(mean(value), 1h, 3) from myseries`, err: `expected field argument in non_negative_derivative() with an ordering field`},
+		{s: `select non_negative_derivative(value, 1h, 3) from myseries`, err: `expected field as third argument in non_negative_derivative(), found 3.000`},
+		{s: `select non_negative_derivative(value, 1h, seq, 3) from myseries`, err: `invalid number of arguments for non_negative_derivative, expected at least 1 but no more than 3, got 4`},
 		{s: `SELECT non_negative_derivative(value) FROM myseries group by time(1h)`, err: `aggregate function required inside the call to non_negative_derivative`},
 		{s: `SELECT field1 from myseries WHERE host =~ 'asd' LIMIT 1`, err: `found asd, expected regex at line 1, char 42`},
 		{s: `SELECT value > 2 FROM cpu`, err: `invalid operator > in SELECT clause at line 1, char 8; operator is intended for WHERE clause`},
 		{s: `SELECT value = 2 FROM cpu`, err: `invalid operator = in SELECT clause at line 1, char 8; operator is intended for WHERE clause`},
 		{s: `SELECT s =~ /foo/ FROM cpu`, err: `invalid operator =~ in SELECT clause at line 1, char 8; operator is intended for WHERE clause`},
+		{s: `SELECT count(value =~ /foo/) FROM cpu`, err: `invalid operator =~ in SELECT clause at line 1, char 8; operator is intended for WHERE clause`},
+		{s: `SELECT sum(value > 2) FROM cpu`, err: `invalid operator > in SELECT clause at line 1, char 8; operator is intended for WHERE clause`},
+		{s: `SELECT count(2 < value) FROM cpu`, err: `expected comparison of a field with a number in count(), found 2.000 < value`},
+		{s: `SELECT count(value > other) FROM cpu`, err: `expected comparison of a field with a number in count(), found value > other`},
 		{s: `DELETE`, err: `found EOF, expected FROM at line 1, char 8`},
 		{s: `DELETE FROM`, err: `found EOF, expected identifier at line 1, char 13`},
 		{s: `DELETE FROM myseries WHERE`, err: `found EOF, expected identifier, string, number, bool at line 1, char 28`},
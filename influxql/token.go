@@ -290,6 +290,15 @@ func (tok Token) Precedence() int {
 // isOperator returns true for operator tokens.
 func (tok Token) isOperator() bool { return tok > operator_beg && tok < operator_end }
 
+// isComparison returns true for operator tokens comparing values, other than by regex.
+func (tok Token) isComparison() bool {
+	switch tok {
+	case EQ, NEQ, LT, LTE, GT, GTE:
+		return true
+	}
+	return false
+}
+
 // tokstr returns a literal if provided, otherwise returns the token string.
 func tokstr(tok Token, lit string) string {
 	if lit != "" {
@@ -1,6 +1,7 @@
 package hh
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/influxdb/influxdb/toml"
@@ -10,6 +11,15 @@ const (
 	// DefaultMaxSize is the default maximum size of all hinted handoff queues in bytes.
 	DefaultMaxSize = 1024 * 1024 * 1024
 
+	// DefaultHighWaterMark is the default size in bytes of a hinted handoff queue above
+	// which writes are still queued, but callers are told the queue is filling up.  A
+	// value of 0 disables the high-water mark.
+	DefaultHighWaterMark = 0
+
+	// DefaultMaxBatchSize is the default maximum size in bytes of a single write queued
+	// for a node.  A value of 0 disables the limit.
+	DefaultMaxBatchSize = 0
+
 	// DefaultMaxAge is the default maximum amount of time that a hinted handoff write
 	// can stay in the queue.  After this time, the write will be purged.
 	DefaultMaxAge = 7 * 24 * time.Hour
@@ -32,27 +42,211 @@ const (
 	// DefaultPurgeInterval is the amount of time the system waits before attempting
 	// to purge hinted handoff data due to age or inactive nodes.
 	DefaultPurgeInterval = time.Hour
+
+	// DefaultMaxInactiveAge is the default amount of time a hinted handoff queue can
+	// go unmodified before it is purged when the meta store can't be used to determine
+	// whether its node is still part of the cluster.
+	DefaultMaxInactiveAge = 30 * 24 * time.Hour
+
+	// DefaultMaxProcessors is the default maximum number of nodes hinted handoff
+	// data will be queued for.  A value of 0 disables the limit.
+	DefaultMaxProcessors = 0
+
+	// DefaultMaxConcurrentReplays is the default maximum number of nodes hinted handoff
+	// data is sent to at the same time.  A value of 0 disables the limit.
+	DefaultMaxConcurrentReplays = 0
+
+	// DefaultBatchSize is the default number of points buffered in memory before
+	// they are written to a hinted handoff queue.
+	DefaultBatchSize = 1000
+
+	// DefaultBatchInterval is the default maximum amount of time writes are buffered
+	// in memory before they are written to a hinted handoff queue.  A value of 0
+	// disables buffering, so every write is synced to disk before it is acknowledged.
+	DefaultBatchInterval = 0
+
+	// DefaultSyncPolicy is the default policy for syncing hinted handoff queues to disk.
+	DefaultSyncPolicy = SyncAlways
+
+	// DefaultSyncInterval is the default amount of time between syncing hinted handoff
+	// queues to disk, when the sync policy is SyncInterval.
+	DefaultSyncInterval = 100 * time.Millisecond
+
+	// DefaultKeepDrainedFor is the default amount of time segments are kept after all
+	// of their data has been sent.  A value of 0 removes them once they are drained.
+	DefaultKeepDrainedFor = 0
+
+	// DefaultWriteTimeout is the default maximum amount of time sending a queued write
+	// to a node can take before it is abandoned and retried.  A value of 0 disables the
+	// timeout.
+	DefaultWriteTimeout = 0
+
+	// DefaultMaxPointAge is the default maximum age of points that are queued.  Older
+	// points are dropped rather than queued.  A value of 0 disables the limit.
+	DefaultMaxPointAge = 0
+
+	// DefaultReadAheadBytes is the default maximum number of bytes of queued writes read
+	// into memory ahead of being sent to a node.  A value of 0 disables reading ahead.
+	DefaultReadAheadBytes = 0
+
+	// DefaultMaxAsyncWrites is the default maximum number of writes queued in the
+	// background by WriteShardAsync at the same time.
+	DefaultMaxAsyncWrites = 100
+
+	// DefaultDirPerm is the default permission of hinted handoff directories.  Segment
+	// files get the same permission without execute bits.
+	DefaultDirPerm = 0700
+
+	// DefaultValidateOnWrite is the default for whether writes are checked against the
+	// meta store, and points against their measurement's schema, before they are queued.
+	DefaultValidateOnWrite = false
+)
+
+// Policies for syncing hinted handoff queues to disk.  Syncing every write is the most
+// durable, but limits the rate writes can be queued.  Syncing on an interval loses at
+// most the interval's writes on a crash of the host, and never syncing leaves it to the
+// operating system to decide when writes reach disk.
+const (
+	SyncAlways   = "always"
+	SyncInterval = "interval"
+	SyncNever    = "never"
 )
 
 type Config struct {
-	Enabled          bool          `toml:"enabled"`
-	Dir              string        `toml:"dir"`
-	MaxSize          int64         `toml:"max-size"`
-	MaxAge           toml.Duration `toml:"max-age"`
-	RetryRateLimit   int64         `toml:"retry-rate-limit"`
-	RetryInterval    toml.Duration `toml:"retry-interval"`
-	RetryMaxInterval toml.Duration `toml:"retry-max-interval"`
-	PurgeInterval    toml.Duration `toml:"purge-interval"`
+	Enabled              bool          `toml:"enabled"`
+	Dir                  string        `toml:"dir"`
+	DirPerm              toml.FileMode `toml:"dir-perm"`
+	MaxSize              int64         `toml:"max-size"`
+	HighWaterMark        int64         `toml:"high-water-mark"`
+	MaxBatchSize         int64         `toml:"max-batch-size"`
+	MaxAge               toml.Duration `toml:"max-age"`
+	RetryRateLimit       int64         `toml:"retry-rate-limit"`
+	RetryInterval        toml.Duration `toml:"retry-interval"`
+	RetryMaxInterval     toml.Duration `toml:"retry-max-interval"`
+	PurgeInterval        toml.Duration `toml:"purge-interval"`
+	MaxInactiveAge       toml.Duration `toml:"max-inactive-age"`
+	MaxProcessors        int           `toml:"max-processors"`
+	MaxConcurrentReplays int           `toml:"max-concurrent-replays"`
+	BatchSize            int           `toml:"batch-size"`
+	BatchInterval        toml.Duration `toml:"batch-interval"`
+	SyncPolicy           string        `toml:"sync-policy"`
+	SyncInterval         toml.Duration `toml:"sync-interval"`
+	KeepDrainedFor       toml.Duration `toml:"keep-drained-for"`
+	WriteTimeout         toml.Duration `toml:"write-timeout"`
+	MaxPointAge          toml.Duration `toml:"max-point-age"`
+	ReadAheadBytes       int64         `toml:"read-ahead-bytes"`
+	MaxAsyncWrites       int           `toml:"max-async-writes"`
+	ValidateOnWrite      bool          `toml:"validate-on-write"`
 }
 
 func NewConfig() Config {
 	return Config{
-		Enabled:          true,
-		MaxSize:          DefaultMaxSize,
-		MaxAge:           toml.Duration(DefaultMaxAge),
-		RetryRateLimit:   DefaultRetryRateLimit,
-		RetryInterval:    toml.Duration(DefaultRetryInterval),
-		RetryMaxInterval: toml.Duration(DefaultRetryMaxInterval),
-		PurgeInterval:    toml.Duration(DefaultPurgeInterval),
+		Enabled:              true,
+		DirPerm:              DefaultDirPerm,
+		MaxSize:              DefaultMaxSize,
+		HighWaterMark:        DefaultHighWaterMark,
+		MaxBatchSize:         DefaultMaxBatchSize,
+		MaxAge:               toml.Duration(DefaultMaxAge),
+		RetryRateLimit:       DefaultRetryRateLimit,
+		RetryInterval:        toml.Duration(DefaultRetryInterval),
+		RetryMaxInterval:     toml.Duration(DefaultRetryMaxInterval),
+		PurgeInterval:        toml.Duration(DefaultPurgeInterval),
+		MaxInactiveAge:       toml.Duration(DefaultMaxInactiveAge),
+		MaxProcessors:        DefaultMaxProcessors,
+		MaxConcurrentReplays: DefaultMaxConcurrentReplays,
+		BatchSize:            DefaultBatchSize,
+		BatchInterval:        toml.Duration(DefaultBatchInterval),
+		SyncPolicy:           DefaultSyncPolicy,
+		SyncInterval:         toml.Duration(DefaultSyncInterval),
+		KeepDrainedFor:       toml.Duration(DefaultKeepDrainedFor),
+		WriteTimeout:         toml.Duration(DefaultWriteTimeout),
+		MaxPointAge:          toml.Duration(DefaultMaxPointAge),
+		ReadAheadBytes:       DefaultReadAheadBytes,
+		MaxAsyncWrites:       DefaultMaxAsyncWrites,
+		ValidateOnWrite:      DefaultValidateOnWrite,
 	}
 }
+
+// Validate returns an error if the config is invalid.  A disabled config is always valid.
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.Dir == "" {
+		return fmt.Errorf("hinted handoff dir must be specified")
+	}
+	if c.DirPerm&^0777 != 0 || c.DirPerm&0700 != 0700 {
+		return fmt.Errorf("hinted handoff dir-perm must give the owner read, write and execute permission: %s", c.DirPerm)
+	}
+
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("hinted handoff max-size must be positive: %d", c.MaxSize)
+	}
+	if c.HighWaterMark < 0 || c.HighWaterMark > c.MaxSize {
+		return fmt.Errorf("hinted handoff high-water-mark must be between 0 and max-size: %d", c.HighWaterMark)
+	}
+	if c.MaxBatchSize < 0 || c.MaxBatchSize > c.MaxSize {
+		return fmt.Errorf("hinted handoff max-batch-size must be between 0 and max-size: %d", c.MaxBatchSize)
+	}
+	if c.RetryRateLimit < 0 {
+		return fmt.Errorf("hinted handoff retry-rate-limit must not be negative: %d", c.RetryRateLimit)
+	}
+	if c.MaxProcessors < 0 {
+		return fmt.Errorf("hinted handoff max-processors must not be negative: %d", c.MaxProcessors)
+	}
+	if c.MaxConcurrentReplays < 0 {
+		return fmt.Errorf("hinted handoff max-concurrent-replays must not be negative: %d", c.MaxConcurrentReplays)
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("hinted handoff batch-size must not be negative: %d", c.BatchSize)
+	}
+	if c.ReadAheadBytes < 0 {
+		return fmt.Errorf("hinted handoff read-ahead-bytes must not be negative: %d", c.ReadAheadBytes)
+	}
+	if c.MaxAsyncWrites <= 0 {
+		return fmt.Errorf("hinted handoff max-async-writes must be positive: %d", c.MaxAsyncWrites)
+	}
+
+	for _, d := range []struct {
+		name string
+		d    toml.Duration
+	}{
+		{"max-age", c.MaxAge},
+		{"retry-interval", c.RetryInterval},
+		{"retry-max-interval", c.RetryMaxInterval},
+		{"purge-interval", c.PurgeInterval},
+		{"max-inactive-age", c.MaxInactiveAge},
+	} {
+		if d.d <= 0 {
+			return fmt.Errorf("hinted handoff %s must be positive: %s", d.name, time.Duration(d.d))
+		}
+	}
+	if c.RetryMaxInterval < c.RetryInterval {
+		return fmt.Errorf("hinted handoff retry-max-interval must not be less than retry-interval: %s", time.Duration(c.RetryMaxInterval))
+	}
+	if c.BatchInterval < 0 {
+		return fmt.Errorf("hinted handoff batch-interval must not be negative: %s", time.Duration(c.BatchInterval))
+	}
+	if c.KeepDrainedFor < 0 {
+		return fmt.Errorf("hinted handoff keep-drained-for must not be negative: %s", time.Duration(c.KeepDrainedFor))
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("hinted handoff write-timeout must not be negative: %s", time.Duration(c.WriteTimeout))
+	}
+	if c.MaxPointAge < 0 {
+		return fmt.Errorf("hinted handoff max-point-age must not be negative: %s", time.Duration(c.MaxPointAge))
+	}
+
+	switch c.SyncPolicy {
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if c.SyncInterval <= 0 {
+			return fmt.Errorf("hinted handoff sync-interval must be positive: %s", time.Duration(c.SyncInterval))
+		}
+	default:
+		return fmt.Errorf("hinted handoff sync-policy unknown: %q", c.SyncPolicy)
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package hh_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -16,9 +17,25 @@ enabled = false
 retry-interval = "10m"
 retry-max-interval = "100m"
 max-size=2048
+high-water-mark=1024
+max-batch-size=512
 max-age="20m"
 retry-rate-limit=1000
 purge-interval = "1h"
+max-inactive-age = "720h"
+max-processors = 10
+max-concurrent-replays = 4
+batch-size = 500
+batch-interval = "100ms"
+sync-policy = "interval"
+sync-interval = "50ms"
+keep-drained-for = "24h"
+validate-on-write = true
+write-timeout = "5s"
+max-point-age = "24h"
+dir-perm = "0750"
+read-ahead-bytes = 4096
+max-async-writes = 50
 `, &c); err != nil {
 		t.Fatal(err)
 	}
@@ -44,6 +61,14 @@ purge-interval = "1h"
 		t.Fatalf("unexpected retry interval: got %v, exp %v", c.MaxSize, exp)
 	}
 
+	if exp := int64(1024); c.HighWaterMark != exp {
+		t.Fatalf("unexpected high-water mark: got %v, exp %v", c.HighWaterMark, exp)
+	}
+
+	if exp := int64(512); c.MaxBatchSize != exp {
+		t.Fatalf("unexpected max batch size: got %v, exp %v", c.MaxBatchSize, exp)
+	}
+
 	if exp := int64(1000); c.RetryRateLimit != exp {
 		t.Fatalf("unexpected retry rate limit: got %v, exp %v", c.RetryRateLimit, exp)
 	}
@@ -52,4 +77,125 @@ purge-interval = "1h"
 		t.Fatalf("unexpected purge interval: got %v, exp %v", c.PurgeInterval, exp)
 	}
 
+	if exp := 720 * time.Hour; c.MaxInactiveAge.String() != exp.String() {
+		t.Fatalf("unexpected max inactive age: got %v, exp %v", c.MaxInactiveAge, exp)
+	}
+
+	if exp := 10; c.MaxProcessors != exp {
+		t.Fatalf("unexpected max processors: got %v, exp %v", c.MaxProcessors, exp)
+	}
+
+	if exp := 4; c.MaxConcurrentReplays != exp {
+		t.Fatalf("unexpected max concurrent replays: got %v, exp %v", c.MaxConcurrentReplays, exp)
+	}
+
+	if exp := 500; c.BatchSize != exp {
+		t.Fatalf("unexpected batch size: got %v, exp %v", c.BatchSize, exp)
+	}
+
+	if exp := 100 * time.Millisecond; c.BatchInterval.String() != exp.String() {
+		t.Fatalf("unexpected batch interval: got %v, exp %v", c.BatchInterval, exp)
+	}
+
+	if exp := hh.SyncInterval; c.SyncPolicy != exp {
+		t.Fatalf("unexpected sync policy: got %v, exp %v", c.SyncPolicy, exp)
+	}
+
+	if exp := 50 * time.Millisecond; c.SyncInterval.String() != exp.String() {
+		t.Fatalf("unexpected sync interval: got %v, exp %v", c.SyncInterval, exp)
+	}
+
+	if exp := 24 * time.Hour; c.KeepDrainedFor.String() != exp.String() {
+		t.Fatalf("unexpected keep drained for: got %v, exp %v", c.KeepDrainedFor, exp)
+	}
+
+	if exp := true; c.ValidateOnWrite != exp {
+		t.Fatalf("unexpected validate on write: got %v, exp %v", c.ValidateOnWrite, exp)
+	}
+
+	if exp := 5 * time.Second; c.WriteTimeout.String() != exp.String() {
+		t.Fatalf("unexpected write timeout: got %v, exp %v", c.WriteTimeout, exp)
+	}
+
+	if exp := 24 * time.Hour; c.MaxPointAge.String() != exp.String() {
+		t.Fatalf("unexpected max point age: got %v, exp %v", c.MaxPointAge, exp)
+	}
+
+	if exp := "0750"; c.DirPerm.String() != exp {
+		t.Fatalf("unexpected dir perm: got %v, exp %v", c.DirPerm, exp)
+	}
+
+	if exp := int64(4096); c.ReadAheadBytes != exp {
+		t.Fatalf("unexpected read ahead bytes: got %v, exp %v", c.ReadAheadBytes, exp)
+	}
+
+	if exp := 50; c.MaxAsyncWrites != exp {
+		t.Fatalf("unexpected max async writes: got %v, exp %v", c.MaxAsyncWrites, exp)
+	}
+
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := hh.NewConfig()
+	c.Dir = "/tmp/hh"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("default config validate failed: %v", err)
+	}
+
+	c = hh.NewConfig()
+	c.Enabled = false
+	if err := c.Validate(); err != nil {
+		t.Fatalf("disabled config validate failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		fn     func(c *hh.Config)
+		expErr string
+	}{
+		{"dir", func(c *hh.Config) { c.Dir = "" }, "dir"},
+		{"max size", func(c *hh.Config) { c.MaxSize = 0 }, "max-size"},
+		{"high-water mark negative", func(c *hh.Config) { c.HighWaterMark = -1 }, "high-water-mark"},
+		{"high-water mark above max size", func(c *hh.Config) { c.HighWaterMark = c.MaxSize + 1 }, "high-water-mark"},
+		{"max batch size negative", func(c *hh.Config) { c.MaxBatchSize = -1 }, "max-batch-size"},
+		{"max batch size above max size", func(c *hh.Config) { c.MaxBatchSize = c.MaxSize + 1 }, "max-batch-size"},
+		{"retry rate limit", func(c *hh.Config) { c.RetryRateLimit = -1 }, "retry-rate-limit"},
+		{"max processors", func(c *hh.Config) { c.MaxProcessors = -1 }, "max-processors"},
+		{"max concurrent replays", func(c *hh.Config) { c.MaxConcurrentReplays = -1 }, "max-concurrent-replays"},
+		{"batch size", func(c *hh.Config) { c.BatchSize = -1 }, "batch-size"},
+		{"read ahead bytes", func(c *hh.Config) { c.ReadAheadBytes = -1 }, "read-ahead-bytes"},
+		{"max async writes", func(c *hh.Config) { c.MaxAsyncWrites = 0 }, "max-async-writes"},
+		{"max age", func(c *hh.Config) { c.MaxAge = 0 }, "max-age"},
+		{"retry interval", func(c *hh.Config) { c.RetryInterval = 0 }, "retry-interval"},
+		{"retry max interval", func(c *hh.Config) { c.RetryMaxInterval = 0 }, "retry-max-interval"},
+		{"retry max interval below retry interval", func(c *hh.Config) {
+			c.RetryMaxInterval = c.RetryInterval - 1
+		}, "retry-max-interval"},
+		{"purge interval", func(c *hh.Config) { c.PurgeInterval = 0 }, "purge-interval"},
+		{"max inactive age", func(c *hh.Config) { c.MaxInactiveAge = -1 }, "max-inactive-age"},
+		{"batch interval", func(c *hh.Config) { c.BatchInterval = -1 }, "batch-interval"},
+		{"keep drained for", func(c *hh.Config) { c.KeepDrainedFor = -1 }, "keep-drained-for"},
+		{"write timeout", func(c *hh.Config) { c.WriteTimeout = -1 }, "write-timeout"},
+		{"max point age", func(c *hh.Config) { c.MaxPointAge = -1 }, "max-point-age"},
+		{"dir perm", func(c *hh.Config) { c.DirPerm = 0500 }, "dir-perm"},
+		{"dir perm bits", func(c *hh.Config) { c.DirPerm = 01700 }, "dir-perm"},
+		{"sync policy", func(c *hh.Config) { c.SyncPolicy = "sometimes" }, "sync-policy"},
+		{"sync interval", func(c *hh.Config) {
+			c.SyncPolicy = hh.SyncInterval
+			c.SyncInterval = 0
+		}, "sync-interval"},
+	}
+
+	for _, test := range tests {
+		c := hh.NewConfig()
+		c.Dir = "/tmp/hh"
+		test.fn(&c)
+
+		err := c.Validate()
+		if err == nil {
+			t.Fatalf("%s: expected error", test.name)
+		} else if !strings.Contains(err.Error(), test.expErr) {
+			t.Fatalf("%s: error mismatch: got %v, exp to contain %q", test.name, err, test.expErr)
+		}
+	}
 }
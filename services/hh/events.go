@@ -0,0 +1,106 @@
+package hh
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// Levels of events logged to an EventLogger.
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelError = "error"
+)
+
+// Events logged to an EventLogger.
+const (
+	EventQueueCreated  = "queue-created"  // A queue was created for a node.
+	EventDrainSuccess  = "drain-success"  // A queued write was sent to its node.
+	EventDrainFail     = "drain-fail"     // A queued write could not be sent, and will be retried.
+	EventDeadLetter    = "dead-letter"    // A queued write failed permanently, and was dead-lettered.
+	EventPointsStale   = "points-stale"   // Points older than the max point age were dropped.
+	EventPointsInvalid = "points-invalid" // Points not matching the schema were dropped.
+)
+
+// EventLogger logs hinted handoff events, such as data being sent to a node, so that they
+// can be processed by machine.  kv holds alternating keys and values describing the event,
+// such as the node, shard and bytes involved.
+type EventLogger interface {
+	Logf(level, msg string, kv ...interface{})
+}
+
+// NewEventLogger returns an EventLogger that writes events to l as a message followed by
+// key=value pairs.  Debug events are not written.
+func NewEventLogger(l *log.Logger) EventLogger {
+	return &stdEventLogger{l: l}
+}
+
+type stdEventLogger struct {
+	l *log.Logger
+}
+
+func (s *stdEventLogger) Logf(level, msg string, kv ...interface{}) {
+	if level == LevelDebug {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		var v interface{}
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		fmt.Fprintf(&buf, " %v=%v", kv[i], v)
+	}
+	s.l.Print(buf.String())
+}
+
+// replayEventBuffer is the number of replay events buffered for a subscriber.  Events
+// for a subscriber that falls further behind are dropped.
+const replayEventBuffer = 100
+
+// ReplayEvent describes a queued write that was sent to its node.
+type ReplayEvent struct {
+	NodeID         uint64
+	ShardID        uint64
+	Points         int   // Points in the write.
+	RemainingBytes int64 // Bytes still waiting to be sent to the node.
+}
+
+// Subscribe returns a channel receiving an event each time queued data is sent to a
+// node, such as for showing the progress of draining the queues.  Sending data never
+// waits for the channel to be read, so events are dropped if it falls behind.
+func (s *Service) Subscribe() <-chan ReplayEvent {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	c := make(chan ReplayEvent, replayEventBuffer)
+	s.subs[c] = c
+	return c
+}
+
+// Unsubscribe stops events being sent to a channel returned by Subscribe, and closes it.
+func (s *Service) Unsubscribe(c <-chan ReplayEvent) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	if sub, ok := s.subs[c]; ok {
+		delete(s.subs, c)
+		close(sub)
+	}
+}
+
+// publishReplay sends e to each subscriber with room for it.
+func (s *Service) publishReplay(e ReplayEvent) {
+	s.subsMu.RLock()
+	defer s.subsMu.RUnlock()
+
+	for _, c := range s.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package hh_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+
+	"github.com/influxdb/influxdb/services/hh"
+)
+
+func TestEventLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := hh.NewEventLogger(log.New(&buf, "", 0))
+
+	l.Logf(hh.LevelDebug, hh.EventDrainSuccess, "node", 1, "shard", 100)
+	l.Logf(hh.LevelError, hh.EventDrainFail, "node", 1, "shard", 100, "error", fmt.Errorf("timeout"))
+
+	if exp := "drain-fail node=1 shard=100 error=timeout\n"; buf.String() != exp {
+		t.Fatalf("log mismatch: got %q, exp %q", buf.String(), exp)
+	}
+}
@@ -0,0 +1,187 @@
+package hh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/influxdb/influxdb/toml"
+)
+
+// nodeConfigFile is the name of the file, in the service's directory, holding the
+// configuration overrides of nodes.
+const nodeConfigFile = "nodes.json"
+
+// NodeConfig overrides the service configuration for the queue of a single node.  Zero
+// fields use the service configuration, so an override can't disable a limit that the
+// service configuration sets.
+type NodeConfig struct {
+	MaxSize          int64         `json:"maxSize,omitempty"`
+	HighWaterMark    int64         `json:"highWaterMark,omitempty"`
+	MaxBatchSize     int64         `json:"maxBatchSize,omitempty"`
+	RetryInterval    time.Duration `json:"retryInterval,omitempty"`
+	RetryMaxInterval time.Duration `json:"retryMaxInterval,omitempty"`
+	RetryRateLimit   int64         `json:"retryRateLimit,omitempty"`
+}
+
+// apply returns c with the fields set in the override replacing its own.
+func (o NodeConfig) apply(c Config) Config {
+	if o.MaxSize != 0 {
+		c.MaxSize = o.MaxSize
+	}
+	if o.HighWaterMark != 0 {
+		c.HighWaterMark = o.HighWaterMark
+	}
+	if o.MaxBatchSize != 0 {
+		c.MaxBatchSize = o.MaxBatchSize
+	}
+	if o.RetryInterval != 0 {
+		c.RetryInterval = toml.Duration(o.RetryInterval)
+	}
+	if o.RetryMaxInterval != 0 {
+		c.RetryMaxInterval = toml.Duration(o.RetryMaxInterval)
+	}
+	if o.RetryRateLimit != 0 {
+		c.RetryRateLimit = o.RetryRateLimit
+	}
+	return c
+}
+
+// SetNodeConfig overrides the service configuration for the queue of the node.  The
+// override is saved in the service's directory, so it applies after a restart, and a
+// zero override removes it.  The node's processor, if it has one, is reopened to use the
+// new configuration, keeping whether sending is paused, its last error and its throughput.
+func (s *Service) SetNodeConfig(nodeID uint64, override NodeConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := override.apply(s.cfg)
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("node %d: %s", nodeID, err)
+	}
+
+	configs := make(map[uint64]NodeConfig, len(s.nodeConfigs)+1)
+	for k, v := range s.nodeConfigs {
+		configs[k] = v
+	}
+	if override == (NodeConfig{}) {
+		delete(configs, nodeID)
+	} else {
+		configs[nodeID] = override
+	}
+	if err := s.saveNodeConfigs(configs); err != nil {
+		return err
+	}
+	s.nodeConfigs = configs
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return nil
+	}
+	if err := processor.Close(); err != nil {
+		return err
+	}
+	old := processor
+	processor = s.newNodeProcessor(nodeID)
+	processor.inheritState(old)
+	if err := processor.Open(); err != nil {
+		delete(s.processors, nodeID)
+		s.setNodePending(nodeID, false)
+		return err
+	}
+	s.processors[nodeID] = processor
+	return nil
+}
+
+// configForNode returns the service configuration with the node's override applied.
+func (s *Service) configForNode(nodeID uint64) Config {
+	if o, ok := s.nodeConfigs[nodeID]; ok {
+		return o.apply(s.cfg)
+	}
+	return s.cfg
+}
+
+// saveNodeConfigs replaces the saved configuration overrides of nodes with configs.
+func (s *Service) saveNodeConfigs(configs map[uint64]NodeConfig) error {
+	// JSON object keys must be strings.
+	m := make(map[string]NodeConfig, len(configs))
+	for k, v := range configs {
+		m[strconv.FormatUint(k, 10)] = v
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.MkdirAll(s.cfg.Dir); err != nil {
+		return fmt.Errorf("mkdir all: %s", err)
+	}
+
+	// Write a new file and rename it over the old one, so a crash can't leave a partial file.
+	path := filepath.Join(s.cfg.Dir, nodeConfigFile)
+	f, err := s.store.OpenFile(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return s.store.Rename(path+".tmp", path)
+}
+
+// loadNodeConfigs reads the saved configuration overrides of nodes, if there are any.
+func (s *Service) loadNodeConfigs() error {
+	// Check the file exists first, since opening a file of the store creates it.
+	files, err := s.store.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, fi := range files {
+		if fi.Name() == nodeConfigFile && !fi.IsDir() {
+			found = true
+		}
+	}
+	if !found {
+		s.nodeConfigs = make(map[uint64]NodeConfig)
+		return nil
+	}
+
+	f, err := s.store.OpenFile(filepath.Join(s.cfg.Dir, nodeConfigFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var m map[string]NodeConfig
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("node config: %s", err)
+	}
+
+	configs := make(map[uint64]NodeConfig, len(m))
+	for k, v := range m {
+		nodeID, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			return fmt.Errorf("node config: invalid node ID: %q", k)
+		}
+		configs[nodeID] = v
+	}
+	s.nodeConfigs = configs
+	return nil
+}
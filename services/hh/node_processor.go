@@ -1,18 +1,44 @@
 package hh
 
 import (
+	"bytes"
 	"encoding/binary"
 	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/influxdb/influxdb"
 	"github.com/influxdb/influxdb/models"
+	"github.com/influxdb/influxdb/tsdb"
+)
+
+// throughputWeight is the weight given to each new measurement of the rate data is sent
+// to a node, in the moving average of the rate.
+const throughputWeight = 0.2
+
+// hintPrefix starts the comment line holding the hint of a marshaled write.
+var hintPrefix = []byte("#hint ")
+
+// errClosing is returned when sending data stops because the NodeProcessor is closing.
+var errClosing = fmt.Errorf("node processor closing")
+
+const (
+	// deadLetterDir is the directory, under the NodeProcessor's directory, where writes
+	// that failed permanently are kept.
+	deadLetterDir = "deadletter"
+
+	// archiveDir is the directory, under the NodeProcessor's directory, where segments
+	// are kept once their data has been sent.
+	archiveDir = "archive"
 )
 
 // NodeProcessor encapsulates a queue of hinted-handoff data for a node, and the
@@ -22,21 +48,79 @@ type NodeProcessor struct {
 	RetryInterval    time.Duration // Interval between periodic write-to-node attempts.
 	RetryMaxInterval time.Duration // Max interval between periodic write-to-node attempts.
 	MaxSize          int64         // Maximum size an underlying queue can get.
+	HighWaterMark    int64         // Queue size above which writes return ErrHighWaterMark.
+	MaxBatchSize     int64         // Maximum size of a single write. Zero disables the limit.
 	MaxAge           time.Duration // Maximum age queue data can get before purging.
 	RetryRateLimit   int64         // Limits the rate data is sent to node.
+	BatchSize        int           // Number of buffered points that causes a flush to the queue.
+	BatchInterval    time.Duration // Max time writes are buffered. Zero disables buffering.
+	SyncPolicy       string        // When queued writes are synced to disk.
+	SyncInterval     time.Duration // Interval between syncs for the SyncInterval policy.
+	KeepDrainedFor   time.Duration // How long drained segments are archived. Zero disables it.
+	WriteTimeout     time.Duration // Max time sending a write can take. Zero disables it.
+	ReadAheadBytes   int64         // Max bytes of writes read ahead while sending. Zero disables it.
 	nodeID           uint64
 	dir              string
 
-	mu   sync.RWMutex
-	wg   sync.WaitGroup
-	done chan struct{}
+	mu      sync.RWMutex
+	wg      sync.WaitGroup
+	done    chan struct{}
+	closing bool
+
+	// Held while sending queued data, so writes aren't sent twice by concurrent replays.
+	replayMu sync.Mutex
+
+	// The result of the last send to exceed WriteTimeout, if it hasn't finished.  No other
+	// send starts until it does, so a hung node can't leave a goroutine behind per retry.
+	// Guarded by replayMu.
+	inflight chan error
+
+	// Writes buffered in memory before being appended to the queue.  bufBytes also counts
+	// writes being flushed, so the queue space they need stays reserved until they're in it.
+	flushMu   sync.Mutex
+	bufMu     sync.Mutex
+	buf       [][]byte
+	bufPoints int
+	bufBytes  int64
+
+	store       queueStore
+	replays     chan struct{} // Shared by processors to limit concurrent sending, if not nil.
+	queue       *queue
+	deadLetters *queue
+	meta        metaStore
+	writer      shardWriter
+
+	// Number of points and bytes in the queue waiting to be sent.
+	pendingPoints int64
+	pendingBytes  int64
+
+	// Number of writes in the queue waiting to be sent, for each shard.
+	shardsMu      sync.Mutex
+	pendingShards map[uint64]int64
+
+	// Whether writes were waiting to be sent, buffered or queued, when pendingChanged was
+	// last called.  pendingChanged is called when that changes, if not nil.
+	notifyMu        sync.Mutex
+	notifiedPending bool
+	pendingChanged  func(pending bool)
 
-	queue  *queue
-	meta   metaStore
-	writer shardWriter
+	// Non-zero if sending data to the node is paused.
+	paused int32
 
-	statMap *expvar.Map
-	Logger  *log.Logger
+	// The most recent error sending data to the node, cleared by a successful send.
+	errMu       sync.Mutex
+	lastErr     error
+	lastErrTime time.Time
+
+	// Moving average of the rate data is sent to the node, in bytes per second.
+	throughputMu sync.Mutex
+	throughput   float64
+
+	statMap        *expvar.Map
+	serviceStatMap *expvar.Map         // Statistics of the owning Service, if any.
+	replayed       func(e ReplayEvent) // Called when a write is sent to the node, if not nil.
+	Logger         *log.Logger
+	EventLogger    EventLogger // Logs events for processing by machine. If nil, they go to Logger.
 }
 
 // NewNodeProcessor returns a new NodeProcessor for the given node, using dir for
@@ -51,8 +135,13 @@ func NewNodeProcessor(nodeID uint64, dir string, w shardWriter, m metaStore) *No
 		RetryMaxInterval: DefaultRetryMaxInterval,
 		MaxSize:          DefaultMaxSize,
 		MaxAge:           DefaultMaxAge,
+		BatchSize:        DefaultBatchSize,
+		BatchInterval:    DefaultBatchInterval,
+		SyncPolicy:       DefaultSyncPolicy,
+		SyncInterval:     DefaultSyncInterval,
 		nodeID:           nodeID,
 		dir:              dir,
+		store:            fileStore{},
 		writer:           w,
 		meta:             m,
 		statMap:          influxdb.NewStatistics(key, "hh_processor", tags),
@@ -71,26 +160,75 @@ func (n *NodeProcessor) Open() error {
 		// Already open.
 		return nil
 	}
+
+	switch n.SyncPolicy {
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return fmt.Errorf("unknown sync policy: %q", n.SyncPolicy)
+	}
 	n.done = make(chan struct{})
 
 	// Create the queue directory if it doesn't already exist.
-	if err := os.MkdirAll(n.dir, 0700); err != nil {
+	if err := n.store.MkdirAll(n.dir); err != nil {
 		return fmt.Errorf("mkdir all: %s", err)
 	}
 
 	// Create the queue of hinted-handoff data.
-	queue, err := newQueue(n.dir, n.MaxSize)
+	queue, err := newQueue(n.store, n.dir, n.MaxSize)
 	if err != nil {
 		return err
 	}
 	if err := queue.Open(); err != nil {
 		return err
 	}
+	queue.SetSyncAppends(n.SyncPolicy == SyncAlways)
+	queue.SetReadAhead(n.ReadAheadBytes)
 	n.queue = queue
 
+	// Archive drained segments, if they are to be kept.
+	if n.KeepDrainedFor > 0 {
+		if err := n.store.MkdirAll(filepath.Join(n.dir, archiveDir)); err != nil {
+			return fmt.Errorf("mkdir all: %s", err)
+		}
+		queue.SetArchiveDir(filepath.Join(n.dir, archiveDir))
+	}
+
+	// Report any data lost from segments that were not completely written.
+	for path, sz := range queue.Truncated() {
+		n.Logger.Printf("truncated partial write in %s for node %d: dropped %d bytes", path, n.nodeID, sz)
+	}
+
+	if err := n.countPending(); err != nil {
+		return err
+	}
+
+	// Create the queue of writes that failed permanently.
+	if err := n.store.MkdirAll(filepath.Join(n.dir, deadLetterDir)); err != nil {
+		return fmt.Errorf("mkdir all: %s", err)
+	}
+
+	deadLetters, err := newQueue(n.store, filepath.Join(n.dir, deadLetterDir), n.MaxSize)
+	if err != nil {
+		return err
+	}
+	if err := deadLetters.Open(); err != nil {
+		return err
+	}
+	n.deadLetters = deadLetters
+
 	n.wg.Add(1)
 	go n.run()
 
+	if n.BatchInterval > 0 {
+		n.wg.Add(1)
+		go n.flushBuffered()
+	}
+
+	if n.SyncPolicy == SyncInterval {
+		n.wg.Add(1)
+		go n.syncPeriodically()
+	}
+
 	return nil
 }
 
@@ -98,17 +236,40 @@ func (n *NodeProcessor) Open() error {
 // When closed it will not accept hinted-handoff data.
 func (n *NodeProcessor) Close() error {
 	n.mu.Lock()
-	defer n.mu.Unlock()
-
-	if n.done == nil {
+	if n.done == nil || n.closing {
 		// Already closed.
+		n.mu.Unlock()
 		return nil
 	}
-
 	close(n.done)
+	n.closing = true
+	n.mu.Unlock()
+
+	// Wait without the lock, since sending data takes it.
 	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	n.done = nil
+	n.closing = false
+
+	if err := n.flush(); err != nil {
+		n.bufMu.Lock()
+		n.Logger.Printf("failed to flush buffered writes for node %d, dropping %d points: %s", n.nodeID, n.bufPoints, err.Error())
+		n.addStat(pointsDropped, int64(n.bufPoints))
+		n.buf, n.bufPoints, n.bufBytes = nil, 0, 0
+		n.bufMu.Unlock()
+	}
 
+	if n.SyncPolicy == SyncInterval {
+		if err := n.queue.Sync(); err != nil {
+			n.Logger.Printf("failed to sync queue for node %d: %s", n.nodeID, err.Error())
+		}
+	}
+
+	if err := n.deadLetters.Close(); err != nil {
+		return err
+	}
 	return n.queue.Close()
 }
 
@@ -122,12 +283,21 @@ func (n *NodeProcessor) Purge() error {
 		return fmt.Errorf("node processor is open")
 	}
 
-	return os.RemoveAll(n.dir)
+	return n.store.RemoveAll(n.dir)
 }
 
 // WriteShard writes hinted-handoff data for the given shard and node. Since it may manipulate
 // hinted-handoff queues, and be called concurrently, it takes a lock during queue access.
+// ErrHighWaterMark is returned if the data was written but the queue is above the
+// high-water mark, ErrBatchTooLarge if the data is larger than MaxBatchSize, and
+// ErrQueueFull if the queue, including writes buffered for it, has no room for the data.
 func (n *NodeProcessor) WriteShard(shardID uint64, points []models.Point) error {
+	return n.WriteShardWithHint(shardID, points, "")
+}
+
+// WriteShardWithHint writes hinted-handoff data like WriteShard, storing hint, describing
+// why the data was handed off, along with it.
+func (n *NodeProcessor) WriteShardWithHint(shardID uint64, points []models.Point, hint string) error {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 
@@ -138,8 +308,515 @@ func (n *NodeProcessor) WriteShard(shardID uint64, points []models.Point) error
 	n.statMap.Add(writeShardReq, 1)
 	n.statMap.Add(writeShardReqPoints, int64(len(points)))
 
-	b := marshalWrite(shardID, points)
-	return n.queue.Append(b)
+	b := marshalHintedWrite(shardID, hint, points)
+	if n.MaxBatchSize > 0 && int64(len(b)) > n.MaxBatchSize {
+		return ErrBatchTooLarge
+	}
+
+	if n.BatchInterval <= 0 {
+		if err := n.queue.Append(b); err != nil {
+			return err
+		}
+		n.addPending(int64(len(points)), int64(len(b)))
+		n.addPendingShards(1, b)
+	} else {
+		// Buffer the write, flushing if the buffer is full.  The write is only accepted if
+		// the queue has room for it along with the writes already buffered, so flushing
+		// can't fail for lack of space.
+		n.bufMu.Lock()
+		if n.queue.Size()+n.bufBytes+int64(len(b)) > n.MaxSize {
+			n.bufMu.Unlock()
+			return ErrQueueFull
+		}
+		n.buf = append(n.buf, b)
+		n.bufPoints += len(points)
+		n.bufBytes += int64(len(b))
+		full := n.bufPoints >= n.BatchSize
+		n.bufMu.Unlock()
+		n.notifyPending()
+
+		if full {
+			if err := n.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.HighWaterMark > 0 && n.queue.Size() > n.HighWaterMark {
+		return ErrHighWaterMark
+	}
+	return nil
+}
+
+// flush appends any buffered writes to the queue.  If the writes can't be appended,
+// they are kept buffered, ahead of any buffered since, to be appended by the next flush.
+func (n *NodeProcessor) flush() error {
+	n.flushMu.Lock()
+	defer n.flushMu.Unlock()
+
+	n.bufMu.Lock()
+	buf, points := n.buf, n.bufPoints
+	n.buf, n.bufPoints = nil, 0
+	n.bufMu.Unlock()
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var size int64
+	for _, b := range buf {
+		size += int64(len(b))
+	}
+
+	err := n.queue.Append(buf...)
+	n.bufMu.Lock()
+	if err != nil {
+		n.buf = append(buf, n.buf...)
+		n.bufPoints += points
+	} else {
+		n.bufBytes -= size
+	}
+	n.bufMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	n.addPending(int64(points), size)
+	n.addPendingShards(1, buf...)
+
+	return nil
+}
+
+// flushBuffered periodically appends buffered writes to the queue.
+func (n *NodeProcessor) flushBuffered() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.BatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			if err := n.flush(); err != nil {
+				n.Logger.Printf("failed to flush buffered writes for node %d: %s", n.nodeID, err.Error())
+			}
+		}
+	}
+}
+
+// QueueLen returns the number of points and bytes waiting to be sent to the node.
+func (n *NodeProcessor) QueueLen() (points int64, bytes int64, err error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.done == nil {
+		return 0, 0, fmt.Errorf("node processor is closed")
+	}
+
+	return atomic.LoadInt64(&n.pendingPoints), atomic.LoadInt64(&n.pendingBytes), nil
+}
+
+// countPending sets the number of points and bytes waiting to be sent by reading
+// the queue from the head.
+func (n *NodeProcessor) countPending() error {
+	var points, size int64
+	shards := make(map[uint64]int64)
+	if err := n.queue.forEach(func(b []byte) error {
+		points += blockPoints(b)
+		size += int64(len(b))
+		if len(b) >= 8 {
+			shards[binary.BigEndian.Uint64(b[:8])]++
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&n.pendingPoints, points)
+	atomic.StoreInt64(&n.pendingBytes, size)
+
+	n.shardsMu.Lock()
+	n.pendingShards = shards
+	n.shardsMu.Unlock()
+
+	n.notifyPending()
+	return nil
+}
+
+// addPending adjusts the number of points and bytes waiting to be sent.
+func (n *NodeProcessor) addPending(points, bytes int64) {
+	atomic.AddInt64(&n.pendingPoints, points)
+	atomic.AddInt64(&n.pendingBytes, bytes)
+	n.notifyPending()
+}
+
+// notifyPending calls pendingChanged if whether writes are waiting to be sent has changed
+// since it was last called.
+func (n *NodeProcessor) notifyPending() {
+	if n.pendingChanged == nil {
+		return
+	}
+
+	n.notifyMu.Lock()
+	defer n.notifyMu.Unlock()
+
+	n.bufMu.Lock()
+	pending := n.bufPoints > 0
+	n.bufMu.Unlock()
+	pending = pending || atomic.LoadInt64(&n.pendingBytes) > 0
+
+	if pending != n.notifiedPending {
+		n.notifiedPending = pending
+		n.pendingChanged(pending)
+	}
+}
+
+// addPendingShards adjusts the number of writes waiting to be sent for the shard of each
+// marshaled write in blocks.
+func (n *NodeProcessor) addPendingShards(delta int64, blocks ...[]byte) {
+	n.shardsMu.Lock()
+	defer n.shardsMu.Unlock()
+
+	for _, b := range blocks {
+		if len(b) < 8 {
+			continue
+		}
+		shardID := binary.BigEndian.Uint64(b[:8])
+		if n.pendingShards[shardID] += delta; n.pendingShards[shardID] <= 0 {
+			delete(n.pendingShards, shardID)
+		}
+	}
+}
+
+// PendingShards returns the IDs of the shards with writes waiting to be sent to the
+// node, in order.
+func (n *NodeProcessor) PendingShards() ([]uint64, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.done == nil {
+		return nil, fmt.Errorf("node processor is closed")
+	}
+
+	n.shardsMu.Lock()
+	ids := make([]uint64, 0, len(n.pendingShards))
+	for k := range n.pendingShards {
+		ids = append(ids, k)
+	}
+	n.shardsMu.Unlock()
+
+	sort.Sort(uint64Slice(ids))
+	return ids, nil
+}
+
+// NodeStats are statistics for the hinted-handoff data of a node.
+type NodeStats struct {
+	PendingPoints int64 // Points waiting to be sent to the node.
+	PendingBytes  int64 // Bytes waiting to be sent to the node.
+	ArchivedBytes int64 // Bytes of drained segments kept in the archive.
+	Paused        bool  // Whether sending data to the node is paused.
+}
+
+// Stats returns statistics for the node's hinted-handoff data.
+func (n *NodeProcessor) Stats() (NodeStats, error) {
+	points, bytes, err := n.QueueLen()
+	if err != nil {
+		return NodeStats{}, err
+	}
+
+	var archived int64
+	if err := n.forEachArchived(func(fi os.FileInfo, _ time.Time) error {
+		archived += fi.Size()
+		return nil
+	}); err != nil {
+		return NodeStats{}, err
+	}
+
+	return NodeStats{
+		PendingPoints: points,
+		PendingBytes:  bytes,
+		ArchivedBytes: archived,
+		Paused:        n.Paused(),
+	}, nil
+}
+
+// VerifyReport is the result of checking the data queued for a node with Verify.
+type VerifyReport struct {
+	Records int64           // Records waiting to be sent, including corrupt ones.
+	Bytes   int64           // Bytes of the records.
+	Corrupt []CorruptRecord // Records that can't be read.
+}
+
+// CorruptRecord identifies a queued record that can't be read.
+type CorruptRecord struct {
+	Segment string // Path of the segment holding the record.
+	Offset  int64  // Offset of the record in the segment.
+	Err     error  // Why the record can't be read.
+}
+
+// Verify checks that the data waiting to be sent to the node can be read, without
+// modifying it.  If a record's length is corrupt, the rest of its segment can't be
+// read and isn't counted.
+func (n *NodeProcessor) Verify() (VerifyReport, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.done == nil {
+		return VerifyReport{}, fmt.Errorf("node processor is closed")
+	}
+
+	var r VerifyReport
+	if err := n.queue.verify(func(path string, pos int64, b []byte, err error) {
+		if err == nil {
+			r.Records++
+			r.Bytes += int64(len(b))
+			_, _, err = unmarshalWrite(b)
+		}
+		if err != nil {
+			r.Corrupt = append(r.Corrupt, CorruptRecord{Segment: path, Offset: pos, Err: err})
+		}
+	}); err != nil {
+		return VerifyReport{}, err
+	}
+	return r, nil
+}
+
+// Snapshot copies the data queued for the node, including dead-lettered writes, to dir
+// so that a NodeProcessor opened on dir has the data queued when it was called.  Buffered
+// writes are flushed first.  Writes wait only until the segments of the queues are opened,
+// and the data is copied after.  It returns the number of points and bytes waiting to be
+// sent in the copy.
+func (n *NodeProcessor) Snapshot(dir string) (points int64, bytes int64, err error) {
+	queue, deadLetters, points, bytes, err := n.takeSnapshot()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer queue.Close()
+	defer deadLetters.Close()
+
+	if err := queue.copyTo(dir); err != nil {
+		return 0, 0, err
+	}
+	if err := deadLetters.copyTo(filepath.Join(dir, deadLetterDir)); err != nil {
+		return 0, 0, err
+	}
+	return points, bytes, nil
+}
+
+// takeSnapshot flushes buffered writes and takes snapshots of the queue and the
+// dead-lettered writes, along with the number of points and bytes waiting to be sent.
+func (n *NodeProcessor) takeSnapshot() (queue, deadLetters *queueSnapshot, points, bytes int64, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.done == nil {
+		return nil, nil, 0, 0, fmt.Errorf("node processor is closed")
+	}
+
+	if err := n.flush(); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if queue, err = n.queue.takeSnapshot(); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if deadLetters, err = n.deadLetters.takeSnapshot(); err != nil {
+		queue.Close()
+		return nil, nil, 0, 0, err
+	}
+	return queue, deadLetters, atomic.LoadInt64(&n.pendingPoints), atomic.LoadInt64(&n.pendingBytes), nil
+}
+
+// Compact rewrites the data waiting to be sent to the node into as few segments as it
+// fits in, removing segments that were partly sent or left small.  Data isn't sent, and
+// writes wait, until it is complete.
+func (n *NodeProcessor) Compact() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.done == nil {
+		return fmt.Errorf("node processor is closed")
+	}
+
+	if err := n.flush(); err != nil {
+		return err
+	}
+	return n.queue.compact()
+}
+
+// purgeArchive removes archived segments that were drained longer than KeepDrainedFor
+// before now.
+func (n *NodeProcessor) purgeArchive(now time.Time) error {
+	return n.forEachArchived(func(fi os.FileInfo, drained time.Time) error {
+		if drained.Add(n.KeepDrainedFor).After(now) {
+			return nil
+		}
+		return n.store.Remove(filepath.Join(n.dir, archiveDir, fi.Name()))
+	})
+}
+
+// forEachArchived calls fn for each archived segment, with the time it was drained.
+func (n *NodeProcessor) forEachArchived(fn func(fi os.FileInfo, drained time.Time) error) error {
+	files, err := n.store.ReadDir(filepath.Join(n.dir, archiveDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		// Archived segments are named by the time they were drained.
+		i := strings.Index(fi.Name(), ".")
+		if fi.IsDir() || i < 0 {
+			continue
+		}
+		ns, err := strconv.ParseInt(fi.Name()[:i], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if err := fn(fi, time.Unix(0, ns)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pause stops data being sent to the node in the background until Resume is called.
+// Writes are still queued while paused.
+func (n *NodeProcessor) Pause() {
+	atomic.StoreInt32(&n.paused, 1)
+}
+
+// Resume resumes sending data to the node after Pause.
+func (n *NodeProcessor) Resume() {
+	atomic.StoreInt32(&n.paused, 0)
+}
+
+// SetWriter sets the writer data is sent to the node with.  It waits for any write in
+// progress to finish.
+func (n *NodeProcessor) SetWriter(w shardWriter) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.writer = w
+}
+
+// Paused returns whether sending data to the node is paused.
+func (n *NodeProcessor) Paused() bool {
+	return atomic.LoadInt32(&n.paused) != 0
+}
+
+// Peek returns up to the next n points waiting to be sent to the node, without
+// removing them from the queue.  No points are returned if limit isn't positive.
+func (n *NodeProcessor) Peek(limit int) ([]models.Point, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.done == nil {
+		return nil, fmt.Errorf("node processor is closed")
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	var points []models.Point
+	if err := n.queue.forEach(func(b []byte) error {
+		if len(points) >= limit {
+			return io.EOF
+		}
+
+		_, p, err := unmarshalWrite(b)
+		if err != nil {
+			return err
+		}
+		points = append(points, p...)
+		return nil
+	}); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(points) > limit {
+		points = points[:limit]
+	}
+	return points, nil
+}
+
+// DeadLettered returns the points in writes that failed permanently.
+func (n *NodeProcessor) DeadLettered() ([]models.Point, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.done == nil {
+		return nil, fmt.Errorf("node processor is closed")
+	}
+
+	var points []models.Point
+	if err := n.deadLetters.forEach(func(b []byte) error {
+		_, p, err := unmarshalWrite(b)
+		if err != nil {
+			return err
+		}
+		points = append(points, p...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// RequeueDeadLetters moves writes that failed permanently back to the end of the
+// queue, so they will be sent to the node again.  Buffered writes are flushed first, so
+// the requeued writes can't take the space reserved for them.
+func (n *NodeProcessor) RequeueDeadLetters() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.done == nil {
+		return fmt.Errorf("node processor is closed")
+	}
+
+	if err := n.flush(); err != nil {
+		return err
+	}
+
+	for {
+		b, err := n.deadLetters.Current()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := n.queue.Append(b); err != nil {
+			return err
+		}
+		n.addPending(blockPoints(b), int64(len(b)))
+		n.addPendingShards(1, b)
+
+		if err := n.deadLetters.Advance(); err != nil {
+			return err
+		}
+	}
+}
+
+// syncPeriodically syncs the queue to disk every SyncInterval.
+func (n *NodeProcessor) syncPeriodically() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			if err := n.queue.Sync(); err != nil {
+				n.Logger.Printf("failed to sync queue for node %d: %s", n.nodeID, err.Error())
+			}
+		}
+	}
 }
 
 // LastModified returns the time the NodeProcessor last receieved hinted-handoff data.
@@ -161,55 +838,150 @@ func (n *NodeProcessor) run() {
 		currInterval = time.Duration(n.RetryMaxInterval)
 	}
 
+	// Purging and retrying are timed separately, so that the other firing more often
+	// doesn't keep either from happening.
+	purge := time.NewTicker(n.PurgeInterval)
+	defer purge.Stop()
+	retry := time.NewTimer(currInterval)
+	defer retry.Stop()
+
 	for {
 		select {
 		case <-n.done:
 			return
 
-		case <-time.After(n.PurgeInterval):
+		case <-purge.C:
+			before := atomic.LoadInt64(&n.pendingPoints)
 			if err := n.queue.PurgeOlderThan(time.Now().Add(-n.MaxAge)); err != nil {
 				n.Logger.Printf("failed to purge for node %d: %s", n.nodeID, err.Error())
 			}
+			if err := n.countPending(); err != nil {
+				n.Logger.Printf("failed to count pending data for node %d: %s", n.nodeID, err.Error())
+			} else if dropped := before - atomic.LoadInt64(&n.pendingPoints); dropped > 0 {
+				n.addStat(pointsDropped, dropped)
+			}
+			if err := n.purgeArchive(time.Now()); err != nil {
+				n.Logger.Printf("failed to purge archived segments for node %d: %s", n.nodeID, err.Error())
+			}
 
-		case <-time.After(currInterval):
-			limiter := NewRateLimiter(n.RetryRateLimit)
-			for {
-				c, err := n.SendWrite()
-				if err != nil {
-					if err == io.EOF {
-						// No more data, return to configured interval
-						currInterval = time.Duration(n.RetryInterval)
-					} else {
-						currInterval = currInterval * 2
-						if currInterval > time.Duration(n.RetryMaxInterval) {
-							currInterval = time.Duration(n.RetryMaxInterval)
-						}
-					}
-					break
-				}
+		case <-retry.C:
+			sent, err := n.replay()
+			if err == errClosing {
+				return
+			}
 
-				// Success! Ensure backoff is cancelled.
+			// Success! Ensure backoff is cancelled.
+			if sent {
 				currInterval = time.Duration(n.RetryInterval)
+			}
 
-				// Update how many bytes we've sent
-				limiter.Update(c)
-
-				// Block to maintain the throughput rate
-				time.Sleep(limiter.Delay())
+			if err == io.EOF {
+				// No more data, return to configured interval
+				currInterval = time.Duration(n.RetryInterval)
+			} else if err != nil {
+				currInterval = currInterval * 2
+				if currInterval > time.Duration(n.RetryMaxInterval) {
+					currInterval = time.Duration(n.RetryMaxInterval)
+				}
 			}
+			retry.Reset(currInterval)
+		}
+	}
+}
+
+// Replay sends any buffered and queued data to the node now, rather than waiting for the
+// next retry interval, and returns once it has all been sent, sending is paused, or
+// sending fails.  Like sending on the retry interval, it waits for a turn to send if the
+// number of nodes sending at once is limited, and sends no faster than RetryRateLimit.
+func (n *NodeProcessor) Replay() error {
+	n.mu.RLock()
+	closed := n.done == nil
+	n.mu.RUnlock()
+	if closed {
+		return fmt.Errorf("node processor is closed")
+	}
+
+	if err := n.flush(); err != nil {
+		return err
+	}
+
+	if _, err := n.replay(); err == errClosing {
+		return fmt.Errorf("node processor is closed")
+	} else if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// replay sends queued data to the node until there is none left, sending is paused, or
+// sending fails, and returns whether any data was sent.  io.EOF is returned if no data
+// is left, and errClosing if the processor started closing before it finished.
+func (n *NodeProcessor) replay() (sent bool, err error) {
+	n.mu.RLock()
+	done := n.done
+	n.mu.RUnlock()
+	if done == nil {
+		return false, errClosing
+	}
+
+	// Wait for a turn to send, if sending is limited.
+	if n.replays != nil {
+		select {
+		case n.replays <- struct{}{}:
+		case <-done:
+			return false, errClosing
 		}
+		defer func() { <-n.replays }()
 	}
+
+	n.replayMu.Lock()
+	defer n.replayMu.Unlock()
+
+	limiter := NewRateLimiter(n.RetryRateLimit)
+	for !n.Paused() {
+		// Stop between writes when closing, so Close doesn't wait for the whole queue.
+		select {
+		case <-done:
+			return sent, errClosing
+		default:
+		}
+
+		start := time.Now()
+		c, err := n.SendWrite()
+		if err != nil {
+			return sent, err
+		}
+		sent = true
+
+		// Update how many bytes we've sent
+		limiter.Update(c)
+
+		// Block to maintain the throughput rate
+		select {
+		case <-time.After(limiter.Delay()):
+		case <-done:
+			return sent, errClosing
+		}
+
+		n.recordThroughput(c, time.Since(start))
+	}
+	return sent, nil
 }
 
 // SendWrite attempts to sent the current block of hinted data to the target node. If successful,
 // it returns the number of bytes it sent and advances to the next block. Otherwise returns EOF
 // when there is no more data or the node is inactive.
+//
+// If the write fails with an error that can't be retried, or that has a Permanent method
+// returning true, the block is moved to the dead-letter queue so the rest of the data can
+// be sent.
 func (n *NodeProcessor) SendWrite() (int, error) {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 
 	active, err := n.Active()
 	if err != nil {
+		n.setLastError(err)
 		return 0, err
 	}
 	if !active {
@@ -229,24 +1001,196 @@ func (n *NodeProcessor) SendWrite() (int, error) {
 		// Try to skip it.
 		if err := n.queue.Advance(); err != nil {
 			n.Logger.Printf("failed to advance queue for node %d: %s", n.nodeID, err.Error())
+		} else {
+			n.addPending(-blockPoints(buf), -int64(len(buf)))
+			n.addPendingShards(-1, buf)
+			n.addStat(pointsDropped, blockPoints(buf))
 		}
 		return 0, err
 	}
 
-	if err := n.writer.WriteShard(shardID, n.nodeID, points); err != nil {
+	// Read the following writes from disk while this one is sent.
+	var wg sync.WaitGroup
+	if n.ReadAheadBytes > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.queue.readAhead(); err != nil {
+				n.Logger.Printf("failed to read ahead for node %d: %s", n.nodeID, err.Error())
+			}
+		}()
+	}
+
+	err = n.writeShard(shardID, points)
+	wg.Wait()
+	if err != nil {
 		n.statMap.Add(writeNodeReqFail, 1)
-		return 0, err
+		n.setLastError(err)
+		if !isPermanent(err) {
+			n.logEvent(LevelError, EventDrainFail, withHint(buf, "node", n.nodeID, "shard", shardID, "bytes", len(buf), "error", err)...)
+			return 0, err
+		}
+
+		n.logEvent(LevelError, EventDeadLetter, withHint(buf, "node", n.nodeID, "shard", shardID, "bytes", len(buf), "error", err)...)
+		if err := n.deadLetters.Append(buf); err != nil {
+			n.Logger.Printf("failed to append to dead-letter queue for node %d, dropping write: %s", n.nodeID, err.Error())
+			n.addStat(pointsDropped, int64(len(points)))
+		} else {
+			n.addStat(pointsDeadLettered, int64(len(points)))
+		}
+
+		if err := n.queue.Advance(); err != nil {
+			n.Logger.Printf("failed to advance queue for node %d: %s", n.nodeID, err.Error())
+			return 0, err
+		}
+		n.addPending(-int64(len(points)), -int64(len(buf)))
+		n.addPendingShards(-1, buf)
+
+		return 0, nil
 	}
 	n.statMap.Add(writeNodeReq, 1)
 	n.statMap.Add(writeNodeReqPoints, int64(len(points)))
+	n.setLastError(nil)
+	n.logEvent(LevelDebug, EventDrainSuccess, "node", n.nodeID, "shard", shardID, "points", len(points), "bytes", len(buf))
 
 	if err := n.queue.Advance(); err != nil {
 		n.Logger.Printf("failed to advance queue for node %d: %s", n.nodeID, err.Error())
+	} else {
+		n.addStat(pointsDelivered, int64(len(points)))
+		n.addPending(-int64(len(points)), -int64(len(buf)))
+		n.addPendingShards(-1, buf)
+	}
+
+	if n.replayed != nil {
+		n.replayed(ReplayEvent{
+			NodeID:         n.nodeID,
+			ShardID:        shardID,
+			Points:         len(points),
+			RemainingBytes: atomic.LoadInt64(&n.pendingBytes),
+		})
 	}
 
 	return len(buf), nil
 }
 
+// writeShard sends points for the shard to the node.  If sending takes longer than
+// WriteTimeout, ErrWriteTimeout is returned and the write is left to finish or fail in
+// the background, so the write may be received by the node twice.  Until it finishes,
+// later sends aren't started and also return ErrWriteTimeout.  n.replayMu must be held.
+func (n *NodeProcessor) writeShard(shardID uint64, points []models.Point) error {
+	w := n.writer
+	if n.WriteTimeout <= 0 {
+		return w.WriteShard(shardID, n.nodeID, points)
+	}
+
+	if n.inflight != nil {
+		select {
+		case <-n.inflight:
+			n.inflight = nil
+		default:
+			return ErrWriteTimeout
+		}
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- w.WriteShard(shardID, n.nodeID, points)
+	}()
+
+	timer := time.NewTimer(n.WriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-errC:
+		return err
+	case <-timer.C:
+		n.inflight = errC
+		return ErrWriteTimeout
+	}
+}
+
+// logEvent logs an event to the EventLogger, or to the Logger if there isn't one.
+func (n *NodeProcessor) logEvent(level, msg string, kv ...interface{}) {
+	l := n.EventLogger
+	if l == nil {
+		l = NewEventLogger(n.Logger)
+	}
+	l.Logf(level, msg, kv...)
+}
+
+// EstimateDrainTime returns how long sending the data waiting for the node should take,
+// based on the recent rate data has been sent.  ErrNodeFailing is returned if the last
+// attempt to send data failed, and ErrNoThroughput if no data has been sent yet.
+func (n *NodeProcessor) EstimateDrainTime() (time.Duration, error) {
+	_, bytes, err := n.QueueLen()
+	if err != nil {
+		return 0, err
+	} else if bytes == 0 {
+		return 0, nil
+	}
+
+	if err, _ := n.LastError(); err != nil {
+		return 0, ErrNodeFailing
+	}
+
+	n.throughputMu.Lock()
+	throughput := n.throughput
+	n.throughputMu.Unlock()
+	if throughput <= 0 {
+		return 0, ErrNoThroughput
+	}
+
+	return time.Duration(float64(bytes) / throughput * float64(time.Second)), nil
+}
+
+// recordThroughput adds the rate of sending bytes in d to the moving average.
+func (n *NodeProcessor) recordThroughput(bytes int, d time.Duration) {
+	if bytes <= 0 || d <= 0 {
+		return
+	}
+	rate := float64(bytes) / d.Seconds()
+
+	n.throughputMu.Lock()
+	defer n.throughputMu.Unlock()
+	if n.throughput == 0 {
+		n.throughput = rate
+	} else {
+		n.throughput += throughputWeight * (rate - n.throughput)
+	}
+}
+
+// inheritState carries over from old, a closed processor for the same node, the state
+// that isn't kept with the queued data: whether sending is paused, the last error sending,
+// and the throughput.  It must be called before the processor is opened.
+func (n *NodeProcessor) inheritState(old *NodeProcessor) {
+	atomic.StoreInt32(&n.paused, atomic.LoadInt32(&old.paused))
+	n.lastErr, n.lastErrTime = old.LastError()
+
+	old.throughputMu.Lock()
+	n.throughput = old.throughput
+	old.throughputMu.Unlock()
+}
+
+// LastError returns the most recent error sending data to the node, and when it
+// occurred.  The error is nil if data has been sent successfully since.
+func (n *NodeProcessor) LastError() (error, time.Time) {
+	n.errMu.Lock()
+	defer n.errMu.Unlock()
+	return n.lastErr, n.lastErrTime
+}
+
+// setLastError records err as the most recent error sending data to the node, or clears
+// it if err is nil.
+func (n *NodeProcessor) setLastError(err error) {
+	n.errMu.Lock()
+	defer n.errMu.Unlock()
+
+	n.lastErr, n.lastErrTime = err, time.Time{}
+	if err != nil {
+		n.lastErrTime = time.Now()
+	}
+}
+
 func (n *NodeProcessor) Head() string {
 	qp, err := n.queue.Position()
 	if err != nil {
@@ -274,8 +1218,19 @@ func (n *NodeProcessor) Active() (bool, error) {
 }
 
 func marshalWrite(shardID uint64, points []models.Point) []byte {
+	return marshalHintedWrite(shardID, "", points)
+}
+
+// marshalHintedWrite marshals a write along with a hint of why it was handed off.  The
+// hint is stored as a comment line before the points, which parsing the points skips.
+func marshalHintedWrite(shardID uint64, hint string, points []models.Point) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, shardID)
+	if hint != "" {
+		b = append(b, hintPrefix...)
+		b = append(b, strings.Replace(hint, "\n", " ", -1)...)
+		b = append(b, '\n')
+	}
 	for _, p := range points {
 		b = append(b, []byte(p.String())...)
 		b = append(b, '\n')
@@ -283,6 +1238,59 @@ func marshalWrite(shardID uint64, points []models.Point) []byte {
 	return b
 }
 
+// isPermanent returns true if err indicates a write that will never succeed.
+func isPermanent(err error) bool {
+	if !tsdb.IsRetryable(err) {
+		return true
+	}
+
+	e, ok := err.(interface {
+		Permanent() bool
+	})
+	return ok && e.Permanent()
+}
+
+// addStat adds delta to the statistic key for the NodeProcessor, and for the
+// owning Service if there is one.
+func (n *NodeProcessor) addStat(key string, delta int64) {
+	n.statMap.Add(key, delta)
+	if n.serviceStatMap != nil {
+		n.serviceStatMap.Add(key, delta)
+	}
+}
+
+// blockPoints returns the number of points in a marshaled write without parsing them.
+func blockPoints(b []byte) int64 {
+	if len(b) < 8 {
+		return 0
+	}
+	n := int64(bytes.Count(b[8:], []byte{'\n'}))
+	if bytes.HasPrefix(b[8:], hintPrefix) {
+		n--
+	}
+	return n
+}
+
+// blockHint returns the hint a marshaled write was handed off with, if any.
+func blockHint(b []byte) string {
+	if len(b) < 8 || !bytes.HasPrefix(b[8:], hintPrefix) {
+		return ""
+	}
+	line := b[8+len(hintPrefix):]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return string(line)
+}
+
+// withHint appends the hint of the marshaled write b, if any, to the event key/values kv.
+func withHint(b []byte, kv ...interface{}) []interface{} {
+	if hint := blockHint(b); hint != "" {
+		kv = append(kv, "hint", hint)
+	}
+	return kv
+}
+
 func unmarshalWrite(b []byte) (uint64, []models.Point, error) {
 	if len(b) < 8 {
 		return 0, nil, fmt.Errorf("too short: len = %d", len(b))
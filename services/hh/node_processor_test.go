@@ -1,12 +1,18 @@
 package hh
 
 import (
+	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/influxdb/influxdb/influxql"
 	"github.com/influxdb/influxdb/meta"
 	"github.com/influxdb/influxdb/models"
 )
@@ -20,13 +26,28 @@ func (f *fakeShardWriter) WriteShard(shardID, nodeID uint64, points []models.Poi
 }
 
 type fakeMetaStore struct {
-	NodeFn func(nodeID uint64) (*meta.NodeInfo, error)
+	NodeFn              func(nodeID uint64) (*meta.NodeInfo, error)
+	ShardOwnerFn        func(shardID uint64) (string, string, *meta.ShardGroupInfo)
+	MeasurementFieldsFn func(database, name string) (map[string]influxql.DataType, bool)
 }
 
 func (f *fakeMetaStore) Node(nodeID uint64) (*meta.NodeInfo, error) {
 	return f.NodeFn(nodeID)
 }
 
+func (f *fakeMetaStore) ShardOwner(shardID uint64) (string, string, *meta.ShardGroupInfo) {
+	return f.ShardOwnerFn(shardID)
+}
+
+// MeasurementFields returns an empty schema for every measurement unless
+// MeasurementFieldsFn is set.
+func (f *fakeMetaStore) MeasurementFields(database, name string) (map[string]influxql.DataType, bool) {
+	if f.MeasurementFieldsFn == nil {
+		return map[string]influxql.DataType{}, true
+	}
+	return f.MeasurementFieldsFn(database, name)
+}
+
 func TestNodeProcessorSendBlock(t *testing.T) {
 	dir, err := ioutil.TempDir("", "node_processor_test")
 	if err != nil {
@@ -153,3 +174,827 @@ func TestNodeProcessorSendBlock(t *testing.T) {
 		t.Fatalf("Node processor directory still present after purge")
 	}
 }
+
+func TestNodeProcessorAdvanceFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_processor_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	var n *NodeProcessor
+	sh := &fakeShardWriter{
+		// Close the queue under the write so the following Advance fails.
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return n.queue.Close()
+		},
+	}
+	n = NewNodeProcessor(1, dir, sh, metastore)
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+	defer n.Close()
+
+	if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+
+	// The points are still queued, so they must not be counted as delivered.
+	if v := n.statMap.Get(pointsDelivered); v != nil && v.String() != "0" {
+		t.Fatalf("points delivered mismatch: got %v, exp 0", v)
+	}
+}
+
+func TestNodeProcessorQueueLen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_processor_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	batches := [][]models.Point{{pt}, {pt, pt}, {pt, pt, pt}}
+
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return nil
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	// Keep the background sender out of the way so only SendWrite drains the queue.
+	n := NewNodeProcessor(1, dir, sh, metastore)
+	n.RetryInterval, n.RetryMaxInterval = time.Hour, time.Hour
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+
+	checkQueueLen := func(expPoints int, expBatches [][]models.Point) {
+		var expBytes int
+		for _, b := range expBatches {
+			expBytes += len(marshalWrite(100, b))
+		}
+
+		points, bytes, err := n.QueueLen()
+		if err != nil {
+			t.Fatalf("QueueLen() failed: %v", err)
+		}
+		if points != int64(expPoints) {
+			t.Fatalf("QueueLen() points mismatch: got %v, exp %v", points, expPoints)
+		}
+		if bytes != int64(expBytes) {
+			t.Fatalf("QueueLen() bytes mismatch: got %v, exp %v", bytes, expBytes)
+		}
+	}
+
+	checkQueueLen(0, nil)
+
+	for _, b := range batches {
+		if err := n.WriteShard(100, b); err != nil {
+			t.Fatalf("WriteShard() failed to write points: %v", err)
+		}
+	}
+	checkQueueLen(6, batches)
+
+	// Partially drain the queue.
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed to write points: %v", err)
+	}
+	checkQueueLen(5, batches[1:])
+
+	// Counts should be rebuilt from the queue on reopen.
+	if err := n.Close(); err != nil {
+		t.Fatalf("Failed to close node processor: %v", err)
+	}
+	if _, _, err := n.QueueLen(); err == nil {
+		t.Fatalf("QueueLen() expected error on closed node processor")
+	}
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to re-open node processor: %v", err)
+	}
+	checkQueueLen(5, batches[1:])
+
+	for i := 0; i < 2; i++ {
+		if _, err := n.SendWrite(); err != nil {
+			t.Fatalf("SendWrite() failed to write points: %v", err)
+		}
+	}
+	checkQueueLen(0, nil)
+
+	if err := n.Close(); err != nil {
+		t.Fatalf("Failed to close node processor: %v", err)
+	}
+}
+
+// permanentError is a write error that should not be retried.
+type permanentError struct{ error }
+
+func (e permanentError) Permanent() bool { return true }
+
+func TestNodeProcessorPermanentWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_processor_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+
+	// Writes to shards 1 and 3 can never succeed. Writes to shard 2 fail once.
+	var shard2Writes int
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			if shardID == 1 {
+				return permanentError{fmt.Errorf("shard not found")}
+			} else if shardID == 3 {
+				return fmt.Errorf("write failed: field type conflict")
+			}
+			shard2Writes++
+			if shard2Writes == 1 {
+				return fmt.Errorf("timeout")
+			}
+			return nil
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	n := NewNodeProcessor(1, dir, sh, metastore)
+	n.RetryInterval, n.RetryMaxInterval = time.Hour, time.Hour
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+	defer n.Close()
+
+	for _, shardID := range []uint64{1, 3, 2} {
+		if err := n.WriteShard(shardID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed to write points: %v", err)
+		}
+	}
+
+	// The permanent failures are moved out of the way.
+	for i := 0; i < 2; i++ {
+		if _, err := n.SendWrite(); err != nil {
+			t.Fatalf("SendWrite() failed on permanent error: %v", err)
+		}
+	}
+
+	for _, exp := range []uint64{1, 3} {
+		buf, err := n.deadLetters.Current()
+		if err != nil {
+			t.Fatalf("failed to read dead-letter queue: %v", err)
+		}
+		if shardID, _, err := unmarshalWrite(buf); err != nil || shardID != exp {
+			t.Fatalf("dead-letter queue mismatch: got shard %v (%v), exp %v", shardID, err, exp)
+		}
+		if err := n.deadLetters.Advance(); err != nil {
+			t.Fatalf("failed to advance dead-letter queue: %v", err)
+		}
+	}
+
+	// The transient failure is kept and retried.
+	if _, err := n.SendWrite(); err == nil {
+		t.Fatalf("SendWrite() expected transient error")
+	}
+	if points, _, _ := n.QueueLen(); points != 1 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 1", points)
+	}
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed to write points: %v", err)
+	}
+	if points, _, _ := n.QueueLen(); points != 0 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 0", points)
+	}
+	if exp := 2; shard2Writes != exp {
+		t.Fatalf("shard 2 write count mismatch: got %v, exp %v", shard2Writes, exp)
+	}
+}
+
+func TestNodeProcessorBufferedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_processor_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return fmt.Errorf("node unavailable")
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	n := NewNodeProcessor(1, dir, sh, metastore)
+	n.RetryInterval, n.RetryMaxInterval = time.Hour, time.Hour
+	n.BatchSize, n.BatchInterval = 3, 10*time.Millisecond
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+
+	// A write smaller than the batch size is flushed after the batch interval.
+	if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed to write points: %v", err)
+	}
+	timeout := time.After(time.Second)
+	for {
+		if points, _, _ := n.QueueLen(); points == 1 {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("buffered write not flushed")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// Writes are flushed once the batch size is reached.
+	n.BatchInterval = time.Hour
+	if err := n.Close(); err != nil {
+		t.Fatalf("Failed to close node processor: %v", err)
+	}
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to re-open node processor: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed to write points: %v", err)
+		}
+	}
+	if points, _, _ := n.QueueLen(); points != 4 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 4", points)
+	}
+
+	// Buffered writes are flushed on close, and survive a reopen.
+	if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed to write points: %v", err)
+	}
+	if points, _, _ := n.QueueLen(); points != 4 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 4", points)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatalf("Failed to close node processor: %v", err)
+	}
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to re-open node processor: %v", err)
+	}
+	defer n.Close()
+
+	points, err := n.Peek(10)
+	if err != nil {
+		t.Fatalf("Peek() failed: %v", err)
+	}
+	if len(points) != 5 {
+		t.Fatalf("Peek() points mismatch: got %v, exp 5", len(points))
+	}
+}
+
+// Ensure buffered writes are rejected once the queue has no room for them along with the
+// writes already buffered, rather than dropped when they're flushed.
+func TestNodeProcessorBufferedWritesFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_processor_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	size := int64(len(marshalWrite(100, []models.Point{pt})))
+
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	n := NewNodeProcessor(1, dir, &fakeShardWriter{}, metastore)
+	n.RetryInterval, n.RetryMaxInterval = time.Hour, time.Hour
+	n.BatchSize, n.BatchInterval = 100, time.Hour
+	n.MaxSize = 3*size + size/2
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed to write points: %v", err)
+		}
+	}
+	if err := n.WriteShard(100, []models.Point{pt}); err != ErrQueueFull {
+		t.Fatalf("WriteShard() error mismatch: got %v, exp %v", err, ErrQueueFull)
+	}
+
+	// Every accepted write is flushed on close.
+	if err := n.Close(); err != nil {
+		t.Fatalf("Failed to close node processor: %v", err)
+	}
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to re-open node processor: %v", err)
+	}
+	defer n.Close()
+
+	if points, _, _ := n.QueueLen(); points != 3 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 3", points)
+	}
+	if v := n.statMap.Get(pointsDropped); v != nil && v.String() != "0" {
+		t.Fatalf("points dropped: %s", v)
+	}
+
+	// Flushed writes no longer reserve space on top of the space they take in the queue.
+	if n.bufBytes != 0 {
+		t.Fatalf("buffered bytes mismatch: got %d, exp 0", n.bufBytes)
+	}
+}
+
+// Ensure data older than MaxAge is purged on the purge interval, even though retries
+// happen more often.
+func TestNodeProcessorPurgeMaxAge(t *testing.T) {
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return nil, nil // Inactive, so data stays queued.
+		},
+	}
+
+	store := newMemStore()
+	n := NewNodeProcessor(1, "/hh/1", &fakeShardWriter{}, metastore)
+	n.store = store
+	n.RetryInterval, n.RetryMaxInterval = time.Millisecond, time.Millisecond
+	n.PurgeInterval, n.MaxAge = 20*time.Millisecond, time.Minute
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+	defer n.Close()
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := n.WriteShard(100, []models.Point{pt, pt}); err != nil {
+		t.Fatalf("WriteShard() failed to write points: %v", err)
+	}
+
+	// Age the queued data past MaxAge.
+	store.mu.Lock()
+	for _, data := range store.files {
+		data.modTime = time.Now().Add(-time.Hour)
+	}
+	store.mu.Unlock()
+
+	// The points are counted as dropped once they're purged.
+	timeout := time.After(5 * time.Second)
+	for {
+		points, _, _ := n.QueueLen()
+		if v := n.statMap.Get(pointsDropped); points == 0 && v != nil && v.String() == "2" {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("data older than MaxAge not purged: %d points queued, dropped %v", points, n.statMap.Get(pointsDropped))
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestNodeProcessorSyncPolicy(t *testing.T) {
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return fmt.Errorf("node unavailable")
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	for _, policy := range []string{SyncAlways, SyncInterval, SyncNever} {
+		func() {
+			dir, err := ioutil.TempDir("", "node_processor_test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			n := NewNodeProcessor(1, dir, sh, metastore)
+			n.RetryInterval, n.RetryMaxInterval = time.Hour, time.Hour
+			n.SyncPolicy = policy
+			if err := n.Open(); err != nil {
+				t.Fatalf("Failed to open node processor with policy %s: %v", policy, err)
+			}
+			defer n.Close()
+
+			if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+				t.Fatalf("WriteShard() failed to write points with policy %s: %v", policy, err)
+			}
+			if policy != SyncAlways {
+				return
+			}
+
+			// Simulate a crash by reading the data without closing the processor.
+			other := NewNodeProcessor(1, dir, sh, metastore)
+			other.RetryInterval, other.RetryMaxInterval = time.Hour, time.Hour
+			if err := other.Open(); err != nil {
+				t.Fatalf("Failed to open node processor: %v", err)
+			}
+			defer other.Close()
+
+			points, err := other.Peek(10)
+			if err != nil {
+				t.Fatalf("Peek() failed: %v", err)
+			}
+			if len(points) != 1 || points[0].String() != pt.String() {
+				t.Fatalf("Peek() mismatch: got %v, exp %v", points, []models.Point{pt})
+			}
+		}()
+	}
+
+	n := NewNodeProcessor(1, "", sh, metastore)
+	n.SyncPolicy = "sometimes"
+	if err := n.Open(); err == nil {
+		t.Fatalf("Open() expected error for unknown sync policy")
+	}
+}
+
+func BenchmarkNodeProcessorWriteShard(b *testing.B) {
+	benchmarkNodeProcessorWriteShard(b, func(n *NodeProcessor) {})
+}
+
+func BenchmarkNodeProcessorWriteShardBuffered(b *testing.B) {
+	benchmarkNodeProcessorWriteShard(b, func(n *NodeProcessor) { n.BatchInterval = time.Second })
+}
+
+func BenchmarkNodeProcessorWriteShardSyncInterval(b *testing.B) {
+	benchmarkNodeProcessorWriteShard(b, func(n *NodeProcessor) { n.SyncPolicy = SyncInterval })
+}
+
+func BenchmarkNodeProcessorWriteShardSyncNever(b *testing.B) {
+	benchmarkNodeProcessorWriteShard(b, func(n *NodeProcessor) { n.SyncPolicy = SyncNever })
+}
+
+func benchmarkNodeProcessorWriteShard(b *testing.B, configure func(n *NodeProcessor)) {
+	dir, err := ioutil.TempDir("", "node_processor_test")
+	if err != nil {
+		b.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return fmt.Errorf("node unavailable")
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return nil, nil
+		},
+	}
+
+	n := NewNodeProcessor(1, dir, sh, metastore)
+	configure(n)
+	if err := n.Open(); err != nil {
+		b.Fatalf("Failed to open node processor: %v", err)
+	}
+	defer n.Close()
+
+	points := []models.Point{models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := n.WriteShard(100, points); err != nil {
+			b.Fatalf("WriteShard() failed to write points: %v", err)
+		}
+	}
+}
+
+func BenchmarkNodeProcessorSendWrite(b *testing.B) {
+	benchmarkNodeProcessorSendWrite(b, 0)
+}
+
+func BenchmarkNodeProcessorSendWriteReadAhead(b *testing.B) {
+	benchmarkNodeProcessorSendWrite(b, 1024*1024)
+}
+
+// benchmarkNodeProcessorSendWrite measures draining a queue to a node that takes a
+// little time to accept each write.
+func benchmarkNodeProcessorSendWrite(b *testing.B, readAhead int64) {
+	dir, err := ioutil.TempDir("", "node_processor_test")
+	if err != nil {
+		b.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			time.Sleep(50 * time.Microsecond)
+			return nil
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	n := NewNodeProcessor(1, dir, sh, metastore)
+	n.RetryInterval, n.RetryMaxInterval = time.Hour, time.Hour
+	n.SyncPolicy = SyncNever
+	n.MaxSize = 1024 * 1024 * 1024
+	n.ReadAheadBytes = readAhead
+	if err := n.Open(); err != nil {
+		b.Fatalf("Failed to open node processor: %v", err)
+	}
+	defer n.Close()
+
+	var points []models.Point
+	for i := 0; i < 100; i++ {
+		points = append(points, models.MustNewPoint("cpu", models.Tags{"host": fmt.Sprintf("server%d", i)}, models.Fields{"value": 1.0}, time.Unix(0, 0)))
+	}
+	for i := 0; i < b.N; i++ {
+		if err := n.WriteShard(100, points); err != nil {
+			b.Fatalf("WriteShard() failed to write points: %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := n.SendWrite(); err != nil {
+			b.Fatalf("SendWrite() failed: %v", err)
+		}
+	}
+}
+
+func TestNodeProcessorKeepDrained(t *testing.T) {
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	block := marshalWrite(100, []models.Point{pt})
+
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return nil
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	n := NewNodeProcessor(1, "1", sh, metastore)
+	n.store = newMemStore()
+	n.RetryInterval, n.RetryMaxInterval = time.Hour, time.Hour
+	n.KeepDrainedFor = time.Hour
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+	defer n.Close()
+
+	// Each write fills a segment: a length prefix, the block and the footer.
+	segmentSize := int64(8 + len(block) + 8)
+	if err := n.queue.SetMaxSegmentSize(segmentSize); err != nil {
+		t.Fatalf("failed to set max segment size: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	checkArchived := func(exp int64) {
+		stats, err := n.Stats()
+		if err != nil {
+			t.Fatalf("Stats() failed: %v", err)
+		}
+		if stats.ArchivedBytes != exp {
+			t.Fatalf("archived bytes mismatch: got %v, exp %v", stats.ArchivedBytes, exp)
+		}
+	}
+
+	// Sending the first write drains the first segment.
+	checkArchived(0)
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	checkArchived(segmentSize)
+
+	// The segment is kept until it has been drained for KeepDrainedFor.
+	if err := n.purgeArchive(time.Now()); err != nil {
+		t.Fatalf("purgeArchive() failed: %v", err)
+	}
+	checkArchived(segmentSize)
+
+	if err := n.purgeArchive(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("purgeArchive() failed: %v", err)
+	}
+	checkArchived(0)
+}
+
+func TestNodeProcessorCloseDuringReplay(t *testing.T) {
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+
+	delivered := make(chan struct{}, 20)
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			delivered <- struct{}{}
+			return nil
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	// The rate limit makes sending the whole queue take much longer than the test.
+	n := NewNodeProcessor(1, "1", sh, metastore)
+	n.store = newMemStore()
+	n.RetryInterval, n.RetryMaxInterval = 10*time.Millisecond, 10*time.Millisecond
+	n.RetryRateLimit = 1
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+	for i := 0; i < cap(delivered); i++ {
+		if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the queue to be sent")
+	}
+
+	// Close stops sending rather than waiting for the rest of the queue.
+	closed := make(chan error, 1)
+	go func() { closed <- n.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close() failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for Close() while sending")
+	}
+	if len(delivered) == cap(delivered)-1 {
+		t.Fatalf("whole queue sent before Close() returned")
+	}
+}
+
+func TestNodeProcessorWriteTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_processor_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+
+	// The first write hangs until it is released.  Later writes succeed.
+	hang := make(chan struct{})
+	var release sync.Once
+	defer release.Do(func() { close(hang) })
+	var writes int32
+	delivered := make(chan []models.Point, 1)
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			if atomic.AddInt32(&writes, 1) == 1 {
+				<-hang
+				return nil
+			}
+			delivered <- points
+			return nil
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	n := NewNodeProcessor(1, dir, sh, metastore)
+	n.RetryInterval, n.RetryMaxInterval = 10*time.Millisecond, 50*time.Millisecond
+	n.WriteTimeout = 20 * time.Millisecond
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+	defer n.Close()
+
+	if err := n.WriteShard(100, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed to write points: %v", err)
+	}
+
+	// The drain loop gives up on the hung write, but doesn't send again while it's hung.
+	fails := func() int64 {
+		if v, ok := n.statMap.Get(writeNodeReqFail).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	waitFails := func(exp int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for fails() < exp {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d failed writes, got %d", exp, fails())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFails(1)
+	goroutines := runtime.NumGoroutine()
+	waitFails(5)
+	if got := atomic.LoadInt32(&writes); got != 1 {
+		t.Fatalf("writes started while one was hung: got %d, exp 1", got)
+	}
+	if got := runtime.NumGoroutine(); got > goroutines+2 {
+		t.Fatalf("goroutines grew while a write was hung: got %d, exp at most %d", got, goroutines+2)
+	}
+
+	// Once the hung write finishes, the write is retried.
+	release.Do(func() { close(hang) })
+	select {
+	case points := <-delivered:
+		if len(points) != 1 || points[0].String() != pt.String() {
+			t.Fatalf("points mismatch: got %v, exp %v", points, pt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for write to be retried")
+	}
+}
+
+func TestNodeProcessorReadAhead(t *testing.T) {
+	var got []uint64
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			if len(points) != 1 || points[0].Name() != fmt.Sprintf("cpu%d", shardID) {
+				return fmt.Errorf("unexpected points for shard %d: %v", shardID, points)
+			}
+			got = append(got, shardID)
+			return nil
+		},
+	}
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{}, nil
+		},
+	}
+
+	n := NewNodeProcessor(1, "1", sh, metastore)
+	n.store = newMemStore()
+	n.RetryInterval, n.RetryMaxInterval = time.Hour, time.Hour
+	n.ReadAheadBytes = 256
+	if err := n.Open(); err != nil {
+		t.Fatalf("Failed to open node processor: %v", err)
+	}
+	defer n.Close()
+
+	// Spread the writes over several segments.
+	pt := models.MustNewPoint("cpu10", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := n.queue.SetMaxSegmentSize(int64(3*(8+len(marshalWrite(10, []models.Point{pt}))) + 8)); err != nil {
+		t.Fatalf("failed to set max segment size: %v", err)
+	}
+
+	var exp []uint64
+	for i := uint64(10); i < 30; i++ {
+		pt := models.MustNewPoint(fmt.Sprintf("cpu%d", i), models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+		if err := n.WriteShard(i, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+		exp = append(exp, i)
+	}
+
+	for {
+		if _, err := n.SendWrite(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("SendWrite() failed: %v", err)
+		}
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Fatalf("sent shards mismatch: got %v, exp %v", got, exp)
+	}
+	if points, bytes, err := n.QueueLen(); err != nil {
+		t.Fatalf("QueueLen() failed: %v", err)
+	} else if points != 0 || bytes != 0 {
+		t.Fatalf("QueueLen() mismatch: got %d points, %d bytes, exp none", points, bytes)
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -16,6 +16,9 @@ var (
 	ErrNotOpen     = fmt.Errorf("queue not open")
 	ErrQueueFull   = fmt.Errorf("queue is full")
 	ErrSegmentFull = fmt.Errorf("segment is full")
+
+	// errReadAheadFull stops reading ahead once the read-ahead limit is reached.
+	errReadAheadFull = fmt.Errorf("read-ahead is full")
 )
 
 const (
@@ -55,6 +58,9 @@ const (
 type queue struct {
 	mu sync.RWMutex
 
+	// Storage for segments
+	store queueStore
+
 	// Directory to create segments
 	dir string
 
@@ -71,6 +77,26 @@ type queue struct {
 
 	// The segments that exist on disk
 	segments segments
+
+	// Whether appends are synced to disk before returning
+	syncAppends bool
+
+	// Directory drained segments are moved to, instead of being removed
+	archiveDir string
+
+	// Byte slices from the head onwards, read into memory before they are needed, and
+	// the maximum number of bytes that can be held.
+	aheadMu       sync.Mutex
+	ahead         []aheadBlock
+	aheadSize     int64
+	readAheadSize int64
+}
+
+// aheadBlock is a byte slice read ahead, along with its segment and offset in the segment.
+type aheadBlock struct {
+	seg *segment
+	pos int64
+	b   []byte
 }
 type queuePos struct {
 	head string
@@ -79,14 +105,16 @@ type queuePos struct {
 
 type segments []*segment
 
-// newQueue create a queue that will store segments in dir and that will
+// newQueue create a queue that will store segments in dir of store and that will
 // consume more than maxSize on disk.
-func newQueue(dir string, maxSize int64) (*queue, error) {
+func newQueue(store queueStore, dir string, maxSize int64) (*queue, error) {
 	return &queue{
+		store:          store,
 		dir:            dir,
 		maxSegmentSize: defaultSegmentSize,
 		maxSize:        maxSize,
 		segments:       segments{},
+		syncAppends:    true,
 	}, nil
 }
 
@@ -116,12 +144,27 @@ func (l *queue) Open() error {
 	// This advances the segment if the current head is already at the end.
 	_, err = l.head.current()
 	if err == io.EOF {
-		return l.trimHead()
+		return l.trimHead(true)
 	}
 
 	return nil
 }
 
+// Truncated returns the number of bytes dropped from each segment, keyed by path, that
+// ended with a partial block when the queue was opened.
+func (l *queue) Truncated() map[string]int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	truncated := make(map[string]int64)
+	for _, s := range l.segments {
+		if s.dropped > 0 {
+			truncated[s.path] = s.dropped
+		}
+	}
+	return truncated
+}
+
 // Close stops the queue for reading and writing
 func (l *queue) Close() error {
 	l.mu.Lock()
@@ -135,6 +178,7 @@ func (l *queue) Close() error {
 	l.head = nil
 	l.tail = nil
 	l.segments = nil
+	l.resetAhead()
 	return nil
 }
 
@@ -148,7 +192,7 @@ func (l *queue) Remove() error {
 		return fmt.Errorf("queue is open")
 	}
 
-	return os.RemoveAll(l.dir)
+	return l.store.RemoveAll(l.dir)
 }
 
 // SetMaxSegmentSize updates the max segment size for new and existing
@@ -173,6 +217,47 @@ func (l *queue) SetMaxSegmentSize(size int64) error {
 	return nil
 }
 
+// SetArchiveDir sets the directory segments are moved to once all of their byte slices
+// have been advanced past.  The segments are named by the time they were moved, in
+// nanoseconds, followed by their original name.  If dir is empty, drained segments are
+// removed.
+func (l *queue) SetArchiveDir(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.archiveDir = dir
+}
+
+// SetSyncAppends sets whether appends are synced to disk before returning.  If not,
+// Sync must be called to make appends durable.
+func (l *queue) SetSyncAppends(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncAppends = enabled
+}
+
+// SetReadAhead sets the maximum number of bytes readAhead can hold in memory.  Zero
+// disables reading ahead.
+func (l *queue) SetReadAhead(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.aheadMu.Lock()
+	defer l.aheadMu.Unlock()
+	l.readAheadSize = size
+	l.resetAhead()
+}
+
+// Sync commits appends to disk.
+func (l *queue) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tail == nil {
+		return ErrNotOpen
+	}
+	return l.tail.sync()
+}
+
 func (l *queue) PurgeOlderThan(when time.Time) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -201,7 +286,7 @@ func (l *queue) PurgeOlderThan(when time.Time) error {
 			}
 		}
 
-		if err := l.trimHead(); err != nil {
+		if err := l.trimHead(false); err != nil {
 			return err
 		}
 	}
@@ -232,6 +317,13 @@ func (l *queue) Position() (*queuePos, error) {
 	return qp, nil
 }
 
+// Size returns the total size on disk used by the queue
+func (l *queue) Size() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.diskUsage()
+}
+
 // diskUsage returns the total size on disk used by the queue
 func (l *queue) diskUsage() int64 {
 	var size int64
@@ -248,7 +340,7 @@ func (l *queue) addSegment() (*segment, error) {
 		return nil, err
 	}
 
-	segment, err := newSegment(filepath.Join(l.dir, strconv.FormatUint(nextID, 10)), l.maxSegmentSize)
+	segment, err := newSegment(l.store, filepath.Join(l.dir, strconv.FormatUint(nextID, 10)), l.maxSegmentSize)
 	if err != nil {
 		return nil, err
 	}
@@ -261,11 +353,12 @@ func (l *queue) addSegment() (*segment, error) {
 func (l *queue) loadSegments() (segments, error) {
 	segments := []*segment{}
 
-	files, err := ioutil.ReadDir(l.dir)
+	files, err := l.store.ReadDir(l.dir)
 	if err != nil {
 		return segments, err
 	}
 
+	var ids []uint64
 	for _, segment := range files {
 		// Segments should be files.  Skip anything that is not a dir.
 		if segment.IsDir() {
@@ -273,12 +366,19 @@ func (l *queue) loadSegments() (segments, error) {
 		}
 
 		// Segments file names are all numeric
-		_, err := strconv.ParseUint(segment.Name(), 10, 64)
+		id, err := strconv.ParseUint(segment.Name(), 10, 64)
 		if err != nil {
 			continue
 		}
+		ids = append(ids, id)
+	}
 
-		segment, err := newSegment(filepath.Join(l.dir, segment.Name()), l.maxSegmentSize)
+	// Segment IDs increase as segments are added, so order by ID rather than by
+	// name to read segments back in the order they were written.
+	sort.Sort(uint64Slice(ids))
+
+	for _, id := range ids {
+		segment, err := newSegment(l.store, filepath.Join(l.dir, strconv.FormatUint(id, 10)), l.maxSegmentSize)
 		if err != nil {
 			return segments, err
 		}
@@ -290,7 +390,7 @@ func (l *queue) loadSegments() (segments, error) {
 
 // nextSegmentID returns the next segment ID that is free
 func (l *queue) nextSegmentID() (uint64, error) {
-	segments, err := ioutil.ReadDir(l.dir)
+	segments, err := l.store.ReadDir(l.dir)
 	if err != nil {
 		return 0, err
 	}
@@ -316,8 +416,9 @@ func (l *queue) nextSegmentID() (uint64, error) {
 	return maxID + 1, nil
 }
 
-// Append appends a byte slice to the end of the queue
-func (l *queue) Append(b []byte) error {
+// Append appends byte slices to the end of the queue.  If appends are synced, the
+// queue is synced to disk once all of the slices are written.
+func (l *queue) Append(b ...[]byte) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -325,32 +426,391 @@ func (l *queue) Append(b []byte) error {
 		return ErrNotOpen
 	}
 
-	if l.diskUsage()+int64(len(b)) > l.maxSize {
+	var size int64
+	for _, v := range b {
+		size += int64(len(v))
+	}
+
+	if l.diskUsage()+size > l.maxSize {
 		return ErrQueueFull
 	}
 
-	// Append the entry to the tail, if the segment is full,
-	// try to create new segment and retry the append
-	if err := l.tail.append(b); err == ErrSegmentFull {
-		segment, err := l.addSegment()
-		if err != nil {
+	for _, v := range b {
+		// Append the entry to the tail, if the segment is full,
+		// try to create new segment and retry the append
+		if err := l.tail.append(v); err == ErrSegmentFull {
+			// The tail won't be synced after this, so sync it now.
+			if err := l.tail.sync(); err != nil {
+				return err
+			}
+
+			segment, err := l.addSegment()
+			if err != nil {
+				return err
+			}
+			l.tail = segment
+
+			if err := l.tail.append(v); err != nil {
+				return err
+			}
+		} else if err != nil {
 			return err
 		}
-		l.tail = segment
-		return l.tail.append(b)
 	}
-	return nil
+
+	if !l.syncAppends {
+		return nil
+	}
+	return l.tail.sync()
 }
 
 // Current returns the current byte slice at the head of the queue
 func (l *queue) Current() ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
 	if l.head == nil {
 		return nil, ErrNotOpen
 	}
 
+	l.aheadMu.Lock()
+	defer l.aheadMu.Unlock()
+	if l.aheadValid() {
+		return l.ahead[0].b, nil
+	}
+	l.resetAhead()
+
 	return l.head.current()
 }
 
+// readAhead reads the byte slices following those already read ahead into memory, from
+// the head onwards, until the read-ahead size would be exceeded.  Current returns them
+// without reading the segments, so a reader can call readAhead while it handles the
+// current byte slice to overlap the two.
+func (l *queue) readAhead() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.head == nil {
+		return ErrNotOpen
+	}
+
+	l.aheadMu.Lock()
+	defer l.aheadMu.Unlock()
+
+	if l.readAheadSize <= 0 {
+		return nil
+	}
+	if !l.aheadValid() {
+		l.resetAhead()
+	}
+
+	// Continue from the end of the last byte slice read ahead, or from the head.
+	var i int
+	pos := int64(-1)
+	if len(l.ahead) > 0 {
+		last := l.ahead[len(l.ahead)-1]
+		for i < len(l.segments) && l.segments[i] != last.seg {
+			i++
+		}
+		pos = last.pos + 8 + int64(len(last.b))
+	}
+
+	for ; i < len(l.segments); i++ {
+		s := l.segments[i]
+		err := s.forEachFrom(pos, func(p int64, b []byte) error {
+			if l.aheadSize+int64(len(b)) > l.readAheadSize {
+				return errReadAheadFull
+			}
+			l.ahead = append(l.ahead, aheadBlock{seg: s, pos: p, b: b})
+			l.aheadSize += int64(len(b))
+			return nil
+		})
+		if err == errReadAheadFull {
+			return nil
+		} else if err != nil {
+			l.resetAhead()
+			return err
+		}
+
+		// Later segments are read from their own current position.
+		pos = -1
+	}
+	return nil
+}
+
+// aheadValid returns true if the first byte slice read ahead is the current byte slice
+// of the head.  Anything moving the head, other than Advance, makes it false, so the
+// byte slices read ahead are dropped.  The queue and aheadMu must be locked.
+func (l *queue) aheadValid() bool {
+	return len(l.ahead) > 0 && l.ahead[0].seg == l.head && l.ahead[0].pos == l.head.position()
+}
+
+// resetAhead drops the byte slices read ahead.  aheadMu must be locked.
+func (l *queue) resetAhead() {
+	l.ahead, l.aheadSize = nil, 0
+}
+
+// forEach calls fn with each byte slice in the queue, from the head to the tail,
+// without advancing the head.
+func (l *queue) forEach(fn func(b []byte) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.head == nil {
+		return ErrNotOpen
+	}
+
+	for _, s := range l.segments {
+		if err := s.forEach(func(_ int64, b []byte) error {
+			return fn(b)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify calls fn with each byte slice in the queue, from the head to the tail, along
+// with the path of its segment and its offset in the segment.  If the length of a byte
+// slice is out of range, fn is called with the error instead, and the rest of the
+// segment is skipped.  The queue is not modified.
+func (l *queue) verify(fn func(path string, pos int64, b []byte, err error)) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.head == nil {
+		return ErrNotOpen
+	}
+
+	for _, s := range l.segments {
+		err := s.forEach(func(pos int64, b []byte) error {
+			fn(s.path, pos, b, nil)
+			return nil
+		})
+		if e, ok := err.(*recordSizeError); ok {
+			fn(s.path, e.pos, nil, e)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueSnapshot is the state of the segments of a queue at the time it was taken.  The
+// segment files are held open, so it can be copied after the queue has sent or removed
+// them.
+type queueSnapshot struct {
+	store    queueStore
+	segments []snapshotSegment
+}
+
+// snapshotSegment is a segment in a queueSnapshot.  Appends only write past the blocks
+// a segment already has, and advancing only rewrites its footer, so the first size bytes
+// of the file don't change and pos is written as the footer of the copy.
+type snapshotSegment struct {
+	file segmentFile
+	path string
+	size int64
+	pos  int64
+}
+
+// snapshot copies the segments of the queue to dir, so that a queue opened on dir holds
+// the same data as the queue did when it was called.  The queue is held only while its
+// segments are opened; they are copied after it is released.
+func (l *queue) snapshot(dir string) error {
+	qs, err := l.takeSnapshot()
+	if err != nil {
+		return err
+	}
+	defer qs.Close()
+
+	return qs.copyTo(dir)
+}
+
+// takeSnapshot opens the segments of the queue and records their sizes and positions.
+// The snapshot must be closed once it has been copied.
+func (l *queue) takeSnapshot() (*queueSnapshot, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.head == nil {
+		return nil, ErrNotOpen
+	}
+
+	qs := &queueSnapshot{store: l.store}
+	for _, s := range l.segments {
+		f, err := l.store.OpenFile(s.path)
+		if err != nil {
+			qs.Close()
+			return nil, err
+		}
+
+		s.mu.RLock()
+		size, pos := s.size-footerSize, s.pos
+		s.mu.RUnlock()
+
+		qs.segments = append(qs.segments, snapshotSegment{file: f, path: s.path, size: size, pos: pos})
+	}
+	return qs, nil
+}
+
+// copyTo writes the segments of the snapshot to dir.
+func (qs *queueSnapshot) copyTo(dir string) error {
+	if err := qs.store.MkdirAll(dir); err != nil {
+		return err
+	}
+	for _, s := range qs.segments {
+		if err := s.copyTo(qs.store, filepath.Join(dir, filepath.Base(s.path))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the segment files of the snapshot.
+func (qs *queueSnapshot) Close() error {
+	var err error
+	for _, s := range qs.segments {
+		if e := s.file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	qs.segments = nil
+	return err
+}
+
+// copyTo writes the blocks of the segment followed by its footer to dst.
+func (s snapshotSegment) copyTo(store queueStore, dst string) error {
+	out, err := store.OpenFile(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := out.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, s.file, s.size); err != nil {
+		return err
+	}
+	if _, err := out.Write(u64tob(uint64(s.pos))); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// compact rewrites the byte slices in the queue, from the head to the tail, into as few
+// new segments as they fit in, and removes the old segments.  Since the new segments are
+// written before the old ones are removed, a crash part of the way through can leave
+// slices in the queue twice, but never loses them.  Queues whose segments are already
+// full are left as they are.
+func (l *queue) compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.head == nil {
+		return ErrNotOpen
+	}
+	if l.isCompact() {
+		return nil
+	}
+
+	var compacted segments
+	removeCompacted := func() {
+		for _, s := range compacted {
+			s.close()
+			l.store.Remove(s.path)
+		}
+	}
+
+	addSegment := func() (*segment, error) {
+		if n := len(compacted); n > 0 {
+			if err := compacted[n-1].sync(); err != nil {
+				return nil, err
+			}
+		}
+
+		id, err := l.nextSegmentID()
+		if err != nil {
+			return nil, err
+		}
+		s, err := newSegment(l.store, filepath.Join(l.dir, strconv.FormatUint(id, 10)), l.maxSegmentSize)
+		if err != nil {
+			return nil, err
+		}
+		compacted = append(compacted, s)
+		return s, nil
+	}
+
+	tail, err := addSegment()
+	if err != nil {
+		return err
+	}
+	for _, s := range l.segments {
+		if err := s.forEach(func(_ int64, b []byte) error {
+			err := tail.append(b)
+			if err != ErrSegmentFull {
+				return err
+			}
+
+			if tail, err = addSegment(); err != nil {
+				return err
+			}
+			return tail.append(b)
+		}); err != nil {
+			removeCompacted()
+			return err
+		}
+	}
+	if err := tail.sync(); err != nil {
+		removeCompacted()
+		return err
+	}
+
+	for _, s := range l.segments {
+		if err := s.close(); err != nil {
+			return err
+		}
+		if err := l.store.Remove(s.path); err != nil {
+			return err
+		}
+	}
+	l.segments = compacted
+	l.head = l.segments[0]
+	l.tail = l.segments[len(l.segments)-1]
+	return nil
+}
+
+// isCompact returns whether compacting the queue would write the same segments: nothing
+// has been sent from the head, and no segment has room for the first slice of the next.
+func (l *queue) isCompact() bool {
+	l.head.mu.RLock()
+	pos := l.head.pos
+	l.head.mu.RUnlock()
+	if pos != 0 {
+		return false
+	}
+
+	for i := 0; i < len(l.segments)-1; i++ {
+		s, next := l.segments[i], l.segments[i+1]
+		s.mu.RLock()
+		size := s.size
+		s.mu.RUnlock()
+		next.mu.RLock()
+		first := next.currentSize
+		next.mu.RUnlock()
+
+		if first == 0 || size+first <= l.maxSegmentSize {
+			return false
+		}
+	}
+	return true
+}
+
 // Advance moves the head point to the next byte slice in the queue
 func (l *queue) Advance() error {
 	l.mu.Lock()
@@ -359,9 +819,17 @@ func (l *queue) Advance() error {
 		return ErrNotOpen
 	}
 
+	// Drop the current byte slice if it was read ahead.
+	l.aheadMu.Lock()
+	if l.aheadValid() {
+		l.aheadSize -= int64(len(l.ahead[0].b))
+		l.ahead = l.ahead[1:]
+	}
+	l.aheadMu.Unlock()
+
 	err := l.head.advance()
 	if err == io.EOF {
-		if err := l.trimHead(); err != nil {
+		if err := l.trimHead(true); err != nil {
 			return err
 		}
 	}
@@ -369,14 +837,21 @@ func (l *queue) Advance() error {
 	return nil
 }
 
-func (l *queue) trimHead() error {
+// trimHead removes the head segment, unless it is the only segment.  If drained is true,
+// the segment was advanced past, and it is archived if there is an archive directory.
+func (l *queue) trimHead(drained bool) error {
 	if len(l.segments) > 1 {
 		l.segments = l.segments[1:]
 
 		if err := l.head.close(); err != nil {
 			return err
 		}
-		if err := os.Remove(l.head.path); err != nil {
+		if drained && l.archiveDir != "" {
+			name := fmt.Sprintf("%d.%s", time.Now().UnixNano(), filepath.Base(l.head.path))
+			if err := l.store.Rename(l.head.path, filepath.Join(l.archiveDir, name)); err != nil {
+				return err
+			}
+		} else if err := l.store.Remove(l.head.path); err != nil {
 			return err
 		}
 		l.head = l.segments[0]
@@ -407,21 +882,24 @@ type segment struct {
 	mu sync.RWMutex
 
 	size int64
-	file *os.File
+	file segmentFile
 	path string
 
 	pos         int64
 	currentSize int64
 	maxSize     int64
+
+	// Number of bytes dropped from the end of the segment when it was opened
+	dropped int64
 }
 
-func newSegment(path string, maxSize int64) (*segment, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+func newSegment(store queueStore, path string, maxSize int64) (*segment, error) {
+	f, err := store.OpenFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	stats, err := os.Stat(path)
+	stats, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
@@ -457,7 +935,14 @@ func (l *segment) open() error {
 		return nil
 	}
 
-	// Existing segment so read the current position and the size of the current block
+	// Existing segment so make sure the last append completed before trusting the footer
+	dropped, err := l.recover()
+	if err != nil {
+		return err
+	}
+	l.dropped = dropped
+
+	// Read the current position and the size of the current block
 	if err := l.seekEnd(-footerSize); err != nil {
 		return err
 	}
@@ -485,7 +970,81 @@ func (l *segment) open() error {
 	return nil
 }
 
-// append adds byte slice to the end of segment
+// recover checks that the segment ends with a complete block followed by a valid footer.
+// If an append was interrupted, e.g. by a crash, the segment may end with a partial block
+// and the footer may have been overwritten.  In that case the segment is truncated back to
+// the end of the last complete block and a new footer is written.  If the old footer can't
+// be found, the head is reset to the start of the segment so no data is skipped.  It returns
+// the number of bytes that followed the last complete block.
+func (l *segment) recover() (int64, error) {
+	// Walk the blocks from the start of the segment, stopping at the first one that
+	// doesn't fit in the segment along with a footer.
+	offsets := map[int64]struct{}{0: {}}
+	var end int64
+	for end+footerSize < l.size {
+		if err := l.seek(end); err != nil {
+			return 0, err
+		}
+
+		sz, err := l.readUint64()
+		if err != nil {
+			return 0, err
+		}
+
+		if sz > uint64(l.size) || end+8+int64(sz)+footerSize > l.size {
+			break
+		}
+		end += 8 + int64(sz)
+		offsets[end] = struct{}{}
+	}
+
+	// Use the footer following the last complete block if it points at a block
+	var head int64
+	var footerOK bool
+	if end+footerSize <= l.size {
+		if err := l.seek(end); err != nil {
+			return 0, err
+		}
+
+		pos, err := l.readUint64()
+		if err != nil {
+			return 0, err
+		}
+
+		if _, ok := offsets[int64(pos)]; ok {
+			head, footerOK = int64(pos), true
+		}
+	}
+
+	if footerOK && end+footerSize == l.size {
+		// Segment is intact
+		return 0, nil
+	}
+
+	if err := l.file.Truncate(end); err != nil {
+		return 0, err
+	}
+
+	if err := l.seek(end); err != nil {
+		return 0, err
+	}
+
+	if err := l.writeUint64(uint64(head)); err != nil {
+		return 0, err
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return 0, err
+	}
+
+	dropped := l.size - end
+	l.size = end + footerSize
+
+	return dropped, nil
+}
+
+// append adds byte slice to the end of segment.  The segment must be synced for
+// the write to be durable.
 func (l *segment) append(b []byte) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -514,10 +1073,6 @@ func (l *segment) append(b []byte) error {
 		return err
 	}
 
-	if err := l.file.Sync(); err != nil {
-		return err
-	}
-
 	if l.currentSize == 0 {
 		l.currentSize = int64(len(b))
 	}
@@ -527,6 +1082,17 @@ func (l *segment) append(b []byte) error {
 	return nil
 }
 
+// sync commits the segment to disk
+func (l *segment) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return ErrNotOpen
+	}
+	return l.file.Sync()
+}
+
 // current returns byte slice that the current segment points
 func (l *segment) current() ([]byte, error) {
 	l.mu.Lock()
@@ -559,6 +1125,53 @@ func (l *segment) current() ([]byte, error) {
 	return b, nil
 }
 
+// forEach calls fn with each byte slice, and its offset, from the current position to
+// the end of the segment.  A *recordSizeError is returned if the length of a byte slice
+// is out of range.
+func (l *segment) forEach(fn func(pos int64, b []byte) error) error {
+	return l.forEachFrom(-1, fn)
+}
+
+// forEachFrom is like forEach, but starts at the byte slice at offset start, or at the
+// current position if start is negative.
+func (l *segment) forEachFrom(start int64, fn func(pos int64, b []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return ErrNotOpen
+	}
+
+	if start < 0 {
+		start = l.pos
+	}
+	for pos := start; pos < l.size-footerSize; {
+		if err := l.seek(pos); err != nil {
+			return err
+		}
+
+		sz, err := l.readUint64()
+		if err != nil {
+			return err
+		}
+
+		if max := l.size - footerSize - pos - 8; max < 0 || sz > uint64(max) {
+			return &recordSizeError{pos: pos, max: max, size: sz}
+		}
+
+		b := make([]byte, sz)
+		if err := l.readBytes(b); err != nil {
+			return err
+		}
+
+		if err := fn(pos, b); err != nil {
+			return err
+		}
+		pos += 8 + int64(sz)
+	}
+	return nil
+}
+
 // advance advances the current value pointer
 func (l *segment) advance() error {
 	l.mu.Lock()
@@ -620,13 +1233,20 @@ func (l *segment) lastModified() (time.Time, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	stats, err := os.Stat(l.file.Name())
+	stats, err := l.file.Stat()
 	if err != nil {
 		return time.Time{}, err
 	}
 	return stats.ModTime().UTC(), nil
 }
 
+// position returns the offset of the current byte slice in the segment.
+func (l *segment) position() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.pos
+}
+
 func (l *segment) diskUsage() int64 {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -706,6 +1326,24 @@ func (l *segment) readBytes(b []byte) error {
 	return nil
 }
 
+// recordSizeError is returned when the length of a byte slice in a segment is larger
+// than the rest of the segment.
+type recordSizeError struct {
+	pos  int64
+	max  int64
+	size uint64
+}
+
+func (e *recordSizeError) Error() string {
+	return fmt.Sprintf("record size out of range: max %d: got %d", e.max, e.size)
+}
+
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+
 func u64tob(v uint64) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, v)
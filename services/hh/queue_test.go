@@ -17,7 +17,7 @@ func BenchmarkQueueAppend(b *testing.B) {
 	}
 	defer os.RemoveAll(dir)
 
-	q, err := newQueue(dir, 1024*1024*1024)
+	q, err := newQueue(fileStore{}, dir, 1024*1024*1024)
 	if err != nil {
 		b.Fatalf("failed to create queue: %v", err)
 	}
@@ -41,7 +41,7 @@ func TestQueueAppendOne(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	q, err := newQueue(dir, 1024)
+	q, err := newQueue(fileStore{}, dir, 1024)
 	if err != nil {
 		t.Fatalf("failed to create queue: %v", err)
 	}
@@ -82,7 +82,7 @@ func TestQueueAppendMultiple(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	q, err := newQueue(dir, 1024)
+	q, err := newQueue(fileStore{}, dir, 1024)
 	if err != nil {
 		t.Fatalf("failed to create queue: %v", err)
 	}
@@ -123,7 +123,7 @@ func TestQueueAdvancePastEnd(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	// create the queue
-	q, err := newQueue(dir, 1024)
+	q, err := newQueue(fileStore{}, dir, 1024)
 	if err != nil {
 		t.Fatalf("failed to create queue: %v", err)
 	}
@@ -198,7 +198,7 @@ func TestQueueFull(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	// create the queue
-	q, err := newQueue(dir, 10)
+	q, err := newQueue(fileStore{}, dir, 10)
 	if err != nil {
 		t.Fatalf("failed to create queue: %v", err)
 	}
@@ -220,7 +220,7 @@ func TestQueueReopen(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	// create the queue
-	q, err := newQueue(dir, 1024)
+	q, err := newQueue(fileStore{}, dir, 1024)
 	if err != nil {
 		t.Fatalf("failed to create queue: %v", err)
 	}
@@ -291,7 +291,7 @@ func TestPurgeQueue(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	// create the queue
-	q, err := newQueue(dir, 1024)
+	q, err := newQueue(fileStore{}, dir, 1024)
 	if err != nil {
 		t.Fatalf("failed to create queue: %v", err)
 	}
@@ -325,3 +325,497 @@ func TestPurgeQueue(t *testing.T) {
 	}
 
 }
+
+func TestQueueReopenPartialWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh_queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create the queue
+	q, err := newQueue(fileStore{}, dir, 1024)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+
+	for _, b := range []string{"one", "two"} {
+		if err := q.Append([]byte(b)); err != nil {
+			t.Fatalf("Queue.Append failed: %v", err)
+		}
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("Queue.Close failed: %v", err)
+	}
+
+	// Simulate a crash part way through an append: the length of the block
+	// overwrites the footer, but only part of the block is written.
+	f, err := os.OpenFile(filepath.Join(dir, "1"), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	if _, err := f.Seek(-footerSize, os.SEEK_END); err != nil {
+		t.Fatalf("failed to seek segment: %v", err)
+	}
+	if _, err := f.Write(append(u64tob(100), []byte("partial")...)); err != nil {
+		t.Fatalf("failed to write segment: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close segment: %v", err)
+	}
+
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to re-open queue: %v", err)
+	}
+
+	if exp, got := int64(8+7), q.Truncated()[filepath.Join(dir, "1")]; got != exp {
+		t.Fatalf("Queue.Truncated mismatch: got %v, exp %v", got, exp)
+	}
+
+	for _, exp := range []string{"one", "two"} {
+		cur, err := q.Current()
+		if err != nil {
+			t.Fatalf("Queue.Current failed: %v", err)
+		}
+
+		if string(cur) != exp {
+			t.Errorf("Queue.Current mismatch: got %v, exp %v", string(cur), exp)
+		}
+
+		if err := q.Advance(); err != nil {
+			t.Fatalf("Queue.Advance failed: %v", err)
+		}
+	}
+
+	if _, err := q.Current(); err != io.EOF {
+		t.Fatalf("Queue.Current expected io.EOF, got: %v", err)
+	}
+
+	// The queue should be writable again after recovery.
+	if err := q.Append([]byte("three")); err != nil {
+		t.Fatalf("Queue.Append failed: %v", err)
+	}
+
+	cur, err := q.Current()
+	if err != nil {
+		t.Fatalf("Queue.Current failed: %v", err)
+	}
+
+	if exp := "three"; string(cur) != exp {
+		t.Errorf("Queue.Current mismatch: got %v, exp %v", string(cur), exp)
+	}
+}
+
+func TestQueueReopenTrailingGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh_queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create the queue
+	q, err := newQueue(fileStore{}, dir, 1024)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+
+	for _, b := range []string{"one", "two"} {
+		if err := q.Append([]byte(b)); err != nil {
+			t.Fatalf("Queue.Append failed: %v", err)
+		}
+	}
+
+	// Advance past the first block so the footer is not at the start of the segment.
+	if err := q.Advance(); err != nil {
+		t.Fatalf("Queue.Advance failed: %v", err)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("Queue.Close failed: %v", err)
+	}
+
+	// Append garbage after the footer.
+	f, err := os.OpenFile(filepath.Join(dir, "1"), os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	if _, err := f.Write([]byte("junk")); err != nil {
+		t.Fatalf("failed to write segment: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close segment: %v", err)
+	}
+
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to re-open queue: %v", err)
+	}
+
+	// The head position should have been kept.
+	cur, err := q.Current()
+	if err != nil {
+		t.Fatalf("Queue.Current failed: %v", err)
+	}
+
+	if exp := "two"; string(cur) != exp {
+		t.Errorf("Queue.Current mismatch: got %v, exp %v", string(cur), exp)
+	}
+
+	stats, err := os.Stat(filepath.Join(dir, "1"))
+	if err != nil {
+		t.Fatalf("failed to stat segment: %v", err)
+	}
+
+	// 8 byte header ptr + 2 * (8 byte record len + record len)
+	if exp := int64(8 + 2*(8+3)); stats.Size() != exp {
+		t.Fatalf("segment size mismatch. got %v, exp %v", stats.Size(), exp)
+	}
+}
+
+func TestQueueReopenSegmentOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh_queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create the queue
+	q, err := newQueue(fileStore{}, dir, 1024)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+
+	// Fit one entry per segment, and write enough entries that the lexical order
+	// of the segment file names differs from the order they were written in.
+	if err := q.SetMaxSegmentSize(8 + 8 + 2); err != nil {
+		t.Fatalf("Queue.SetMaxSegmentSize failed: %v", err)
+	}
+
+	var exp []string
+	for i := 0; i < 12; i++ {
+		exp = append(exp, fmt.Sprintf("%02d", i))
+		if err := q.Append([]byte(exp[i])); err != nil {
+			t.Fatalf("Queue.Append failed: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "12")); err != nil {
+		t.Fatalf("expected 12 segments: %v", err)
+	}
+
+	// close and re-open the queue
+	if err := q.Close(); err != nil {
+		t.Fatalf("Queue.Close failed: %v", err)
+	}
+
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to re-open queue: %v", err)
+	}
+
+	for _, exp := range exp {
+		cur, err := q.Current()
+		if err != nil {
+			t.Fatalf("Queue.Current failed: %v", err)
+		}
+
+		if string(cur) != exp {
+			t.Fatalf("Queue.Current mismatch: got %v, exp %v", string(cur), exp)
+		}
+
+		if err := q.Advance(); err != nil {
+			t.Fatalf("Queue.Advance failed: %v", err)
+		}
+	}
+
+	if _, err := q.Current(); err != io.EOF {
+		t.Fatalf("Queue.Current expected io.EOF, got: %v", err)
+	}
+}
+
+func TestQueueMemStore(t *testing.T) {
+	store := newMemStore()
+	dir := filepath.Join("hh", "1")
+	if err := store.MkdirAll(dir); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	q, err := newQueue(store, dir, 1024)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+
+	// Each append fills a segment, so every value is in its own segment.
+	if err := q.SetMaxSegmentSize(16); err != nil {
+		t.Fatalf("failed to set max segment size: %v", err)
+	}
+	for _, v := range []string{"one", "two", "three"} {
+		if err := q.Append([]byte(v)); err != nil {
+			t.Fatalf("Queue.Append failed: %v", err)
+		}
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("failed to close queue: %v", err)
+	}
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+
+	for _, exp := range []string{"one", "two", "three"} {
+		cur, err := q.Current()
+		if err != nil {
+			t.Fatalf("Queue.Current failed: %v", err)
+		}
+		if string(cur) != exp {
+			t.Fatalf("Queue.Current mismatch: got %v, exp %v", string(cur), exp)
+		}
+		if err := q.Advance(); err != nil {
+			t.Fatalf("Queue.Advance failed: %v", err)
+		}
+	}
+
+	if _, err := q.Current(); err != io.EOF {
+		t.Fatalf("Queue.Current expected io.EOF, got: %v", err)
+	}
+
+	// Segments that were read should have been removed.
+	files, err := store.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if exp := 1; len(files) != exp {
+		t.Fatalf("segment count mismatch: got %v, exp %v", len(files), exp)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("failed to close queue: %v", err)
+	}
+	if err := q.Remove(); err != nil {
+		t.Fatalf("failed to remove queue: %v", err)
+	}
+	if _, err := store.ReadDir(dir); !os.IsNotExist(err) {
+		t.Fatalf("ReadDir() error mismatch: got %v, exp not exist", err)
+	}
+}
+
+func TestQueueReadAhead(t *testing.T) {
+	store := newMemStore()
+	dir := filepath.Join("hh", "1")
+	if err := store.MkdirAll(dir); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	q, err := newQueue(store, dir, 1024)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	defer q.Close()
+
+	// Fit three entries per segment, and read ahead up to three entries, so reading
+	// ahead crosses segments.
+	if err := q.SetMaxSegmentSize(3*(8+2) + 8); err != nil {
+		t.Fatalf("Queue.SetMaxSegmentSize failed: %v", err)
+	}
+	q.SetReadAhead(3 * 2)
+
+	var exp []string
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			exp = append(exp, fmt.Sprintf("%02d", len(exp)))
+			if err := q.Append([]byte(exp[len(exp)-1])); err != nil {
+				t.Fatalf("Queue.Append failed: %v", err)
+			}
+		}
+	}
+	appendN(10)
+
+	for i := 0; i < len(exp); i++ {
+		if err := q.readAhead(); err != nil {
+			t.Fatalf("Queue.readAhead failed: %v", err)
+		}
+		if q.aheadSize == 0 || q.aheadSize > 3*2 {
+			t.Fatalf("read-ahead size mismatch: got %v, exp 1 to %v", q.aheadSize, 3*2)
+		}
+
+		cur, err := q.Current()
+		if err != nil {
+			t.Fatalf("Queue.Current failed: %v", err)
+		}
+		if string(cur) != exp[i] {
+			t.Fatalf("Queue.Current mismatch: got %v, exp %v", string(cur), exp[i])
+		}
+
+		if err := q.Advance(); err != nil {
+			t.Fatalf("Queue.Advance failed: %v", err)
+		}
+
+		// Entries appended while reading ahead, and reopening the queue, shouldn't
+		// change what is read.
+		switch i {
+		case 4:
+			appendN(5)
+		case 7:
+			if err := q.Close(); err != nil {
+				t.Fatalf("Queue.Close failed: %v", err)
+			}
+			if err := q.Open(); err != nil {
+				t.Fatalf("failed to reopen queue: %v", err)
+			}
+		}
+	}
+
+	if _, err := q.Current(); err != io.EOF {
+		t.Fatalf("Queue.Current expected io.EOF, got: %v", err)
+	}
+}
+
+func TestQueueCompact_Full(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh_queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newQueue(fileStore{}, dir, 1024)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	defer q.Close()
+
+	// Each append fills a segment, so the segments can't be compacted any further.
+	if err := q.SetMaxSegmentSize(16); err != nil {
+		t.Fatalf("failed to set max segment size: %v", err)
+	}
+	for _, v := range []string{"one", "two", "three"} {
+		if err := q.Append([]byte(v)); err != nil {
+			t.Fatalf("Queue.Append failed: %v", err)
+		}
+	}
+
+	var paths []string
+	for _, s := range q.segments {
+		paths = append(paths, s.path)
+	}
+	if err := q.compact(); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	for i, s := range q.segments {
+		if i >= len(paths) || s.path != paths[i] {
+			t.Fatalf("segment %d rewritten: got %v, exp %v", i, s.path, paths)
+		}
+	}
+
+	// Once the head has been partly sent, compacting drops what was sent from it.
+	if err := q.Advance(); err != nil {
+		t.Fatalf("Queue.Advance failed: %v", err)
+	}
+	if err := q.compact(); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	if got := len(q.segments); got >= len(paths) {
+		t.Fatalf("segments mismatch: got %v, exp fewer than %v", got, len(paths))
+	}
+}
+
+func TestQueueSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh_queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newQueue(fileStore{}, dir, 1024)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if err := q.Open(); err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	defer q.Close()
+
+	// Each append fills a segment, so every value is in its own segment.
+	if err := q.SetMaxSegmentSize(16); err != nil {
+		t.Fatalf("failed to set max segment size: %v", err)
+	}
+	for _, v := range []string{"one", "two", "three"} {
+		if err := q.Append([]byte(v)); err != nil {
+			t.Fatalf("Queue.Append failed: %v", err)
+		}
+	}
+
+	snapDir, err := ioutil.TempDir("", "hh_snapshot")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(snapDir)
+
+	qs, err := q.takeSnapshot()
+	if err != nil {
+		t.Fatalf("takeSnapshot failed: %v", err)
+	}
+	defer qs.Close()
+
+	// Sending the head, which rewrites its footer and then removes it, and appending
+	// before the snapshot is copied shouldn't change what is in it.
+	for i := 0; i < 2; i++ {
+		if err := q.Advance(); err != nil {
+			t.Fatalf("Queue.Advance failed: %v", err)
+		}
+	}
+	if _, err := os.Stat(qs.segments[0].path); !os.IsNotExist(err) {
+		t.Fatalf("head segment not removed: %v", err)
+	}
+	if err := q.Append([]byte("four")); err != nil {
+		t.Fatalf("Queue.Append failed: %v", err)
+	}
+
+	if err := qs.copyTo(snapDir); err != nil {
+		t.Fatalf("copy snapshot failed: %v", err)
+	}
+
+	r, err := newQueue(fileStore{}, snapDir, 1024)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if err := r.Open(); err != nil {
+		t.Fatalf("failed to open snapshot queue: %v", err)
+	}
+	defer r.Close()
+
+	for _, exp := range []string{"one", "two", "three"} {
+		cur, err := r.Current()
+		if err != nil {
+			t.Fatalf("Queue.Current failed: %v", err)
+		}
+		if string(cur) != exp {
+			t.Fatalf("Queue.Current mismatch: got %v, exp %v", string(cur), exp)
+		}
+		if err := r.Advance(); err != nil {
+			t.Fatalf("Queue.Advance failed: %v", err)
+		}
+	}
+	if _, err := r.Current(); err != io.EOF {
+		t.Fatalf("Queue.Current expected io.EOF, got: %v", err)
+	}
+}
@@ -3,22 +3,70 @@ package hh
 import (
 	"expvar"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/influxdb/influxdb"
+	"github.com/influxdb/influxdb/influxql"
 	"github.com/influxdb/influxdb/meta"
 	"github.com/influxdb/influxdb/models"
 	"github.com/influxdb/influxdb/monitor"
 )
 
-var ErrHintedHandoffDisabled = fmt.Errorf("hinted handoff disabled")
+var (
+	ErrHintedHandoffDisabled = fmt.Errorf("hinted handoff disabled")
+	ErrTooManyProcessors     = fmt.Errorf("too many node processors")
+	ErrProcessorNotFound     = fmt.Errorf("node processor not found")
+	ErrProcessorExists       = fmt.Errorf("node processor already exists")
+	ErrBatchTooLarge         = fmt.Errorf("hinted handoff write larger than max batch size")
+	ErrNodeFailing           = fmt.Errorf("sending hinted handoff data to node is failing")
+	ErrNoThroughput          = fmt.Errorf("no hinted handoff data sent to node yet")
+	ErrShardNotFound         = fmt.Errorf("shard not found")
+	ErrPointsInvalid         = fmt.Errorf("hinted handoff points don't match the schema")
+	ErrServiceOpen           = fmt.Errorf("hinted handoff service open")
+	ErrServiceClosed         = fmt.Errorf("hinted handoff service closed")
+	ErrWriteTimeout          = fmt.Errorf("hinted handoff write to node timed out")
+
+	// ErrHighWaterMark is returned when points were queued, but the queue for the node
+	// is larger than the high-water mark. Callers should slow down to avoid the queue
+	// filling up and further writes being rejected.
+	ErrHighWaterMark error = queuedError{"hinted handoff queue above high-water mark"}
+)
+
+// queuedError is an error returned for a write that was queued anyway. Callers can
+// detect it, without depending on this package, by its Queued method.
+type queuedError struct {
+	msg string
+}
+
+func (e queuedError) Error() string { return e.msg }
+
+// Queued returns true, since the write was queued.
+func (e queuedError) Queued() bool { return true }
+
+// ReplayError is returned by ForceReplayAll when sending the data of some nodes failed.
+// It holds the error of each of those nodes, keyed by node ID.
+type ReplayError map[uint64]error
+
+func (e ReplayError) Error() string {
+	ids := make([]uint64, 0, len(e))
+	for k := range e {
+		ids = append(ids, k)
+	}
+	sort.Sort(uint64Slice(ids))
+
+	msgs := make([]string, len(ids))
+	for i, k := range ids {
+		msgs[i] = fmt.Sprintf("node %d: %s", k, e[k])
+	}
+	return fmt.Sprintf("hinted handoff replay failed: %s", strings.Join(msgs, "; "))
+}
 
 const (
 	writeShardReq       = "writeShardReq"
@@ -26,21 +74,68 @@ const (
 	writeNodeReq        = "writeNodeReq"
 	writeNodeReqFail    = "writeNodeReqFail"
 	writeNodeReqPoints  = "writeNodeReqPoints"
+	pointsDelivered     = "pointsDelivered"
+	pointsDropped       = "pointsDropped"
+	pointsDeadLettered  = "pointsDeadLettered"
+
+	processorCreateContended = "processorCreateContended"
+	writeShardReqInvalid     = "writeShardReqInvalid"
+	pointsStale              = "pointsStale"
+	pointsInvalid            = "pointsInvalid"
+)
+
+const (
+	// maxHintStats is the number of distinct hints writes are counted by.  Writes with
+	// further hints are counted under otherHint, so callers passing arbitrary hints can't
+	// grow the statistics without limit.
+	maxHintStats = 100
+	otherHint    = "other"
 )
 
 type Service struct {
 	mu      sync.RWMutex
 	wg      sync.WaitGroup
 	closing chan struct{}
+	opened  bool
+
+	// Writes being queued by WriteShardAsync.  asyncWrites limits how many there are.
+	asyncWG     sync.WaitGroup
+	asyncWrites chan struct{}
 
 	processors map[uint64]*NodeProcessor
 
 	statMap *expvar.Map
-	Logger  *log.Logger
+	Logger  *log.Logger // Only used under mu, so use SetLogger once the service is open.
 	cfg     Config
 
+	// Statistics of writes, keyed by the hint they were handed off with.
+	hintStatsMu sync.Mutex
+	hintStats   map[string]*expvar.Map
+
+	// Nodes with data waiting to be sent, and the channel closed when there are none.
+	drainedMu    sync.Mutex
+	pendingNodes map[uint64]struct{}
+	drained      chan struct{}
+
+	// Channels receiving replay events, keyed by the channel returned by Subscribe.
+	subsMu sync.RWMutex
+	subs   map[<-chan ReplayEvent]chan ReplayEvent
+
+	// EventLogger logs events for processing by machine. If nil, they go to Logger.
+	EventLogger EventLogger
+
 	shardWriter shardWriter
+	writers     map[uint64]shardWriter // Overrides shardWriter for the data of a node.
+	nodeConfigs map[uint64]NodeConfig  // Overrides cfg for the queue of a node.
 	metastore   metaStore
+	store       queueStore
+
+	// Limits the number of processors sending data at the same time, if not nil.
+	replays chan struct{}
+
+	// Now returns the current time. It is used when deciding whether data is old
+	// enough to purge, and can be replaced for testing.
+	Now func() time.Time
 
 	Monitor interface {
 		RegisterDiagnosticsClient(name string, client monitor.DiagsClient)
@@ -54,6 +149,11 @@ type shardWriter interface {
 
 type metaStore interface {
 	Node(id uint64) (ni *meta.NodeInfo, err error)
+	ShardOwner(shardID uint64) (database, policy string, sgi *meta.ShardGroupInfo)
+
+	// MeasurementFields returns the types of the fields of the measurement in the
+	// database, keyed by field name, or false if the database has no such measurement.
+	MeasurementFields(database, name string) (map[string]influxql.DataType, bool)
 }
 
 // NewService returns a new instance of Service.
@@ -61,17 +161,34 @@ func NewService(c Config, w shardWriter, m metaStore) *Service {
 	key := strings.Join([]string{"hh", c.Dir}, ":")
 	tags := map[string]string{"path": c.Dir}
 
+	drained := make(chan struct{})
+	close(drained)
+
+	var asyncWrites chan struct{}
+	if c.MaxAsyncWrites > 0 {
+		asyncWrites = make(chan struct{}, c.MaxAsyncWrites)
+	}
+
 	return &Service{
 		cfg:         c,
 		closing:     make(chan struct{}),
 		processors:  make(map[uint64]*NodeProcessor),
 		statMap:     influxdb.NewStatistics(key, "hh", tags),
+		hintStats:   make(map[string]*expvar.Map),
+		subs:        make(map[<-chan ReplayEvent]chan ReplayEvent),
+		drained:     drained,
+		asyncWrites: asyncWrites,
 		Logger:      log.New(os.Stderr, "[handoff] ", log.LstdFlags),
 		shardWriter: w,
+		writers:     make(map[uint64]shardWriter),
+		nodeConfigs: make(map[uint64]NodeConfig),
 		metastore:   m,
+		store:       fileStore{perm: os.FileMode(c.DirPerm)},
+		Now:         time.Now,
 	}
 }
 
+// Open starts the service. Calling Open on a service that is already open does nothing.
 func (s *Service) Open() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -79,6 +196,13 @@ func (s *Service) Open() error {
 		// Allow Open to proceed, but don't do anything.
 		return nil
 	}
+	if err := s.cfg.Validate(); err != nil {
+		return err
+	}
+	if s.opened {
+		// Already open.
+		return nil
+	}
 	s.Logger.Printf("Starting hinted handoff service")
 	s.closing = make(chan struct{})
 
@@ -89,12 +213,16 @@ func (s *Service) Open() error {
 
 	// Create the root directory if it doesn't already exist.
 	s.Logger.Printf("Using data dir: %v", s.cfg.Dir)
-	if err := os.MkdirAll(s.cfg.Dir, 0700); err != nil {
+	if err := s.store.MkdirAll(s.cfg.Dir); err != nil {
 		return fmt.Errorf("mkdir all: %s", err)
 	}
 
+	if err := s.loadNodeConfigs(); err != nil {
+		return err
+	}
+
 	// Create a node processor for each node directory.
-	files, err := ioutil.ReadDir(s.cfg.Dir)
+	files, err := s.store.ReadDir(s.cfg.Dir)
 	if err != nil {
 		return err
 	}
@@ -106,23 +234,38 @@ func (s *Service) Open() error {
 			continue
 		}
 
-		n := NewNodeProcessor(nodeID, s.pathforNode(nodeID), s.shardWriter, s.metastore)
+		n := s.newNodeProcessor(nodeID)
 		if err := n.Open(); err != nil {
 			return err
 		}
 		s.processors[nodeID] = n
 	}
 
+	s.opened = true
 	s.wg.Add(1)
-	go s.purgeInactiveProcessors()
+	go s.purgeInactiveProcessors(s.closing)
 
 	return nil
 }
 
 func (s *Service) Close() error {
+	s.mu.Lock()
 	s.Logger.Println("shutting down hh service")
+	closing := s.closing
+	s.closing = nil
+	s.mu.Unlock()
+
+	// Stop purging before closing the processors, since purging takes the lock.
+	if closing != nil {
+		close(closing)
+	}
+	s.wg.Wait()
+	// Async writes are no longer accepted, so none are added while waiting.
+	s.asyncWG.Wait()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.opened = false
 
 	for _, p := range s.processors {
 		if err := p.Close(); err != nil {
@@ -130,27 +273,104 @@ func (s *Service) Close() error {
 		}
 	}
 
-	if s.closing != nil {
-		close(s.closing)
-	}
-	s.wg.Wait()
-	s.closing = nil
-
 	return nil
 }
 
-// SetLogger sets the internal logger to the logger passed in.
+// SetLogger sets the internal logger to the logger passed in. It is safe to call
+// while the service is open.
 func (s *Service) SetLogger(l *log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Logger = l
 }
 
-// WriteShard queues the points write for shardID to node ownerID to handoff queue
+// WriteShard queues the points write for shardID to node ownerID to handoff queue.
+// ErrHighWaterMark is returned if the points were queued, but the queue is filling up.
 func (s *Service) WriteShard(shardID, ownerID uint64, points []models.Point) error {
+	return s.WriteShardWithHint(shardID, ownerID, points, "")
+}
+
+// WriteShardAsync queues the points write like WriteShard, but in the background, and
+// calls done with the result once WriteShard would have returned, so once the write is
+// synced to disk if the sync policy syncs every write.  When batch-interval is set, that
+// is once the write is buffered, before it is in the queue, so a crash can lose writes
+// acknowledged with nil; buffered writes are otherwise flushed by Close.  If
+// max-async-writes writes are already being queued, it waits for one to finish first.
+// ErrServiceClosed is passed to done once the service has started closing.
+// done may be nil.
+func (s *Service) WriteShardAsync(shardID, ownerID uint64, points []models.Point, done func(error)) {
+	if s.asyncWrites != nil {
+		s.asyncWrites <- struct{}{}
+	}
+	finish := func(err error) {
+		if s.asyncWrites != nil {
+			<-s.asyncWrites
+		}
+		if done != nil {
+			done(err)
+		}
+	}
+
+	// Accept the write under the lock, since Close stops accepting writes under it before
+	// waiting for those it accepted.
+	var err error
+	s.mu.RLock()
+	if !s.cfg.Enabled {
+		err = ErrHintedHandoffDisabled
+	} else if s.closing == nil {
+		err = ErrServiceClosed
+	} else {
+		s.asyncWG.Add(1)
+	}
+	s.mu.RUnlock()
+	if err != nil {
+		finish(err)
+		return
+	}
+
+	go func() {
+		defer s.asyncWG.Done()
+		finish(s.WriteShard(shardID, ownerID, points))
+	}()
+}
+
+// WriteShardWithHint queues a write like WriteShard, along with a hint describing why it
+// was handed off, such as "node unreachable".  The hint is kept with the queued data and
+// reported in events about it, and writes are counted by hint in the statistics, up
+// to maxHintStats hints.
+func (s *Service) WriteShardWithHint(shardID, ownerID uint64, points []models.Point, hint string) error {
 	if !s.cfg.Enabled {
 		return ErrHintedHandoffDisabled
 	}
 	s.statMap.Add(writeShardReq, 1)
 	s.statMap.Add(writeShardReqPoints, int64(len(points)))
+	if hint != "" {
+		m := s.hintStatMap(hint)
+		m.Add(writeShardReq, 1)
+		m.Add(writeShardReqPoints, int64(len(points)))
+	}
+
+	// Data for a shard that has been dropped, along with its database or retention
+	// policy, or for a dropped measurement, would only fail once it is sent, so don't
+	// queue it.
+	if s.cfg.ValidateOnWrite {
+		database, _, sgi := s.metastore.ShardOwner(shardID)
+		if sgi == nil {
+			s.statMap.Add(writeShardReqInvalid, 1)
+			return ErrShardNotFound
+		}
+		if points = s.dropInvalidPoints(shardID, ownerID, database, points); len(points) == 0 {
+			s.statMap.Add(writeShardReqInvalid, 1)
+			return ErrPointsInvalid
+		}
+	}
+
+	if s.cfg.MaxPointAge > 0 {
+		points = s.dropStalePoints(shardID, ownerID, points)
+		if len(points) == 0 {
+			return nil
+		}
+	}
 
 	s.mu.RLock()
 	processor, ok := s.processors[ownerID]
@@ -163,11 +383,27 @@ func (s *Service) WriteShard(shardID, ownerID uint64, points []models.Point) err
 
 			processor, ok = s.processors[ownerID]
 			if !ok {
-				processor = NewNodeProcessor(ownerID, s.pathforNode(ownerID), s.shardWriter, s.metastore)
+				s.statMap.Add(processorCreateContended, 1)
+				if s.cfg.MaxProcessors > 0 {
+					// Only real nodes should count towards the limit.
+					ni, err := s.metastore.Node(ownerID)
+					if err != nil {
+						return err
+					} else if ni == nil {
+						return meta.ErrNodeNotFound
+					}
+
+					if len(s.processors) >= s.cfg.MaxProcessors {
+						return ErrTooManyProcessors
+					}
+				}
+
+				processor = s.newNodeProcessor(ownerID)
 				if err := processor.Open(); err != nil {
 					return err
 				}
 				s.processors[ownerID] = processor
+				s.logEvent(LevelInfo, EventQueueCreated, "node", ownerID)
 			}
 			return nil
 		}(); err != nil {
@@ -175,13 +411,378 @@ func (s *Service) WriteShard(shardID, ownerID uint64, points []models.Point) err
 		}
 	}
 
-	if err := processor.WriteShard(shardID, points); err != nil {
+	if err := processor.WriteShardWithHint(shardID, points, hint); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// hintStatMap returns the statistics of writes with the hint, or of otherHint once
+// maxHintStats hints are counted.
+func (s *Service) hintStatMap(hint string) *expvar.Map {
+	s.hintStatsMu.Lock()
+	defer s.hintStatsMu.Unlock()
+
+	m, ok := s.hintStats[hint]
+	if !ok && len(s.hintStats) >= maxHintStats {
+		hint = otherHint
+		m, ok = s.hintStats[hint]
+	}
+	if !ok {
+		key := strings.Join([]string{"hh_hint", s.cfg.Dir, hint}, ":")
+		tags := map[string]string{"path": s.cfg.Dir, "hint": hint}
+		m = influxdb.NewStatistics(key, "hh_hint", tags)
+		s.hintStats[hint] = m
+	}
+	return m
+}
+
+// dropStalePoints returns the points that are no older than the max point age, counting
+// the rest as dropped.
+func (s *Service) dropStalePoints(shardID, ownerID uint64, points []models.Point) []models.Point {
+	cutoff := s.Now().Add(-time.Duration(s.cfg.MaxPointAge))
+
+	fresh := make([]models.Point, 0, len(points))
+	for _, p := range points {
+		if !p.Time().Before(cutoff) {
+			fresh = append(fresh, p)
+		}
+	}
+
+	if dropped := len(points) - len(fresh); dropped > 0 {
+		s.statMap.Add(pointsDropped, int64(dropped))
+		s.statMap.Add(pointsStale, int64(dropped))
+
+		s.mu.RLock()
+		s.logEvent(LevelInfo, EventPointsStale, "node", ownerID, "shard", shardID, "points", dropped)
+		s.mu.RUnlock()
+	}
+	return fresh
+}
+
+// dropInvalidPoints returns the points whose measurement is in the database, and whose
+// fields have the types the measurement's fields have, counting the rest as dropped.
+// Fields the measurement doesn't have yet are allowed, since writes add them.
+func (s *Service) dropInvalidPoints(shardID, ownerID uint64, database string, points []models.Point) []models.Point {
+	valid := make([]models.Point, 0, len(points))
+	schemas := make(map[string]map[string]influxql.DataType)
+	for _, p := range points {
+		fields, ok := schemas[p.Name()]
+		if !ok {
+			// Unknown measurements are cached as a nil schema.
+			fields, _ = s.metastore.MeasurementFields(database, p.Name())
+			schemas[p.Name()] = fields
+		}
+		if fields == nil || !fieldsMatch(fields, p.Fields()) {
+			continue
+		}
+		valid = append(valid, p)
+	}
+
+	if dropped := len(points) - len(valid); dropped > 0 {
+		s.statMap.Add(pointsDropped, int64(dropped))
+		s.statMap.Add(pointsInvalid, int64(dropped))
+
+		s.mu.RLock()
+		s.logEvent(LevelInfo, EventPointsInvalid, "node", ownerID, "shard", shardID, "points", dropped)
+		s.mu.RUnlock()
+	}
+	return valid
+}
+
+// fieldsMatch returns true if every value in fields has the type of the field of the
+// same name in schema, if schema has one.
+func fieldsMatch(schema map[string]influxql.DataType, fields models.Fields) bool {
+	for k, v := range fields {
+		if typ, ok := schema[k]; ok && typ != influxql.InspectDataType(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// PeekNode returns up to the next n points queued for the node, without removing
+// them from the queue.  No points are returned if n isn't positive.
+func (s *Service) PeekNode(nodeID uint64, n int) ([]models.Point, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return nil, ErrProcessorNotFound
+	}
+	return processor.Peek(n)
+}
+
+// DeadLettered returns the points queued for the node in writes that failed permanently.
+func (s *Service) DeadLettered(nodeID uint64) ([]models.Point, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return nil, ErrProcessorNotFound
+	}
+	return processor.DeadLettered()
+}
+
+// RequeueDeadLetters queues writes for the node that failed permanently to be sent again.
+func (s *Service) RequeueDeadLetters(nodeID uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return ErrProcessorNotFound
+	}
+	return processor.RequeueDeadLetters()
+}
+
+// ReassignQueue moves the data queued for a node to another node, such as when a node
+// is replaced by one with a new ID. The data is sent to the new node instead.
+// ErrProcessorExists is returned if data is already queued for the new node.
+func (s *Service) ReassignQueue(oldNodeID, newNodeID uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	processor, ok := s.processors[oldNodeID]
+	if !ok {
+		return ErrProcessorNotFound
+	}
+	if _, ok := s.processors[newNodeID]; ok {
+		return ErrProcessorExists
+	}
+
+	if err := processor.Close(); err != nil {
+		return err
+	}
+	if err := s.store.Rename(s.pathforNode(oldNodeID), s.pathforNode(newNodeID)); err != nil {
+		if err := processor.Open(); err != nil {
+			s.Logger.Printf("failed to reopen node processor %d: %s", oldNodeID, err.Error())
+		}
+		return err
+	}
+	delete(s.processors, oldNodeID)
+
+	// The data is pending for the new node once it is open, so Drained doesn't fire
+	// in between.
+	processor = s.newNodeProcessor(newNodeID)
+	err := processor.Open()
+	s.setNodePending(oldNodeID, false)
+	if err != nil {
+		return err
+	}
+	s.processors[newNodeID] = processor
+	return nil
+}
+
+// LastError returns the most recent error sending queued data to the node, and when it
+// occurred. The error is nil if data has been sent successfully since, or if no data
+// is queued for the node.
+func (s *Service) LastError(nodeID uint64) (error, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return nil, time.Time{}
+	}
+	return processor.LastError()
+}
+
+// VerifyNode checks that the data queued for the node can be read, without modifying it.
+func (s *Service) VerifyNode(nodeID uint64) (VerifyReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return VerifyReport{}, ErrProcessorNotFound
+	}
+	return processor.Verify()
+}
+
+// EstimateDrainTime returns how long sending the data queued for the node should take,
+// based on the recent rate data has been sent to it.
+func (s *Service) EstimateDrainTime(nodeID uint64) (time.Duration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return 0, ErrProcessorNotFound
+	}
+	return processor.EstimateDrainTime()
+}
+
+// Compact rewrites the data queued for the node into as few segments as it fits in,
+// reducing the number of files holding it.  Nothing is rewritten if the segments are
+// already full.
+func (s *Service) Compact(nodeID uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return ErrProcessorNotFound
+	}
+	return processor.Compact()
+}
+
+// ForceReplayAll sends the data of every node now, rather than waiting for the next retry
+// interval, such as after the cluster recovers from an outage.  Nodes are sent to at the
+// same time, within max-concurrent-replays and each node's retry rate limit, and it
+// returns once each node has been drained, paused or failed.  A ReplayError holding the
+// error of each node that failed is returned if any did.
+func (s *Service) ForceReplayAll() error {
+	// Don't hold the lock while sending, which can take a long time.
+	s.mu.RLock()
+	processors := make(map[uint64]*NodeProcessor, len(s.processors))
+	for k, v := range s.processors {
+		processors[k] = v
+	}
+	s.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(ReplayError)
+	for k, v := range processors {
+		wg.Add(1)
+		go func(nodeID uint64, processor *NodeProcessor) {
+			defer wg.Done()
+			if err := processor.Replay(); err != nil {
+				mu.Lock()
+				errs[nodeID] = err
+				mu.Unlock()
+			}
+		}(k, v)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// PendingShards returns the IDs of the shards with data queued for the node, in order.
+func (s *Service) PendingShards(nodeID uint64) ([]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return nil, ErrProcessorNotFound
+	}
+	return processor.PendingShards()
+}
+
+// Drained returns a channel that is closed once no data is waiting to be sent to any
+// node.  Once data is written again, Drained returns a new channel, so call it again
+// after each wait.
+func (s *Service) Drained() <-chan struct{} {
+	s.drainedMu.Lock()
+	defer s.drainedMu.Unlock()
+	return s.drained
+}
+
+// setNodePending records whether data is waiting to be sent to the node, closing the
+// channel returned by Drained once there is none for any node, and replacing it once
+// there is again.
+func (s *Service) setNodePending(nodeID uint64, pending bool) {
+	s.drainedMu.Lock()
+	defer s.drainedMu.Unlock()
+
+	if pending {
+		if s.pendingNodes == nil {
+			s.pendingNodes = make(map[uint64]struct{})
+		}
+		if len(s.pendingNodes) == 0 {
+			s.drained = make(chan struct{})
+		}
+		s.pendingNodes[nodeID] = struct{}{}
+		return
+	}
+
+	if _, ok := s.pendingNodes[nodeID]; !ok {
+		return
+	}
+	delete(s.pendingNodes, nodeID)
+	if len(s.pendingNodes) == 0 {
+		close(s.drained)
+	}
+}
+
+// PauseNode stops queued data being sent to the node until ResumeNode is called.
+// Writes for the node are still queued.
+func (s *Service) PauseNode(nodeID uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return ErrProcessorNotFound
+	}
+	processor.Pause()
+	return nil
+}
+
+// ResumeNode resumes sending queued data to the node after PauseNode.
+func (s *Service) ResumeNode(nodeID uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	processor, ok := s.processors[nodeID]
+	if !ok {
+		return ErrProcessorNotFound
+	}
+	processor.Resume()
+	return nil
+}
+
+// SetWriterForNode sends the data queued for the node to w rather than to the service's
+// shard writer, such as to redirect it to a temporary node during a migration.  A nil w
+// restores the service's shard writer.
+func (s *Service) SetWriterForNode(nodeID uint64, w shardWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w == nil {
+		delete(s.writers, nodeID)
+	} else {
+		s.writers[nodeID] = w
+	}
+
+	if processor, ok := s.processors[nodeID]; ok {
+		processor.SetWriter(s.writerForNode(nodeID))
+	}
+}
+
+// writerForNode returns the writer the node's data is sent with.
+func (s *Service) writerForNode(nodeID uint64) shardWriter {
+	if w, ok := s.writers[nodeID]; ok {
+		return w
+	}
+	return s.shardWriter
+}
+
+// Stats returns statistics for the hinted-handoff data of each node, keyed by node ID.
+func (s *Service) Stats() (map[uint64]NodeStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := make(map[uint64]NodeStats, len(s.processors))
+	for k, v := range s.processors {
+		st, err := v.Stats()
+		if err != nil {
+			return nil, err
+		}
+		stats[k] = st
+	}
+	return stats, nil
+}
+
 // Diagnostics returns diagnostic information.
 func (s *Service) Diagnostics() (*monitor.Diagnostic, error) {
 	s.mu.RLock()
@@ -213,55 +814,152 @@ func (s *Service) Diagnostics() (*monitor.Diagnostic, error) {
 }
 
 // purgeInactiveProcessors will cause the service to remove processors for inactive nodes.
-func (s *Service) purgeInactiveProcessors() {
+func (s *Service) purgeInactiveProcessors(closing <-chan struct{}) {
 	defer s.wg.Done()
 	ticker := time.NewTicker(time.Duration(s.cfg.PurgeInterval))
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-s.closing:
+		case <-closing:
 			return
 		case <-ticker.C:
-			func() {
-				s.mu.Lock()
-				defer s.mu.Unlock()
+			s.purgeInactive()
+		}
+	}
+}
 
-				for k, v := range s.processors {
-					lm, err := v.LastModified()
-					if err != nil {
-						s.Logger.Printf("failed to determine LastModified for processor %d: %s", k, err.Error())
-						continue
-					}
+// purgeInactive closes and purges the processors for nodes that are no longer part
+// of the cluster and whose data is older than the max age. If the meta store can't
+// determine whether a node is still part of the cluster, its processor is only purged
+// once its data is older than the max inactive age.
+func (s *Service) purgeInactive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-					active, err := v.Active()
-					if err != nil {
-						s.Logger.Printf("failed to determine if node %d is active: %s", k, err.Error())
-						continue
-					}
-					if active {
-						// Node is active.
-						continue
-					}
+	now := s.Now()
+	for k, v := range s.processors {
+		lm, err := v.LastModified()
+		if err != nil {
+			s.Logger.Printf("failed to determine LastModified for processor %d: %s", k, err.Error())
+			continue
+		}
 
-					if !lm.Before(time.Now().Add(-time.Duration(s.cfg.MaxAge))) {
-						// Node processor contains too-young data.
-						continue
-					}
+		active, err := v.Active()
+		if err != nil {
+			if !lm.Before(now.Add(-time.Duration(s.cfg.MaxInactiveAge))) {
+				s.Logger.Printf("failed to determine if node %d is active: %s", k, err.Error())
+				continue
+			}
+			s.Logger.Printf("failed to determine if node %d is active, purging data unmodified since %s: %s", k, lm, err.Error())
+		} else if active {
+			// Node is active.
+			continue
+		}
 
-					if err := v.Close(); err != nil {
-						s.Logger.Printf("failed to close node processor %d: %s", k, err.Error())
-						continue
-					}
-					if err := v.Purge(); err != nil {
-						s.Logger.Printf("failed to purge node processor %d: %s", k, err.Error())
-						continue
-					}
-					delete(s.processors, k)
-				}
-			}()
+		if !lm.Before(now.Add(-time.Duration(s.cfg.MaxAge))) {
+			// Node processor contains too-young data.
+			continue
+		}
+
+		points, _, err := v.QueueLen()
+		if err != nil {
+			s.Logger.Printf("failed to determine queue length for processor %d: %s", k, err.Error())
+			continue
+		}
+
+		if err := v.Close(); err != nil {
+			s.Logger.Printf("failed to close node processor %d: %s", k, err.Error())
+			continue
+		}
+		if err := v.Purge(); err != nil {
+			s.Logger.Printf("failed to purge node processor %d: %s", k, err.Error())
+			continue
+		}
+		delete(s.processors, k)
+		s.setNodePending(k, false)
+		s.statMap.Add(pointsDropped, points)
+	}
+}
+
+// PurgeNodesFunc closes and purges the processor of every node for which pred returns
+// true, discarding the data queued for the node. It returns the IDs of the purged nodes,
+// in order, even if an error stops it part of the way.
+func (s *Service) PurgeNodesFunc(pred func(nodeID uint64, stats NodeStats) bool) (purged []uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]uint64, 0, len(s.processors))
+	for k := range s.processors {
+		ids = append(ids, k)
+	}
+	sort.Sort(uint64Slice(ids))
+
+	for _, k := range ids {
+		v := s.processors[k]
+		stats, err := v.Stats()
+		if err != nil {
+			return purged, err
+		}
+		if !pred(k, stats) {
+			continue
 		}
+
+		if err := v.Close(); err != nil {
+			return purged, err
+		}
+		if err := v.Purge(); err != nil {
+			return purged, err
+		}
+		delete(s.processors, k)
+		s.setNodePending(k, false)
+		s.statMap.Add(pointsDropped, stats.PendingPoints)
+		purged = append(purged, k)
+	}
+	return purged, nil
+}
+
+// newNodeProcessor returns a NodeProcessor for the given node, configured from the
+// service configuration and any override for the node.
+func (s *Service) newNodeProcessor(nodeID uint64) *NodeProcessor {
+	c := s.configForNode(nodeID)
+
+	n := NewNodeProcessor(nodeID, s.pathforNode(nodeID), s.writerForNode(nodeID), s.metastore)
+	n.PurgeInterval = time.Duration(c.PurgeInterval)
+	n.RetryInterval = time.Duration(c.RetryInterval)
+	n.RetryMaxInterval = time.Duration(c.RetryMaxInterval)
+	n.MaxSize = c.MaxSize
+	n.HighWaterMark = c.HighWaterMark
+	n.MaxBatchSize = c.MaxBatchSize
+	n.MaxAge = time.Duration(c.MaxAge)
+	n.RetryRateLimit = c.RetryRateLimit
+	n.BatchSize = c.BatchSize
+	n.BatchInterval = time.Duration(c.BatchInterval)
+	n.SyncPolicy = c.SyncPolicy
+	n.SyncInterval = time.Duration(c.SyncInterval)
+	n.KeepDrainedFor = time.Duration(c.KeepDrainedFor)
+	n.WriteTimeout = time.Duration(c.WriteTimeout)
+	n.ReadAheadBytes = c.ReadAheadBytes
+	n.serviceStatMap = s.statMap
+	n.store = s.store
+	n.EventLogger = s.EventLogger
+	n.replayed = s.publishReplay
+	n.pendingChanged = func(pending bool) { s.setNodePending(nodeID, pending) }
+
+	if s.replays == nil && s.cfg.MaxConcurrentReplays > 0 {
+		s.replays = make(chan struct{}, s.cfg.MaxConcurrentReplays)
+	}
+	n.replays = s.replays
+	return n
+}
+
+// logEvent logs an event to the EventLogger, or to the Logger if there isn't one.
+func (s *Service) logEvent(level, msg string, kv ...interface{}) {
+	l := s.EventLogger
+	if l == nil {
+		l = NewEventLogger(s.Logger)
 	}
+	l.Logf(level, msg, kv...)
 }
 
 // pathforNode returns the directory for HH data, for the given node.
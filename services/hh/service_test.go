@@ -0,0 +1,1935 @@
+package hh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/meta"
+	"github.com/influxdb/influxdb/models"
+	"github.com/influxdb/influxdb/toml"
+)
+
+// newTestService returns a Service using a temporary directory and the given
+// shard writer, with all nodes active. Background sends are effectively disabled
+// so tests can drive processors directly.
+func newTestService(t *testing.T, sh shardWriter) *Service {
+	dir, err := ioutil.TempDir("", "hh_service_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	c := NewConfig()
+	c.Dir = dir
+	c.RetryInterval = toml.Duration(time.Hour)
+	c.RetryMaxInterval = toml.Duration(time.Hour)
+
+	metastore := &fakeMetaStore{
+		NodeFn: func(nodeID uint64) (*meta.NodeInfo, error) {
+			return &meta.NodeInfo{ID: nodeID}, nil
+		},
+	}
+	return NewService(c, sh, metastore)
+}
+
+// closeTestService closes the service and removes its data.
+func closeTestService(t *testing.T, s *Service) {
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close service: %v", err)
+	}
+	os.RemoveAll(s.cfg.Dir)
+}
+
+func TestServicePointsDeliveredAndDropped(t *testing.T) {
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return nil
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt, pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	n := s.processors[1]
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+
+	// Queue a batch that can't be unmarshaled, so it is discarded.
+	if err := n.queue.Append(append(u64tob(100), []byte("bad\n")...)); err != nil {
+		t.Fatalf("failed to append to queue: %v", err)
+	}
+	if _, err := n.SendWrite(); err == nil {
+		t.Fatalf("SendWrite() expected error for bad batch")
+	}
+
+	if exp, got := "2", s.statMap.Get(pointsDelivered).String(); got != exp {
+		t.Fatalf("points delivered mismatch: got %v, exp %v", got, exp)
+	}
+	if exp, got := "1", s.statMap.Get(pointsDropped).String(); got != exp {
+		t.Fatalf("points dropped mismatch: got %v, exp %v", got, exp)
+	}
+}
+
+func TestServicePurgeInactiveMetaStoreError(t *testing.T) {
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return fmt.Errorf("node unavailable")
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for _, nodeID := range []uint64{1, 2} {
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	// Node 1's queue has not been touched for longer than the max inactive age.
+	old := time.Now().Add(-time.Duration(s.cfg.MaxInactiveAge) - time.Hour)
+	if err := os.Chtimes(filepath.Join(s.cfg.Dir, "1", "1"), old, old); err != nil {
+		t.Fatalf("failed to change segment times: %v", err)
+	}
+
+	s.metastore.(*fakeMetaStore).NodeFn = func(nodeID uint64) (*meta.NodeInfo, error) {
+		return nil, fmt.Errorf("meta store unavailable")
+	}
+	s.purgeInactive()
+
+	if _, ok := s.processors[1]; ok {
+		t.Fatalf("processor for node 1 not purged")
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.Dir, "1")); !os.IsNotExist(err) {
+		t.Fatalf("node 1 directory still present after purge")
+	}
+	if _, ok := s.processors[2]; !ok {
+		t.Fatalf("processor for node 2 purged")
+	}
+}
+
+func TestServicePurgeInactiveMaxAgeBoundary(t *testing.T) {
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return fmt.Errorf("node unavailable")
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	modified := time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(s.cfg.Dir, "1", "1"), modified, modified); err != nil {
+		t.Fatalf("failed to change segment times: %v", err)
+	}
+
+	// The node has been dropped from the cluster.
+	s.metastore.(*fakeMetaStore).NodeFn = func(nodeID uint64) (*meta.NodeInfo, error) {
+		return nil, nil
+	}
+
+	for _, tt := range []struct {
+		now    time.Time
+		purged bool
+	}{
+		{now: modified.Add(time.Duration(s.cfg.MaxAge) - time.Second), purged: false},
+		{now: modified.Add(time.Duration(s.cfg.MaxAge)), purged: false},
+		{now: modified.Add(time.Duration(s.cfg.MaxAge) + time.Second), purged: true},
+	} {
+		s.Now = func() time.Time { return tt.now }
+		s.purgeInactive()
+
+		if _, ok := s.processors[1]; ok == tt.purged {
+			t.Fatalf("unexpected purge state at %s: got %v, exp %v", tt.now, !ok, tt.purged)
+		}
+	}
+}
+
+func TestServiceMaxProcessors(t *testing.T) {
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return fmt.Errorf("node unavailable")
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+	s.cfg.MaxProcessors = 2
+
+	s.metastore.(*fakeMetaStore).NodeFn = func(nodeID uint64) (*meta.NodeInfo, error) {
+		if nodeID > 100 {
+			return nil, nil
+		}
+		return &meta.NodeInfo{ID: nodeID}, nil
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+
+	// Unknown nodes are rejected without using up the limit.
+	if err := s.WriteShard(100, 101, []models.Point{pt}); err != meta.ErrNodeNotFound {
+		t.Fatalf("WriteShard() error mismatch: got %v, exp %v", err, meta.ErrNodeNotFound)
+	}
+
+	for _, nodeID := range []uint64{1, 2, 1} {
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed for node %d: %v", nodeID, err)
+		}
+	}
+
+	if err := s.WriteShard(100, 3, []models.Point{pt}); err != ErrTooManyProcessors {
+		t.Fatalf("WriteShard() error mismatch: got %v, exp %v", err, ErrTooManyProcessors)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.Dir, "3")); !os.IsNotExist(err) {
+		t.Fatalf("node 3 directory created")
+	}
+
+	// Existing processors keep accepting writes.
+	if err := s.WriteShard(100, 2, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed for node 2: %v", err)
+	}
+}
+
+func TestServicePeekNode(t *testing.T) {
+	var delivered []models.Point
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			delivered = append(delivered, points...)
+			return nil
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	var exp []models.Point
+	for i := 0; i < 3; i++ {
+		pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": float64(i)}, time.Unix(int64(i), 0))
+		exp = append(exp, pt)
+	}
+	if err := s.WriteShard(100, 1, exp[:2]); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	if err := s.WriteShard(100, 1, exp[2:]); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	if _, err := s.PeekNode(2, 1); err != ErrProcessorNotFound {
+		t.Fatalf("PeekNode() error mismatch: got %v, exp %v", err, ErrProcessorNotFound)
+	}
+
+	// Peeking doesn't consume points, so repeated peeks return the same points.
+	for i := 0; i < 2; i++ {
+		for _, n := range []int{-1, 0, 1, 3, 10} {
+			points, err := s.PeekNode(1, n)
+			if err != nil {
+				t.Fatalf("PeekNode() failed: %v", err)
+			}
+
+			want := exp
+			if n < 0 {
+				want = nil
+			} else if n < len(want) {
+				want = want[:n]
+			}
+			if len(points) != len(want) {
+				t.Fatalf("PeekNode(%d) points mismatch: got %v, exp %v", n, len(points), len(want))
+			}
+			for j := range want {
+				if points[j].String() != want[j].String() {
+					t.Fatalf("PeekNode(%d) point mismatch:\n got %v\n exp %v", n, points[j], want[j])
+				}
+			}
+		}
+	}
+
+	// The peeked points are still delivered.
+	n := s.processors[1]
+	for i := 0; i < 2; i++ {
+		if _, err := n.SendWrite(); err != nil {
+			t.Fatalf("SendWrite() failed: %v", err)
+		}
+	}
+	if len(delivered) != len(exp) {
+		t.Fatalf("delivered points mismatch: got %v, exp %v", len(delivered), len(exp))
+	}
+	for i := range exp {
+		if delivered[i].String() != exp[i].String() {
+			t.Fatalf("delivered point mismatch:\n got %v\n exp %v", delivered[i], exp[i])
+		}
+	}
+}
+
+func TestServiceDeadLetters(t *testing.T) {
+	var delivered []models.Point
+	writeErr := error(permanentError{fmt.Errorf("shard not found")})
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			if writeErr != nil {
+				return writeErr
+			}
+			delivered = append(delivered, points...)
+			return nil
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt, pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	if _, err := s.DeadLettered(2); err != ErrProcessorNotFound {
+		t.Fatalf("DeadLettered() error mismatch: got %v, exp %v", err, ErrProcessorNotFound)
+	}
+
+	// Park the write.
+	n := s.processors[1]
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	if _, err := n.SendWrite(); err != io.EOF {
+		t.Fatalf("SendWrite() error mismatch: got %v, exp %v", err, io.EOF)
+	}
+
+	points, err := s.DeadLettered(1)
+	if err != nil {
+		t.Fatalf("DeadLettered() failed: %v", err)
+	}
+	if len(points) != 2 || points[0].String() != pt.String() {
+		t.Fatalf("DeadLettered() mismatch: got %v, exp %v", points, []models.Point{pt, pt})
+	}
+
+	// Requeue and deliver the write.
+	writeErr = nil
+	if err := s.RequeueDeadLetters(1); err != nil {
+		t.Fatalf("RequeueDeadLetters() failed: %v", err)
+	}
+
+	if points, err := s.DeadLettered(1); err != nil || len(points) != 0 {
+		t.Fatalf("DeadLettered() mismatch after requeue: got %v (%v), exp none", points, err)
+	}
+
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("delivered points mismatch: got %v, exp 2", len(delivered))
+	}
+}
+
+func TestServiceHighWaterMark(t *testing.T) {
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return fmt.Errorf("node unavailable")
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	// Each write takes a length prefix plus the marshaled points.
+	size := int64(8 + len(marshalWrite(100, []models.Point{pt})))
+
+	// Segment footer, plus room for 2 writes below the high-water mark and 2 more
+	// before the queue is full.
+	s.cfg.HighWaterMark = 8 + 2*size
+	s.cfg.MaxSize = 8 + 4*size
+
+	for i, exp := range []error{nil, nil, ErrHighWaterMark, ErrHighWaterMark, ErrQueueFull} {
+		if err := s.WriteShard(100, 1, []models.Point{pt}); err != exp {
+			t.Fatalf("WriteShard() %d error mismatch: got %v, exp %v", i, err, exp)
+		}
+	}
+
+	if points, _, _ := s.processors[1].QueueLen(); points != 4 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 4", points)
+	}
+
+	if e, ok := ErrHighWaterMark.(interface {
+		Queued() bool
+	}); !ok || !e.Queued() {
+		t.Fatalf("ErrHighWaterMark should report the write as queued")
+	}
+}
+
+func TestServiceOpenTwice(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatalf("second Open() failed: %v", err)
+	}
+
+	// A second purge goroutine would never see the service closing, and Close
+	// would block waiting for it.
+	defer os.RemoveAll(s.cfg.Dir)
+	done := make(chan error)
+	go func() {
+		done <- s.Close()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close() failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for Close()")
+	}
+}
+
+func TestServiceMemStore(t *testing.T) {
+	var delivered []models.Point
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			delivered = append(delivered, points...)
+			return nil
+		},
+	}
+
+	store := newMemStore()
+	newService := func() *Service {
+		s := newTestService(t, sh)
+		os.RemoveAll(s.cfg.Dir)
+		s.cfg.Dir = "hh"
+		s.store = store
+		if err := s.Open(); err != nil {
+			t.Fatalf("Open() failed: %v", err)
+		}
+		return s
+	}
+
+	s := newService()
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// The queued write is restored from the store, and then delivered.
+	s = newService()
+	defer s.Close()
+	n, ok := s.processors[1]
+	if !ok {
+		t.Fatalf("processor for node 1 not restored")
+	}
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	if len(delivered) != 1 || delivered[0].String() != pt.String() {
+		t.Fatalf("delivered points mismatch: got %v, exp %v", delivered, []models.Point{pt})
+	}
+
+	// Purging the processor removes its data from the store.
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := n.Purge(); err != nil {
+		t.Fatalf("Purge() failed: %v", err)
+	}
+	files, err := store.ReadDir("hh")
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("node directories mismatch: got %v, exp 0", len(files))
+	}
+}
+
+func TestServicePauseNode(t *testing.T) {
+	var mu sync.Mutex
+	delivered := map[uint64]int{}
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered[nodeID] += len(points)
+			return nil
+		},
+	}
+	deliveredTo := func(nodeID uint64) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return delivered[nodeID]
+	}
+
+	s := newTestService(t, sh)
+	s.cfg.RetryInterval = toml.Duration(10 * time.Millisecond)
+	s.cfg.RetryMaxInterval = toml.Duration(10 * time.Millisecond)
+
+	// Node 1 is inactive until it's paused, so nothing is sent to it before then.
+	var active int32
+	s.metastore.(*fakeMetaStore).NodeFn = func(nodeID uint64) (*meta.NodeInfo, error) {
+		if nodeID == 1 && atomic.LoadInt32(&active) == 0 {
+			return nil, nil
+		}
+		return &meta.NodeInfo{ID: nodeID}, nil
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for _, nodeID := range []uint64{1, 2} {
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	if err := s.PauseNode(3); err != ErrProcessorNotFound {
+		t.Fatalf("PauseNode() error mismatch: got %v, exp %v", err, ErrProcessorNotFound)
+	}
+	if err := s.PauseNode(1); err != nil {
+		t.Fatalf("PauseNode() failed: %v", err)
+	}
+	atomic.StoreInt32(&active, 1)
+
+	waitFor := func(nodeID uint64) {
+		for deadline := time.Now().Add(5 * time.Second); deliveredTo(nodeID) == 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for points to be sent to node %d", nodeID)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Node 2 drains while node 1 is paused.
+	waitFor(2)
+	time.Sleep(50 * time.Millisecond)
+	if got := deliveredTo(1); got != 0 {
+		t.Fatalf("points sent to paused node: got %v, exp 0", got)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatalf("Stats() failed: %v", err)
+	}
+	if exp := (NodeStats{PendingPoints: 1, PendingBytes: int64(len(marshalWrite(100, []models.Point{pt}))), Paused: true}); stats[1] != exp {
+		t.Fatalf("node 1 stats mismatch: got %+v, exp %+v", stats[1], exp)
+	}
+	if exp := (NodeStats{}); stats[2] != exp {
+		t.Fatalf("node 2 stats mismatch: got %+v, exp %+v", stats[2], exp)
+	}
+
+	if err := s.ResumeNode(1); err != nil {
+		t.Fatalf("ResumeNode() failed: %v", err)
+	}
+	waitFor(1)
+}
+
+func TestServiceSetLoggerWhileOpen(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	s.cfg.PurgeInterval = toml.Duration(time.Millisecond)
+
+	// Failing to look up the node makes each purge check log.
+	s.metastore.(*fakeMetaStore).NodeFn = func(nodeID uint64) (*meta.NodeInfo, error) {
+		return nil, fmt.Errorf("meta store unavailable")
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServiceReassignQueue(t *testing.T) {
+	var delivered []models.Point
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			if nodeID != 2 {
+				return fmt.Errorf("write to node %d", nodeID)
+			}
+			delivered = append(delivered, points...)
+			return nil
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for _, nodeID := range []uint64{1, 3} {
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	if err := s.ReassignQueue(2, 4); err != ErrProcessorNotFound {
+		t.Fatalf("ReassignQueue() error mismatch: got %v, exp %v", err, ErrProcessorNotFound)
+	}
+	if err := s.ReassignQueue(1, 3); err != ErrProcessorExists {
+		t.Fatalf("ReassignQueue() error mismatch: got %v, exp %v", err, ErrProcessorExists)
+	}
+	if err := s.ReassignQueue(1, 2); err != nil {
+		t.Fatalf("ReassignQueue() failed: %v", err)
+	}
+
+	if _, ok := s.processors[1]; ok {
+		t.Fatalf("processor for node 1 still exists")
+	}
+	if _, err := os.Stat(s.pathforNode(1)); !os.IsNotExist(err) {
+		t.Fatalf("node 1 directory mismatch: got %v, exp not exist", err)
+	}
+
+	n, ok := s.processors[2]
+	if !ok {
+		t.Fatalf("processor for node 2 not found")
+	}
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	if len(delivered) != 1 || delivered[0].String() != pt.String() {
+		t.Fatalf("delivered points mismatch: got %v, exp %v", delivered, []models.Point{pt})
+	}
+}
+
+func TestServiceLastError(t *testing.T) {
+	writeErr := fmt.Errorf("node unavailable")
+	var fail bool
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			if fail {
+				return writeErr
+			}
+			return nil
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	if err, tm := s.LastError(1); err != nil || !tm.IsZero() {
+		t.Fatalf("LastError() mismatch for unknown node: got %v at %v, exp nil", err, tm)
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	n := s.processors[1]
+
+	fail = true
+	before := time.Now()
+	if _, err := n.SendWrite(); err != writeErr {
+		t.Fatalf("SendWrite() error mismatch: got %v, exp %v", err, writeErr)
+	}
+	err, tm := s.LastError(1)
+	if err != writeErr {
+		t.Fatalf("LastError() mismatch: got %v, exp %v", err, writeErr)
+	}
+	if tm.Before(before) || tm.After(time.Now()) {
+		t.Fatalf("LastError() time mismatch: got %v, exp after %v", tm, before)
+	}
+
+	fail = false
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	if err, tm := s.LastError(1); err != nil || !tm.IsZero() {
+		t.Fatalf("LastError() mismatch after success: got %v at %v, exp nil", err, tm)
+	}
+}
+
+func TestServiceMaxBatchSize(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	s.cfg.MaxBatchSize = int64(len(marshalWrite(100, []models.Point{pt})))
+
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	n := s.processors[1]
+	size := n.queue.Size()
+
+	if err := s.WriteShard(100, 1, []models.Point{pt, pt}); err != ErrBatchTooLarge {
+		t.Fatalf("WriteShard() error mismatch: got %v, exp %v", err, ErrBatchTooLarge)
+	}
+
+	// Nothing from the rejected write is queued.
+	if got := n.queue.Size(); got != size {
+		t.Fatalf("queue size mismatch: got %v, exp %v", got, size)
+	}
+	if points, _, _ := n.QueueLen(); points != 1 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 1", points)
+	}
+}
+
+func TestServiceMaxConcurrentReplays(t *testing.T) {
+	var mu sync.Mutex
+	var sending, maxSending, delivered int
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			mu.Lock()
+			sending++
+			if sending > maxSending {
+				maxSending = sending
+			}
+			mu.Unlock()
+
+			time.Sleep(2 * time.Millisecond)
+
+			mu.Lock()
+			sending--
+			delivered += len(points)
+			mu.Unlock()
+			return nil
+		},
+	}
+
+	s := newTestService(t, sh)
+	s.cfg.MaxConcurrentReplays = 2
+	s.cfg.RetryInterval = toml.Duration(10 * time.Millisecond)
+	s.cfg.RetryMaxInterval = toml.Duration(10 * time.Millisecond)
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer closeTestService(t, s)
+
+	// Back up several nodes at once.
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	const nodes, writes = 5, 5
+	for i := 0; i < writes; i++ {
+		for nodeID := uint64(1); nodeID <= nodes; nodeID++ {
+			if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+				t.Fatalf("WriteShard() failed: %v", err)
+			}
+		}
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		mu.Lock()
+		n := delivered
+		mu.Unlock()
+		if n == nodes*writes {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for points: got %v, exp %v", n, nodes*writes)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxSending > s.cfg.MaxConcurrentReplays {
+		t.Fatalf("concurrent sends mismatch: got %v, exp at most %v", maxSending, s.cfg.MaxConcurrentReplays)
+	}
+}
+
+func TestServiceVerifyNode(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	block := marshalWrite(100, []models.Point{pt})
+	for i := 0; i < 4; i++ {
+		if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	if _, err := s.VerifyNode(2); err != ErrProcessorNotFound {
+		t.Fatalf("VerifyNode() error mismatch: got %v, exp %v", err, ErrProcessorNotFound)
+	}
+
+	report, err := s.VerifyNode(1)
+	if err != nil {
+		t.Fatalf("VerifyNode() failed: %v", err)
+	}
+	if report.Records != 4 || report.Bytes != int64(4*len(block)) || len(report.Corrupt) != 0 {
+		t.Fatalf("VerifyNode() mismatch for intact queue: got %+v", report)
+	}
+
+	// Corrupt the points of the second record, and the length of the fourth.
+	path := s.processors[1].queue.head.path
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	recordSize := int64(8 + len(block))
+	garbage := append(bytes.Repeat([]byte("x"), len(block)-9), '\n')
+	if _, err := f.WriteAt(garbage, recordSize+16); err != nil {
+		t.Fatalf("failed to corrupt segment: %v", err)
+	}
+	if _, err := f.WriteAt(u64tob(1<<32), 3*recordSize); err != nil {
+		t.Fatalf("failed to corrupt segment: %v", err)
+	}
+	f.Close()
+
+	report, err = s.VerifyNode(1)
+	if err != nil {
+		t.Fatalf("VerifyNode() failed: %v", err)
+	}
+	if report.Records != 3 || report.Bytes != int64(3*len(block)) {
+		t.Fatalf("VerifyNode() mismatch: got %v records, %v bytes, exp 3 records, %v bytes", report.Records, report.Bytes, 3*len(block))
+	}
+	if len(report.Corrupt) != 2 {
+		t.Fatalf("VerifyNode() corrupt records mismatch: got %v, exp 2", report.Corrupt)
+	}
+	for i, exp := range []int64{recordSize, 3 * recordSize} {
+		if c := report.Corrupt[i]; c.Segment != path || c.Offset != exp || c.Err == nil {
+			t.Fatalf("VerifyNode() corrupt record %d mismatch: got %+v, exp offset %v in %v", i, c, exp, path)
+		}
+	}
+
+	// The queue is unchanged.
+	if points, _, _ := s.processors[1].QueueLen(); points != 4 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 4", points)
+	}
+}
+
+// fakeEventLogger records the events logged to it.
+type fakeEventLogger struct {
+	mu     sync.Mutex
+	events []fakeEvent
+}
+
+type fakeEvent struct {
+	level, msg string
+	kv         []interface{}
+}
+
+func (l *fakeEventLogger) Logf(level, msg string, kv ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, fakeEvent{level: level, msg: msg, kv: kv})
+}
+
+func TestServiceEventLogger(t *testing.T) {
+	writeErr := fmt.Errorf("node unavailable")
+	var fail bool
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			if fail {
+				return writeErr
+			}
+			return nil
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+	el := &fakeEventLogger{}
+	s.EventLogger = el
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt, pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	n := s.processors[1]
+	size := len(marshalWrite(100, []models.Point{pt, pt}))
+
+	fail = true
+	if _, err := n.SendWrite(); err != writeErr {
+		t.Fatalf("SendWrite() error mismatch: got %v, exp %v", err, writeErr)
+	}
+	fail = false
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+
+	exp := []fakeEvent{
+		{LevelInfo, EventQueueCreated, []interface{}{"node", uint64(1)}},
+		{LevelError, EventDrainFail, []interface{}{"node", uint64(1), "shard", uint64(100), "bytes", size, "error", writeErr}},
+		{LevelDebug, EventDrainSuccess, []interface{}{"node", uint64(1), "shard", uint64(100), "points", 2, "bytes", size}},
+	}
+	if !reflect.DeepEqual(el.events, exp) {
+		t.Fatalf("events mismatch:\n got %v\n exp %v", el.events, exp)
+	}
+}
+
+func TestServiceEstimateDrainTime(t *testing.T) {
+	writeErr := fmt.Errorf("node unavailable")
+	var fail bool
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			if fail {
+				return writeErr
+			}
+			return nil
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	if _, err := s.EstimateDrainTime(1); err != ErrProcessorNotFound {
+		t.Fatalf("EstimateDrainTime() error mismatch: got %v, exp %v", err, ErrProcessorNotFound)
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	n := s.processors[1]
+	_, backlog, _ := n.QueueLen()
+
+	if _, err := s.EstimateDrainTime(1); err != ErrNoThroughput {
+		t.Fatalf("EstimateDrainTime() error mismatch: got %v, exp %v", err, ErrNoThroughput)
+	}
+
+	// Send at the backlog size per second, then at 3 times that. The average moves
+	// part of the way to the new rate.
+	n.recordThroughput(int(backlog), time.Second)
+	if d, err := s.EstimateDrainTime(1); err != nil || d != time.Second {
+		t.Fatalf("EstimateDrainTime() mismatch: got %v, %v, exp %v", d, err, time.Second)
+	}
+	n.recordThroughput(int(3*backlog), time.Second)
+	if d, err := s.EstimateDrainTime(1); err != nil || d >= time.Second || d <= time.Second/3 {
+		t.Fatalf("EstimateDrainTime() mismatch: got %v, %v, exp between %v and %v", d, err, time.Second/3, time.Second)
+	}
+
+	fail = true
+	if _, err := n.SendWrite(); err != writeErr {
+		t.Fatalf("SendWrite() error mismatch: got %v, exp %v", err, writeErr)
+	}
+	if _, err := s.EstimateDrainTime(1); err != ErrNodeFailing {
+		t.Fatalf("EstimateDrainTime() error mismatch: got %v, exp %v", err, ErrNodeFailing)
+	}
+
+	fail = false
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	if d, err := s.EstimateDrainTime(1); err != nil || d != 0 {
+		t.Fatalf("EstimateDrainTime() mismatch for empty queue: got %v, %v, exp 0", d, err)
+	}
+}
+
+func TestServiceProcessorCreateContended(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for i := 0; i < 3; i++ {
+		for _, nodeID := range []uint64{1, 2} {
+			if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+				t.Fatalf("WriteShard() failed: %v", err)
+			}
+		}
+	}
+
+	if exp, got := "2", s.statMap.Get(processorCreateContended).String(); got != exp {
+		t.Fatalf("processor create contended mismatch: got %v, exp %v", got, exp)
+	}
+
+	// Concurrent first writes for a node create its processor, and are counted, once.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.WriteShard(100, 3, []models.Point{pt}); err != nil {
+				t.Errorf("WriteShard() failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if exp, got := "3", s.statMap.Get(processorCreateContended).String(); got != exp {
+		t.Fatalf("processor create contended mismatch: got %v, exp %v", got, exp)
+	}
+}
+
+func TestServicePurgeNodesFunc(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return nil
+		},
+	})
+	defer closeTestService(t, s)
+
+	// Queue data for nodes 1 to 4, then send the data queued for nodes 2 and 4.
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for nodeID := uint64(1); nodeID <= 4; nodeID++ {
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+	for _, nodeID := range []uint64{2, 4} {
+		if _, err := s.processors[nodeID].SendWrite(); err != nil {
+			t.Fatalf("SendWrite() failed: %v", err)
+		}
+	}
+
+	purged, err := s.PurgeNodesFunc(func(nodeID uint64, stats NodeStats) bool {
+		return stats.PendingPoints == 0
+	})
+	if err != nil {
+		t.Fatalf("PurgeNodesFunc() failed: %v", err)
+	}
+	if exp := []uint64{2, 4}; !reflect.DeepEqual(purged, exp) {
+		t.Fatalf("purged nodes mismatch: got %v, exp %v", purged, exp)
+	}
+
+	for nodeID := uint64(1); nodeID <= 4; nodeID++ {
+		_, ok := s.processors[nodeID]
+		_, err := os.Stat(s.pathforNode(nodeID))
+		if exp := nodeID%2 == 1; ok != exp || (err == nil) != exp {
+			t.Fatalf("node %d exists mismatch: got processor %v, dir error %v, exp %v", nodeID, ok, err, exp)
+		}
+	}
+}
+
+func TestServiceValidateOnWrite(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+
+	s.cfg.ValidateOnWrite = true
+	s.metastore.(*fakeMetaStore).ShardOwnerFn = func(shardID uint64) (string, string, *meta.ShardGroupInfo) {
+		if shardID == 100 {
+			return "db0", "rp0", &meta.ShardGroupInfo{ID: 1}
+		}
+		return "", "", nil
+	}
+	s.metastore.(*fakeMetaStore).MeasurementFieldsFn = func(database, name string) (map[string]influxql.DataType, bool) {
+		if database == "db0" && name == "cpu" {
+			return map[string]influxql.DataType{"value": influxql.Float}, true
+		}
+		return nil, false
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	// Shard 200 belongs to a dropped database, so its write is rejected.
+	if err := s.WriteShard(200, 1, []models.Point{pt}); err != ErrShardNotFound {
+		t.Fatalf("WriteShard() error mismatch: got %v, exp %v", err, ErrShardNotFound)
+	}
+
+	// The database has no mem measurement, so a write of only mem points is rejected.
+	mem := models.MustNewPoint("mem", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{mem}); err != ErrPointsInvalid {
+		t.Fatalf("WriteShard() error mismatch: got %v, exp %v", err, ErrPointsInvalid)
+	}
+
+	// Only the valid points of a mixed write are queued. A new field is valid, but a
+	// field whose type doesn't match isn't.
+	mixed := []models.Point{
+		models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 2.0, "idle": 3.0}, time.Unix(1, 0)),
+		models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": "high"}, time.Unix(2, 0)),
+		mem,
+	}
+	if err := s.WriteShard(100, 1, mixed); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	points, err := s.PeekNode(1, 10)
+	if err != nil {
+		t.Fatalf("PeekNode() failed: %v", err)
+	}
+	if exp := []models.Point{pt, mixed[0]}; len(points) != len(exp) ||
+		points[0].String() != exp[0].String() || points[1].String() != exp[1].String() {
+		t.Fatalf("PeekNode() points mismatch: got %v, exp %v", points, exp)
+	}
+	if exp, got := "2", s.statMap.Get(writeShardReqInvalid).String(); got != exp {
+		t.Fatalf("write shard req invalid mismatch: got %v, exp %v", got, exp)
+	}
+	if exp, got := "3", s.statMap.Get(pointsInvalid).String(); got != exp {
+		t.Fatalf("points invalid mismatch: got %v, exp %v", got, exp)
+	}
+}
+
+func TestServiceSnapshot(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	for i, nodeID := range []uint64{1, 1, 2} {
+		pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": float64(i)}, time.Unix(int64(i), 0))
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "hh_snapshot_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := s.Snapshot(dir); err != nil {
+		t.Fatalf("Snapshot() failed: %v", err)
+	}
+	if err := s.Snapshot(dir); err == nil {
+		t.Fatalf("Snapshot() to a non-empty dir succeeded")
+	}
+
+	exp := map[uint64][]models.Point{}
+	for _, nodeID := range []uint64{1, 2} {
+		points, err := s.PeekNode(nodeID, 10)
+		if err != nil {
+			t.Fatalf("PeekNode() failed: %v", err)
+		}
+		exp[nodeID] = points
+	}
+
+	// Writes after the snapshot aren't restored.
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 3.0}, time.Unix(3, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	r := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, r)
+	if err := r.RestoreSnapshot(dir); err != nil {
+		t.Fatalf("RestoreSnapshot() failed: %v", err)
+	}
+	if err := r.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if err := r.RestoreSnapshot(dir); err != ErrServiceOpen {
+		t.Fatalf("RestoreSnapshot() error mismatch: got %v, exp %v", err, ErrServiceOpen)
+	}
+
+	for nodeID, points := range exp {
+		got, err := r.PeekNode(nodeID, 10)
+		if err != nil {
+			t.Fatalf("PeekNode() failed: %v", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(points) {
+			t.Fatalf("points mismatch for node %d: got %v, exp %v", nodeID, got, points)
+		}
+		if n, _, _ := r.processors[nodeID].QueueLen(); n != int64(len(points)) {
+			t.Fatalf("QueueLen() points mismatch for node %d: got %v, exp %v", nodeID, n, len(points))
+		}
+	}
+}
+
+func TestServiceStatsSameDir(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	// A second service for the same dir starts counting from zero, and doesn't count
+	// towards the first.
+	r := NewService(s.cfg, s.shardWriter, s.metastore)
+	if err := r.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+	if r.statMap.Get(writeShardReq) != nil {
+		t.Fatalf("write shard req mismatch: got %v, exp none", r.statMap.Get(writeShardReq))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := r.WriteShard(100, 2, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+	if got := r.statMap.Get(writeShardReq).String(); got != "2" {
+		t.Fatalf("write shard req mismatch: got %v, exp 2", got)
+	}
+	if got := s.statMap.Get(writeShardReq).String(); got != "1" {
+		t.Fatalf("first service write shard req mismatch: got %v, exp 1", got)
+	}
+}
+
+func TestServiceSetWriterForNode(t *testing.T) {
+	var mu sync.Mutex
+	delivered := map[string][]uint64{}
+	writer := func(name string) *fakeShardWriter {
+		return &fakeShardWriter{
+			ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+				mu.Lock()
+				defer mu.Unlock()
+				delivered[name] = append(delivered[name], nodeID)
+				return nil
+			},
+		}
+	}
+
+	s := newTestService(t, writer("default"))
+	defer closeTestService(t, s)
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for _, nodeID := range []uint64{1, 2} {
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	// Override the writer of an existing processor, and of one created later.
+	s.SetWriterForNode(1, writer("override"))
+	s.SetWriterForNode(3, writer("override"))
+	if err := s.WriteShard(100, 3, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	for _, nodeID := range []uint64{1, 2, 3} {
+		if _, err := s.processors[nodeID].SendWrite(); err != nil {
+			t.Fatalf("SendWrite() failed: %v", err)
+		}
+	}
+
+	// Removing the override restores the default writer.
+	s.SetWriterForNode(1, nil)
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	if _, err := s.processors[1].SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+
+	exp := map[string][]uint64{"default": {2, 1}, "override": {1, 3}}
+	if !reflect.DeepEqual(delivered, exp) {
+		t.Fatalf("delivered mismatch: got %v, exp %v", delivered, exp)
+	}
+}
+
+func TestServiceMaxPointAge(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+
+	now := time.Unix(100000, 0)
+	s.Now = func() time.Time { return now }
+	s.cfg.MaxPointAge = toml.Duration(time.Hour)
+	l := &fakeEventLogger{}
+	s.EventLogger = l
+
+	fresh := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, now.Add(-time.Minute))
+	stale := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 2.0}, now.Add(-2*time.Hour))
+	if err := s.WriteShard(100, 1, []models.Point{stale, fresh, stale}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	// A write with only stale points queues nothing.
+	if err := s.WriteShard(100, 2, []models.Point{stale}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	if _, ok := s.processors[2]; ok {
+		t.Fatalf("processor created for node 2")
+	}
+
+	points, err := s.PeekNode(1, 10)
+	if err != nil {
+		t.Fatalf("PeekNode() failed: %v", err)
+	}
+	if len(points) != 1 || points[0].String() != fresh.String() {
+		t.Fatalf("points mismatch: got %v, exp %v", points, fresh)
+	}
+
+	if got := s.statMap.Get(pointsStale).String(); got != "3" {
+		t.Fatalf("points stale mismatch: got %v, exp 3", got)
+	}
+	if got := s.statMap.Get(pointsDropped).String(); got != "3" {
+		t.Fatalf("points dropped mismatch: got %v, exp 3", got)
+	}
+
+	var stales int
+	for _, e := range l.events {
+		if e.msg == EventPointsStale {
+			stales++
+		}
+	}
+	if stales != 2 {
+		t.Fatalf("stale events mismatch: got %v, exp 2", stales)
+	}
+}
+
+func TestServiceWriteShardWithHint(t *testing.T) {
+	writeErr := fmt.Errorf("node unavailable")
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return writeErr
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+	el := &fakeEventLogger{}
+	s.EventLogger = el
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for _, w := range []struct {
+		hint   string
+		points []models.Point
+	}{
+		{"node unreachable", []models.Point{pt, pt}},
+		{"shard not ready", []models.Point{pt}},
+		{"node unreachable", []models.Point{pt}},
+		{"", []models.Point{pt}},
+	} {
+		if err := s.WriteShardWithHint(100, 1, w.points, w.hint); err != nil {
+			t.Fatalf("WriteShardWithHint() failed: %v", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		hint           string
+		writes, points string
+	}{
+		{"node unreachable", "2", "3"},
+		{"shard not ready", "1", "1"},
+	} {
+		m := s.hintStatMap(tt.hint)
+		if got := m.Get(writeShardReq).String(); got != tt.writes {
+			t.Fatalf("write shard req mismatch for %q: got %v, exp %v", tt.hint, got, tt.writes)
+		}
+		if got := m.Get(writeShardReqPoints).String(); got != tt.points {
+			t.Fatalf("write shard req points mismatch for %q: got %v, exp %v", tt.hint, got, tt.points)
+		}
+	}
+	if got := s.statMap.Get(writeShardReq).String(); got != "4" {
+		t.Fatalf("write shard req mismatch: got %v, exp 4", got)
+	}
+
+	// Hints past the limit are counted together.
+	for i := len(s.hintStats); i < maxHintStats+5; i++ {
+		s.hintStatMap(fmt.Sprintf("hint %d", i))
+	}
+	if exp := maxHintStats + 1; len(s.hintStats) != exp {
+		t.Fatalf("hint stats count mismatch: got %v, exp %v", len(s.hintStats), exp)
+	}
+	if s.hintStatMap("another hint") != s.hintStats[otherHint] {
+		t.Fatalf("hint past the limit not counted under %q", otherHint)
+	}
+	if s.hintStatMap("node unreachable") == s.hintStats[otherHint] {
+		t.Fatalf("hint within the limit counted under %q", otherHint)
+	}
+
+	// The hint is kept with the queued data, which still counts and parses as before.
+	n := s.processors[1]
+	if points, _, _ := n.QueueLen(); points != 5 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 5", points)
+	}
+	points, err := n.Peek(10)
+	if err != nil {
+		t.Fatalf("Peek() failed: %v", err)
+	}
+	if len(points) != 5 {
+		t.Fatalf("Peek() points mismatch: got %v, exp 5", len(points))
+	}
+
+	// Events about the queued data report the hint.
+	if _, err := n.SendWrite(); err != writeErr {
+		t.Fatalf("SendWrite() error mismatch: got %v, exp %v", err, writeErr)
+	}
+	size := len(marshalHintedWrite(100, "node unreachable", []models.Point{pt, pt}))
+	exp := fakeEvent{LevelError, EventDrainFail, []interface{}{"node", uint64(1), "shard", uint64(100), "bytes", size, "error", writeErr, "hint", "node unreachable"}}
+	if got := el.events[len(el.events)-1]; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("event mismatch:\n got %v\n exp %v", got, exp)
+	}
+}
+
+func TestServiceCompact(t *testing.T) {
+	var delivered []models.Point
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			delivered = append(delivered, points...)
+			return nil
+		},
+	}
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+
+	if err := s.Compact(1); err != ErrProcessorNotFound {
+		t.Fatalf("Compact() error mismatch: got %v, exp %v", err, ErrProcessorNotFound)
+	}
+
+	var exp []models.Point
+	write := func(i int) {
+		pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": float64(i)}, time.Unix(int64(i+1), 0))
+		if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+		exp = append(exp, pt)
+	}
+
+	// Fragment the queue by keeping segments small, and then draining part of it.
+	write(0)
+	n := s.processors[1]
+	if err := n.queue.SetMaxSegmentSize(int64(len(marshalWrite(100, exp)) + 16)); err != nil {
+		t.Fatalf("SetMaxSegmentSize() failed: %v", err)
+	}
+	for i := 1; i < 6; i++ {
+		write(i)
+	}
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	exp, delivered = exp[1:], nil
+
+	fragmented := len(n.queue.segments)
+	if fragmented < 2 {
+		t.Fatalf("segments mismatch: got %v, exp fragmented queue", fragmented)
+	}
+	if err := n.queue.SetMaxSegmentSize(defaultSegmentSize); err != nil {
+		t.Fatalf("SetMaxSegmentSize() failed: %v", err)
+	}
+	if err := s.Compact(1); err != nil {
+		t.Fatalf("Compact() failed: %v", err)
+	}
+	if got := len(n.queue.segments); got >= fragmented || got != 1 {
+		t.Fatalf("segments mismatch: got %v, exp 1 (from %v)", got, fragmented)
+	}
+
+	// The compacted segment is full enough, so compacting again leaves it as it is.
+	path := n.queue.segments[0].path
+	if err := s.Compact(1); err != nil {
+		t.Fatalf("Compact() failed: %v", err)
+	}
+	if got := n.queue.segments[0].path; got != path {
+		t.Fatalf("segment rewritten: got %v, exp %v", got, path)
+	}
+	if files, err := ioutil.ReadDir(n.dir); err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	} else if segments := len(files) - 1; segments != 1 {
+		t.Fatalf("segment files mismatch: got %v, exp 1", segments)
+	}
+
+	// The pending points are unchanged, and are sent in order.
+	if points, _, _ := n.QueueLen(); points != int64(len(exp)) {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp %v", points, len(exp))
+	}
+	for {
+		if _, err := n.SendWrite(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("SendWrite() failed: %v", err)
+		}
+	}
+	if fmt.Sprint(delivered) != fmt.Sprint(exp) {
+		t.Fatalf("delivered mismatch: got %v, exp %v", delivered, exp)
+	}
+}
+
+func TestServiceSubscribe(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return nil
+		},
+	})
+	defer closeTestService(t, s)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt, pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	if err := s.WriteShard(200, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	n := s.processors[1]
+
+	c := s.Subscribe()
+	idle := s.Subscribe() // Never read, so it can't hold up sending.
+	defer s.Unsubscribe(idle)
+
+	for i := 0; i < replayEventBuffer+2; i++ {
+		if i > 1 {
+			if err := n.WriteShard(200, []models.Point{pt}); err != nil {
+				t.Fatalf("WriteShard() failed: %v", err)
+			}
+		}
+		if _, err := n.SendWrite(); err != nil {
+			t.Fatalf("SendWrite() failed: %v", err)
+		}
+	}
+
+	size := int64(len(marshalWrite(200, []models.Point{pt})))
+	for i, exp := range []ReplayEvent{
+		{NodeID: 1, ShardID: 100, Points: 2, RemainingBytes: size},
+		{NodeID: 1, ShardID: 200, Points: 1, RemainingBytes: 0},
+	} {
+		if got := <-c; got != exp {
+			t.Fatalf("event %d mismatch: got %+v, exp %+v", i, got, exp)
+		}
+	}
+
+	// Once unsubscribed, the channel is closed without further events.
+	s.Unsubscribe(c)
+	if err := n.WriteShard(200, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	if _, err := n.SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	var events int
+	for range c {
+		events++
+	}
+	if exp := replayEventBuffer - 2; events != exp {
+		t.Fatalf("remaining events mismatch: got %v, exp %v", events, exp)
+	}
+}
+
+func TestServiceDirPerm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh_service_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewConfig()
+	c.Dir = filepath.Join(dir, "hh")
+	c.DirPerm = 0750
+	s := NewService(c, &fakeShardWriter{}, &fakeMetaStore{})
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer s.Close()
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err := s.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{c.Dir, os.ModeDir | 0750},
+		{s.pathforNode(1), os.ModeDir | 0750},
+		{filepath.Join(s.pathforNode(1), "1"), 0640},
+	} {
+		fi, err := os.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("Stat() failed: %v", err)
+		}
+		if fi.Mode() != tt.mode {
+			t.Fatalf("mode mismatch for %s: got %v, exp %v", tt.path, fi.Mode(), tt.mode)
+		}
+	}
+}
+
+func TestServicePendingShards(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return nil
+		},
+	})
+	defer closeTestService(t, s)
+
+	if _, err := s.PendingShards(1); err != ErrProcessorNotFound {
+		t.Fatalf("PendingShards() error mismatch: got %v, exp %v", err, ErrProcessorNotFound)
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for _, shardID := range []uint64{200, 100, 200} {
+		if err := s.WriteShard(shardID, 1, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+
+	check := func(exp []uint64) {
+		got, err := s.PendingShards(1)
+		if err != nil {
+			t.Fatalf("PendingShards() failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("pending shards mismatch: got %v, exp %v", got, exp)
+		}
+	}
+	check([]uint64{100, 200})
+
+	// Shards are counted again when the queue is reopened.
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	check([]uint64{100, 200})
+
+	// A shard is pending until all of its writes are sent.
+	n := s.processors[1]
+	for _, exp := range [][]uint64{{100, 200}, {200}, {}} {
+		if _, err := n.SendWrite(); err != nil {
+			t.Fatalf("SendWrite() failed: %v", err)
+		}
+		check(exp)
+	}
+}
+
+func TestServiceDrained(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			return nil
+		},
+	})
+	defer closeTestService(t, s)
+
+	isClosed := func(c <-chan struct{}) bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if !isClosed(s.Drained()) {
+		t.Fatalf("Drained() not closed without queued data")
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for _, nodeID := range []uint64{1, 1, 2} {
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+	drained := s.Drained()
+
+	// Only sending the last batch for the last node closes the channel.
+	for _, nodeID := range []uint64{1, 2, 1} {
+		if isClosed(drained) {
+			t.Fatalf("Drained() closed before node %d was sent its data", nodeID)
+		}
+		if _, err := s.processors[nodeID].SendWrite(); err != nil {
+			t.Fatalf("SendWrite() failed: %v", err)
+		}
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("Drained() not closed once all data was sent")
+	}
+
+	// New writes re-arm it.
+	if err := s.WriteShard(100, 2, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+	if isClosed(s.Drained()) {
+		t.Fatalf("Drained() closed with queued data")
+	}
+	if _, err := s.processors[2].SendWrite(); err != nil {
+		t.Fatalf("SendWrite() failed: %v", err)
+	}
+	if !isClosed(s.Drained()) {
+		t.Fatalf("Drained() not closed once all data was sent")
+	}
+}
+
+func TestServiceSetNodeConfig(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	size := int64(len(marshalWrite(100, []models.Point{pt})))
+
+	// Override node 1, which has a processor, and node 3, which doesn't yet.
+	for _, nodeID := range []uint64{1, 2} {
+		if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+			t.Fatalf("WriteShard() failed: %v", err)
+		}
+	}
+	// Reopening node 1's processor keeps its state.
+	writeErr := fmt.Errorf("node unavailable")
+	s.processors[1].Pause()
+	s.processors[1].setLastError(writeErr)
+
+	// An overridden queue holds a single write.
+	override := NodeConfig{MaxSize: 8 + size, RetryRateLimit: 100}
+	for _, nodeID := range []uint64{1, 3} {
+		if err := s.SetNodeConfig(nodeID, override); err != nil {
+			t.Fatalf("SetNodeConfig() failed: %v", err)
+		}
+	}
+	if !s.processors[1].Paused() {
+		t.Fatalf("processor not paused after SetNodeConfig()")
+	}
+	if err, _ := s.processors[1].LastError(); err != writeErr {
+		t.Fatalf("LastError() mismatch: got %v, exp %v", err, writeErr)
+	}
+	if err := s.SetNodeConfig(4, NodeConfig{HighWaterMark: s.cfg.MaxSize + 1}); err == nil {
+		t.Fatalf("SetNodeConfig() with an invalid override succeeded")
+	}
+
+	check := func(s *Service) {
+		for _, nodeID := range []uint64{1, 2, 3} {
+			// Fill the queue, if it isn't already full.
+			s.WriteShard(100, nodeID, []models.Point{pt})
+
+			err := s.WriteShard(100, nodeID, []models.Point{pt})
+			if nodeID == 2 && err != nil {
+				t.Fatalf("WriteShard() to node %d failed: %v", nodeID, err)
+			} else if nodeID != 2 && err != ErrQueueFull {
+				t.Fatalf("WriteShard() error mismatch for node %d: got %v, exp %v", nodeID, err, ErrQueueFull)
+			}
+		}
+		if exp := int64(100); s.processors[1].RetryRateLimit != exp {
+			t.Fatalf("RetryRateLimit mismatch: got %v, exp %v", s.processors[1].RetryRateLimit, exp)
+		}
+		if exp := int64(DefaultRetryRateLimit); s.processors[2].RetryRateLimit != exp {
+			t.Fatalf("RetryRateLimit mismatch: got %v, exp %v", s.processors[2].RetryRateLimit, exp)
+		}
+	}
+	check(s)
+
+	// The overrides apply after a restart.
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	r := NewService(s.cfg, &fakeShardWriter{}, s.metastore)
+	if err := r.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+	check(r)
+
+	// Removing an override restores the service configuration.
+	if err := r.SetNodeConfig(1, NodeConfig{}); err != nil {
+		t.Fatalf("SetNodeConfig() failed: %v", err)
+	}
+	if err := r.WriteShard(100, 1, []models.Point{pt}); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+}
+
+func TestServiceWriteShardAsync(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer closeTestService(t, s)
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	errC := make(chan error, 10)
+	for i := 0; i < cap(errC); i++ {
+		pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": float64(i)}, time.Unix(int64(i), 0))
+		s.WriteShardAsync(100, 1, []models.Point{pt}, func(err error) { errC <- err })
+	}
+
+	for i := 0; i < cap(errC); i++ {
+		select {
+		case err := <-errC:
+			if err != nil {
+				t.Fatalf("WriteShardAsync() failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for WriteShardAsync() to finish")
+		}
+	}
+
+	if n, _, err := s.processors[1].QueueLen(); err != nil {
+		t.Fatalf("QueueLen() failed: %v", err)
+	} else if exp := int64(cap(errC)); n != exp {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp %v", n, exp)
+	}
+	if exp := 0; len(s.asyncWrites) != exp {
+		t.Fatalf("async writes in flight mismatch: got %v, exp %v", len(s.asyncWrites), exp)
+	}
+}
+
+func TestServiceWriteShardAsyncClose(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	defer os.RemoveAll(s.cfg.Dir)
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	check := func(exp error) {
+		errC := make(chan error, 1)
+		s.WriteShardAsync(100, 1, []models.Point{pt}, func(err error) { errC <- err })
+		select {
+		case err := <-errC:
+			if err != exp {
+				t.Fatalf("WriteShardAsync() error mismatch: got %v, exp %v", err, exp)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for WriteShardAsync() to finish")
+		}
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	check(nil)
+
+	// Writes racing Close are either finished before it returns, or rejected.
+	var accepted, rejected int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.WriteShardAsync(100, 1, []models.Point{pt}, func(err error) {
+				if err == ErrServiceClosed {
+					atomic.AddInt32(&rejected, 1)
+				} else if err != nil {
+					t.Errorf("WriteShardAsync() failed: %v", err)
+				} else {
+					atomic.AddInt32(&accepted, 1)
+				}
+			})
+		}()
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	closedAccepted := atomic.LoadInt32(&accepted)
+	wg.Wait()
+	if got := atomic.LoadInt32(&accepted); got != closedAccepted {
+		t.Fatalf("writes accepted after Close() returned: got %d, exp %d", got, closedAccepted)
+	}
+	if got := atomic.LoadInt32(&accepted) + atomic.LoadInt32(&rejected); got != 50 {
+		t.Fatalf("finished writes mismatch: got %d, exp 50", got)
+	}
+	check(ErrServiceClosed)
+
+	// The accepted writes are in the queue.
+	r := NewService(s.cfg, &fakeShardWriter{}, s.metastore)
+	if err := r.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+	if n, _, err := r.processors[1].QueueLen(); err != nil {
+		t.Fatalf("QueueLen() failed: %v", err)
+	} else if exp := int64(closedAccepted) + 1; n != exp {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp %v", n, exp)
+	}
+}
+
+func TestServiceWriteShardAsyncBuffered(t *testing.T) {
+	s := newTestService(t, &fakeShardWriter{})
+	s.cfg.BatchSize, s.cfg.BatchInterval = 100, toml.Duration(time.Hour)
+	defer os.RemoveAll(s.cfg.Dir)
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	// A buffered write is acknowledged before it is in the queue.
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	errC := make(chan error, 1)
+	s.WriteShardAsync(100, 1, []models.Point{pt}, func(err error) { errC <- err })
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Fatalf("WriteShardAsync() failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for WriteShardAsync() to finish")
+	}
+	if n, _, err := s.processors[1].QueueLen(); err != nil {
+		t.Fatalf("QueueLen() failed: %v", err)
+	} else if n != 0 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 0", n)
+	}
+
+	// Close flushes it to the queue.
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	r := NewService(s.cfg, &fakeShardWriter{}, s.metastore)
+	if err := r.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+	if n, _, err := r.processors[1].QueueLen(); err != nil {
+		t.Fatalf("QueueLen() failed: %v", err)
+	} else if n != 1 {
+		t.Fatalf("QueueLen() points mismatch: got %v, exp 1", n)
+	}
+}
+
+func TestServiceForceReplayAll(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[uint64]int{}
+	sh := &fakeShardWriter{
+		ShardWriteFn: func(shardID, nodeID uint64, points []models.Point) error {
+			mu.Lock()
+			defer mu.Unlock()
+			sent[nodeID]++
+			if nodeID == 3 {
+				return fmt.Errorf("node unavailable")
+			}
+			return nil
+		},
+	}
+
+	s := newTestService(t, sh)
+	defer closeTestService(t, s)
+	s.cfg.MaxConcurrentReplays = 2
+	if err := s.Open(); err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	pt := models.MustNewPoint("cpu", models.Tags{"foo": "bar"}, models.Fields{"value": 1.0}, time.Unix(0, 0))
+	for _, nodeID := range []uint64{1, 2, 3} {
+		for i := 0; i < 3; i++ {
+			if err := s.WriteShard(100, nodeID, []models.Point{pt}); err != nil {
+				t.Fatalf("WriteShard() failed: %v", err)
+			}
+		}
+	}
+	if err := s.PauseNode(2); err != nil {
+		t.Fatalf("PauseNode() failed: %v", err)
+	}
+
+	err := s.ForceReplayAll()
+	rerr, ok := err.(ReplayError)
+	if !ok {
+		t.Fatalf("ForceReplayAll() error mismatch: got %v, exp a ReplayError", err)
+	} else if len(rerr) != 1 || rerr[3] == nil {
+		t.Fatalf("ForceReplayAll() node errors mismatch: got %v, exp an error for node 3", rerr)
+	}
+
+	// Node 1 is drained, paused node 2 is left alone, and node 3 stops at its first failure.
+	exp := map[uint64]int{1: 3, 3: 1}
+	if !reflect.DeepEqual(sent, exp) {
+		t.Fatalf("sent writes mismatch: got %v, exp %v", sent, exp)
+	}
+	for nodeID, exp := range map[uint64]int64{1: 0, 2: 3, 3: 3} {
+		if n, _, err := s.processors[nodeID].QueueLen(); err != nil {
+			t.Fatalf("QueueLen() failed: %v", err)
+		} else if n != exp {
+			t.Fatalf("QueueLen() points mismatch for node %d: got %v, exp %v", nodeID, n, exp)
+		}
+	}
+
+	if err := s.ResumeNode(2); err != nil {
+		t.Fatalf("ResumeNode() failed: %v", err)
+	}
+	sh.ShardWriteFn = func(shardID, nodeID uint64, points []models.Point) error { return nil }
+	if err := s.ForceReplayAll(); err != nil {
+		t.Fatalf("ForceReplayAll() failed: %v", err)
+	}
+	select {
+	case <-s.Drained():
+	default:
+		t.Fatalf("queues not drained after ForceReplayAll()")
+	}
+}
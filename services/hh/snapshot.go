@@ -0,0 +1,146 @@
+package hh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// manifestFile is the name of the file describing a snapshot.  It is written once every
+// node's data has been copied, so a snapshot without one is incomplete.
+const manifestFile = "manifest.json"
+
+// snapshotManifest describes the hinted handoff data copied by Service.Snapshot.  Each
+// node's data is in a directory of the snapshot named after the node's ID.
+type snapshotManifest struct {
+	Created time.Time      `json:"created"`
+	Nodes   []snapshotNode `json:"nodes"`
+}
+
+// snapshotNode describes the data of a node in a snapshot.
+type snapshotNode struct {
+	ID            uint64 `json:"id"`
+	PendingPoints int64  `json:"pendingPoints"` // Points waiting to be sent to the node.
+	PendingBytes  int64  `json:"pendingBytes"`  // Bytes waiting to be sent to the node.
+}
+
+// Snapshot copies the hinted handoff data of every node to destDir, which must be empty
+// or not exist, along with a manifest describing it.  Writes for a node wait only while
+// its segments are opened.  The snapshot can be loaded into a closed service with RestoreSnapshot.
+func (s *Service) Snapshot(destDir string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.opened {
+		return ErrServiceClosed
+	}
+
+	if err := s.store.MkdirAll(destDir); err != nil {
+		return fmt.Errorf("mkdir all: %s", err)
+	}
+	if files, err := s.store.ReadDir(destDir); err != nil {
+		return err
+	} else if len(files) > 0 {
+		return fmt.Errorf("snapshot dir not empty: %s", destDir)
+	}
+
+	ids := make([]uint64, 0, len(s.processors))
+	for k := range s.processors {
+		ids = append(ids, k)
+	}
+	sort.Sort(uint64Slice(ids))
+
+	m := snapshotManifest{Created: time.Now().UTC(), Nodes: []snapshotNode{}}
+	for _, k := range ids {
+		points, bytes, err := s.processors[k].Snapshot(filepath.Join(destDir, strconv.FormatUint(k, 10)))
+		if err != nil {
+			return fmt.Errorf("snapshot node %d: %s", k, err)
+		}
+		m.Nodes = append(m.Nodes, snapshotNode{ID: k, PendingPoints: points, PendingBytes: bytes})
+	}
+
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+
+	f, err := s.store.OpenFile(filepath.Join(destDir, manifestFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// RestoreSnapshot loads a snapshot taken by Snapshot from srcDir, replacing any data
+// already held for the nodes in the snapshot.  The service must be closed, and the data
+// is loaded when it is opened.
+func (s *Service) RestoreSnapshot(srcDir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.opened {
+		return ErrServiceOpen
+	}
+
+	m, err := s.readSnapshotManifest(srcDir)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.MkdirAll(s.cfg.Dir); err != nil {
+		return fmt.Errorf("mkdir all: %s", err)
+	}
+	for _, n := range m.Nodes {
+		if err := s.store.RemoveAll(s.pathforNode(n.ID)); err != nil {
+			return err
+		}
+		if err := copyDir(s.store, filepath.Join(srcDir, strconv.FormatUint(n.ID, 10)), s.pathforNode(n.ID)); err != nil {
+			return fmt.Errorf("restore node %d: %s", n.ID, err)
+		}
+	}
+	return nil
+}
+
+// readSnapshotManifest reads the manifest of the snapshot in dir.
+func (s *Service) readSnapshotManifest(dir string) (*snapshotManifest, error) {
+	// Check the manifest exists first, since opening a file of the store creates it.
+	files, err := s.store.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var found bool
+	for _, fi := range files {
+		if fi.Name() == manifestFile && !fi.IsDir() {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("snapshot manifest not found in %s", dir)
+	}
+
+	f, err := s.store.OpenFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &snapshotManifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("snapshot manifest: %s", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,129 @@
+package hh
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// queueStore is the storage used for hinted handoff data.  Node processors keep their
+// queues in directories of the store, and queues keep each segment in a file of their
+// directory.
+type queueStore interface {
+	// MkdirAll creates a directory, along with any parents, if it doesn't exist.
+	MkdirAll(dir string) error
+
+	// ReadDir returns the entries of a directory, sorted by name.
+	ReadDir(dir string) ([]os.FileInfo, error)
+
+	// OpenFile opens a file for reading and writing, creating it if it doesn't exist.
+	OpenFile(path string) (segmentFile, error)
+
+	// Remove removes a file or empty directory.
+	Remove(path string) error
+
+	// RemoveAll removes a path and anything it contains.
+	RemoveAll(path string) error
+
+	// Rename moves a file or directory, along with anything it contains.
+	Rename(oldpath, newpath string) error
+}
+
+// segmentFile is an open file holding a queue segment.
+type segmentFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// defaultPerm is the permission of directories created by a fileStore without one.
+const defaultPerm os.FileMode = 0700
+
+// fileStore is a queueStore on the local filesystem.  Directories are created with perm,
+// and files with perm less its execute bits, subject to the umask.
+type fileStore struct {
+	perm os.FileMode
+}
+
+func (s fileStore) dirPerm() os.FileMode {
+	if s.perm == 0 {
+		return defaultPerm
+	}
+	return s.perm
+}
+
+func (s fileStore) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, s.dirPerm())
+}
+
+func (fileStore) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+func (s fileStore) OpenFile(path string) (segmentFile, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, s.dirPerm()&^0111)
+}
+
+func (fileStore) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (fileStore) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (fileStore) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// copyFile copies the file at src to dst in store, replacing anything dst held.
+func copyFile(store queueStore, src, dst string) error {
+	in, err := store.OpenFile(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := store.OpenFile(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := out.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// copyDir copies the directory src to dst in store, along with anything it contains.
+func copyDir(store queueStore, src, dst string) error {
+	if err := store.MkdirAll(dst); err != nil {
+		return err
+	}
+
+	files, err := store.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		from, to := filepath.Join(src, fi.Name()), filepath.Join(dst, fi.Name())
+		if fi.IsDir() {
+			err = copyDir(store, from, to)
+		} else {
+			err = copyFile(store, from, to)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
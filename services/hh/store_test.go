@@ -0,0 +1,285 @@
+package hh
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore is a queueStore held in memory, so tests don't need a disk.
+type memStore struct {
+	mu    sync.Mutex
+	dirs  map[string]time.Time
+	files map[string]*memFileData
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		dirs:  map[string]time.Time{},
+		files: map[string]*memFileData{},
+	}
+}
+
+func (s *memStore) MkdirAll(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if _, ok := s.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+		if _, ok := s.dirs[dir]; !ok {
+			s.dirs[dir] = time.Now()
+		}
+		if dir == filepath.Dir(dir) {
+			return nil
+		}
+	}
+}
+
+func (s *memStore) ReadDir(dir string) ([]os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if _, ok := s.dirs[dir]; !ok {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+
+	var infos memFileInfos
+	for path, modTime := range s.dirs {
+		if path != dir && filepath.Dir(path) == dir {
+			infos = append(infos, &memFileInfo{name: filepath.Base(path), modTime: modTime, dir: true})
+		}
+	}
+	for path, data := range s.files {
+		if filepath.Dir(path) == dir {
+			infos = append(infos, data.stat(path))
+		}
+	}
+	sort.Sort(infos)
+
+	a := make([]os.FileInfo, len(infos))
+	for i := range infos {
+		a[i] = infos[i]
+	}
+	return a, nil
+}
+
+func (s *memStore) OpenFile(path string) (segmentFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := s.dirs[path]; ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+	} else if _, ok := s.dirs[filepath.Dir(path)]; !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
+	data, ok := s.files[path]
+	if !ok {
+		data = &memFileData{modTime: time.Now()}
+		s.files[path] = data
+	}
+	return &memFile{name: path, data: data}, nil
+}
+
+func (s *memStore) Remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := s.files[path]; ok {
+		delete(s.files, path)
+		return nil
+	}
+	if _, ok := s.dirs[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	for p := range s.files {
+		if filepath.Dir(p) == path {
+			return &os.PathError{Op: "remove", Path: path, Err: os.ErrExist}
+		}
+	}
+	for p := range s.dirs {
+		if p != path && filepath.Dir(p) == path {
+			return &os.PathError{Op: "remove", Path: path, Err: os.ErrExist}
+		}
+	}
+	delete(s.dirs, path)
+	return nil
+}
+
+func (s *memStore) RemoveAll(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for p := range s.files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(s.files, p)
+		}
+	}
+	for p := range s.dirs {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(s.dirs, p)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Rename(oldpath, newpath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if _, ok := s.dirs[filepath.Dir(newpath)]; !ok {
+		return &os.PathError{Op: "rename", Path: newpath, Err: os.ErrNotExist}
+	}
+	// Like os.Rename, a file replaces an existing file.
+	if _, ok := s.files[newpath]; ok {
+		if _, ok := s.files[oldpath]; !ok {
+			return &os.PathError{Op: "rename", Path: newpath, Err: os.ErrExist}
+		}
+	} else if _, ok := s.dirs[newpath]; ok {
+		return &os.PathError{Op: "rename", Path: newpath, Err: os.ErrExist}
+	}
+
+	if data, ok := s.files[oldpath]; ok {
+		delete(s.files, oldpath)
+		s.files[newpath] = data
+		return nil
+	}
+	if _, ok := s.dirs[oldpath]; !ok {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+
+	prefix := oldpath + string(filepath.Separator)
+	for p, data := range s.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(s.files, p)
+			s.files[newpath+p[len(oldpath):]] = data
+		}
+	}
+	for p, modTime := range s.dirs {
+		if p == oldpath || strings.HasPrefix(p, prefix) {
+			delete(s.dirs, p)
+			s.dirs[newpath+p[len(oldpath):]] = modTime
+		}
+	}
+	return nil
+}
+
+// memFileData is the contents of a file in a memStore.
+type memFileData struct {
+	mu      sync.Mutex
+	b       []byte
+	modTime time.Time
+}
+
+func (d *memFileData) stat(path string) *memFileInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return &memFileInfo{name: filepath.Base(path), size: int64(len(d.b)), modTime: d.modTime}
+}
+
+// memFile is an open file of a memStore.
+type memFile struct {
+	name string
+	data *memFileData
+	pos  int64
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if f.pos >= int64(len(f.data.b)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data.b[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if end := f.pos + int64(len(b)); end > int64(len(f.data.b)) {
+		f.data.b = append(f.data.b, make([]byte, end-int64(len(f.data.b)))...)
+	}
+	copy(f.data.b[f.pos:], b)
+	f.pos += int64(len(b))
+	f.data.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	switch whence {
+	case os.SEEK_CUR:
+		offset += f.pos
+	case os.SEEK_END:
+		offset += int64(len(f.data.b))
+	}
+	if offset < 0 {
+		return f.pos, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if size < int64(len(f.data.b)) {
+		f.data.b = f.data.b[:size]
+	} else {
+		f.data.b = append(f.data.b, make([]byte, size-int64(len(f.data.b)))...)
+	}
+	f.data.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) { return f.data.stat(f.name), nil }
+func (f *memFile) Sync() error                { return nil }
+func (f *memFile) Close() error               { return nil }
+
+// memFileInfo describes a file or directory of a memStore.
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+type memFileInfos []*memFileInfo
+
+func (a memFileInfos) Len() int           { return len(a) }
+func (a memFileInfos) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a memFileInfos) Less(i, j int) bool { return a[i].name < a[j].name }
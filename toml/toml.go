@@ -2,6 +2,7 @@ package toml
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"time"
 )
@@ -70,3 +71,34 @@ func (s *Size) UnmarshalText(text []byte) error {
 	*s = Size(size)
 	return nil
 }
+
+// FileMode is a TOML wrapper type for the permission bits of an os.FileMode.  Users
+// specify it as an octal string, such as "0750".
+type FileMode os.FileMode
+
+func (m FileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+// UnmarshalText parses octal permission bits from text.
+func (m *FileMode) UnmarshalText(text []byte) error {
+	// Ignore if there is no value set.
+	if len(text) == 0 {
+		return nil
+	}
+
+	mode, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil {
+		return err
+	} else if os.FileMode(mode)&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid file mode: %s", text)
+	}
+
+	*m = FileMode(mode)
+	return nil
+}
+
+// MarshalText converts a file mode to an octal string for decoding toml
+func (m FileMode) MarshalText() (text []byte, err error) {
+	return []byte(m.String()), nil
+}
@@ -31,6 +31,20 @@ func TestSize_UnmarshalText_GB(t *testing.T) {
 	}
 }
 
+// Ensure that octal file modes can be parsed.
+func TestFileMode_UnmarshalText(t *testing.T) {
+	var m itoml.FileMode
+	if err := m.UnmarshalText([]byte("0750")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if m != 0750 {
+		t.Fatalf("unexpected file mode: %s", m)
+	}
+
+	if err := m.UnmarshalText([]byte("01777")); err == nil {
+		t.Fatal("expected error for mode outside the permission bits")
+	}
+}
+
 func TestConfig_Encode(t *testing.T) {
 	var c run.Config
 	c.Cluster.WriteTimeout = itoml.Duration(time.Minute)
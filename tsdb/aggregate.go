@@ -12,10 +12,29 @@ import (
 	"github.com/influxdb/influxdb/pkg/slices"
 )
 
+// QueryError is returned when executing a valid query fails.
+type QueryError struct {
+	Message string
+	Timeout bool // Whether the query was aborted for running past its deadline.
+}
+
+func (e *QueryError) Error() string { return e.Message }
+
+// newQueryTimeout returns the error of a query aborted for running past its deadline.
+func newQueryTimeout() *QueryError {
+	return &QueryError{Message: "query timeout", Timeout: true}
+}
+
+// expired returns true if deadline is set and has passed.
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
 // AggregateExecutor represents a mapper for execute aggregate SELECT statements.
 type AggregateExecutor struct {
-	stmt    *influxql.SelectStatement
-	mappers []*StatefulMapper
+	stmt     *influxql.SelectStatement
+	mappers  []*StatefulMapper
+	deadline time.Time // when execution is aborted, if not zero
 }
 
 // NewAggregateExecutor returns a new AggregateExecutor.
@@ -32,6 +51,25 @@ func NewAggregateExecutor(stmt *influxql.SelectStatement, mappers []Mapper) *Agg
 	return e
 }
 
+// SetDeadline sets the time after which execution is aborted with a timeout QueryError.
+// The deadline is also set on mappers supporting one, which check it as they read each
+// point, and it is checked as each interval is reduced.
+func (e *AggregateExecutor) SetDeadline(t time.Time) {
+	e.deadline = t
+	for _, m := range e.mappers {
+		if m, ok := m.Mapper.(interface {
+			SetDeadline(time.Time)
+		}); ok {
+			m.SetDeadline(t)
+		}
+	}
+}
+
+// expired returns true if execution has run past the deadline.
+func (e *AggregateExecutor) expired() bool {
+	return expired(e.deadline)
+}
+
 // close closes the executor such that all resources are released.
 // Once closed, an executor may not be re-used.
 func (e *AggregateExecutor) close() {
@@ -137,11 +175,20 @@ func (e *AggregateExecutor) execute(out chan *models.Row) {
 
 		values := make([][]interface{}, len(tMins))
 		for i, t := range tMins {
+			if e.expired() {
+				out <- &models.Row{Err: newQueryTimeout()}
+				return
+			}
+
 			values[i] = make([]interface{}, 0, len(columnNames))
 			values[i] = append(values[i], time.Unix(0, t).UTC()) // Time value is always first.
 
 			for j, f := range reduceFuncs {
 				reducedVal := f(buckets[t][j])
+				if a, ok := reducedVal.(columnValues); ok {
+					values[i] = append(values[i], a...)
+					continue
+				}
 				values[i] = append(values[i], reducedVal)
 			}
 		}
@@ -161,6 +208,9 @@ func (e *AggregateExecutor) execute(out chan *models.Row) {
 		// process derivatives
 		values = e.processDerivative(values)
 
+		// Compute the differences between intervals of bucket_delta().
+		values = e.processBucketDelta(values)
+
 		// If we have multiple tag sets we'll want to filter out the empty ones
 		if hasMultipleTagSets && resultsEmpty(values) {
 			continue
@@ -276,6 +326,9 @@ func (e *AggregateExecutor) readNextTagset() ([]*MapperOutput, error) {
 
 		for {
 			if m.bufferedChunk == nil {
+				if e.expired() {
+					return nil, newQueryTimeout()
+				}
 				chunk, err := m.NextChunk()
 				if err != nil {
 					return nil, err
@@ -365,6 +418,57 @@ func (e *AggregateExecutor) processDerivative(results [][]interface{}) [][]inter
 	return results
 }
 
+// processBucketDelta returns the differences between the values of consecutive intervals
+// of a bucket_delta() call, the only field of the statement, at the time of the later
+// interval.  The earliest interval has no previous interval, so it is dropped.
+func (e *AggregateExecutor) processBucketDelta(results [][]interface{}) [][]interface{} {
+	calls := e.stmt.FunctionCalls()
+	if len(calls) != 1 || calls[0].Name != "bucket_delta" || len(results) == 0 {
+		return results
+	}
+	ascending := e.ascending()
+
+	value := func(row []interface{}) interface{} {
+		// Selectors, like max(), output the point they select.
+		if p, ok := row[1].(PositionPoint); ok {
+			return p.Value
+		}
+		return row[1]
+	}
+
+	deltas := make([][]interface{}, 0, len(results)-1)
+	for i := range results {
+		// Results are in time order, so the previous interval is before or after each one.
+		var prev []interface{}
+		if ascending && i > 0 {
+			prev = results[i-1]
+		} else if !ascending && i < len(results)-1 {
+			prev = results[i+1]
+		} else {
+			continue
+		}
+		cur := results[i]
+
+		var delta interface{}
+		switch v := value(cur).(type) {
+		case int64:
+			if p, ok := value(prev).(int64); ok {
+				delta = v - p
+			} else if p, ok := value(prev).(float64); ok {
+				delta = float64(v) - p
+			}
+		case float64:
+			if p, ok := value(prev).(float64); ok {
+				delta = v - p
+			} else if p, ok := value(prev).(int64); ok {
+				delta = v - float64(p)
+			}
+		}
+		deltas = append(deltas, []interface{}{cur[0], delta})
+	}
+	return deltas
+}
+
 func (e *AggregateExecutor) processFunctions(results [][]interface{}, columnNames []string) ([][]interface{}, error) {
 	callInPosition := e.stmt.FunctionCallsByPosition()
 	hasTimeField := e.stmt.HasTimeFieldSpecified()
@@ -390,6 +494,19 @@ func (e *AggregateExecutor) processFunctions(results [][]interface{}, columnName
 				if err != nil {
 					return results, err
 				}
+			case "ewma", "zscore", "post_gap_first", "moving_min", "moving_max", "normalize":
+				results = e.processPoints(results)
+			case "state_duration":
+				results = e.processStateDurations(results)
+			case "min_points":
+				// Selectors nested in min_points(), like max(), output the point they select.
+				switch c.Args[0].(*influxql.Call).Name {
+				case "first", "last", "min", "max":
+					results, err = e.processSelectors(results, i, hasTimeField, columnNames)
+					if err != nil {
+						return results, err
+					}
+				}
 			}
 		}
 	}
@@ -397,6 +514,42 @@ func (e *AggregateExecutor) processFunctions(results [][]interface{}, columnName
 	return results, nil
 }
 
+// processPoints flattens the values of a call that outputs a value for each point, such as
+// ewma(), into a row for each point.  The call is the only field of the statement.
+func (e *AggregateExecutor) processPoints(results [][]interface{}) [][]interface{} {
+	ascending := e.ascending()
+
+	var values [][]interface{}
+	for _, vals := range results {
+		points, _ := vals[len(vals)-1].(PositionPoints)
+		for i := range points {
+			p := points[i]
+			if !ascending {
+				p = points[len(points)-1-i]
+			}
+			values = append(values, []interface{}{time.Unix(0, p.Time).UTC(), p.Value})
+		}
+	}
+	return values
+}
+
+// processStateDurations expands the values of state_duration() into a row for each state
+// of each interval.  The call is the only field of the statement.
+func (e *AggregateExecutor) processStateDurations(results [][]interface{}) [][]interface{} {
+	var values [][]interface{}
+	for _, vals := range results {
+		states, ok := vals[len(vals)-1].(stateDurations)
+		if !ok {
+			values = append(values, vals)
+			continue
+		}
+		for _, s := range states {
+			values = append(values, append([]interface{}{vals[0]}, s...))
+		}
+	}
+	return values
+}
+
 func (e *AggregateExecutor) processSelectors(results [][]interface{}, callPosition int, hasTimeField bool, columnNames []string) ([][]interface{}, error) {
 	// if the columns doesn't have enough columns, expand it
 	for i, columns := range results {
@@ -512,10 +665,16 @@ type AggregateMapper struct {
 	interval     int   // Current interval for which data is being fetched.
 	intervalN    int   // Maximum number of intervals to return.
 	intervalSize int64 // Size of each interval.
+	intervalStep int64 // Time between the starts of intervals, less than the size if they overlap.
 	qminWindow   int64 // Minimum time of the query floored to start of interval.
 
 	mapFuncs   []mapFunc // The mapping functions.
-	fieldNames []string  // the field name being read for mapping.
+	fieldNames []string  // the field name being read for mapping, or "" for any field.
+	numeric    []bool    // whether each mapping function reads only numeric values.
+
+	tap func(call *influxql.Call, key string, item MapItem) // called with each value mapped, if set.
+
+	deadline time.Time // when reading points is aborted, if not zero
 
 	selectFields []string
 	selectTags   []string
@@ -530,6 +689,18 @@ func NewAggregateMapper(sh *Shard, stmt *influxql.SelectStatement) *AggregateMap
 	}
 }
 
+// SetTap sets a function called with each value read for each aggregate, and the key of
+// its tag set, so the values feeding an aggregate can be inspected when debugging.
+func (m *AggregateMapper) SetTap(fn func(call *influxql.Call, key string, item MapItem)) {
+	m.tap = fn
+}
+
+// SetDeadline sets the time after which reading points is aborted with a timeout
+// QueryError.
+func (m *AggregateMapper) SetDeadline(t time.Time) {
+	m.deadline = t
+}
+
 // Open opens and initializes the mapper.
 func (m *AggregateMapper) Open() error {
 	// Ignore if node has the shard but hasn't written to it yet.
@@ -557,14 +728,21 @@ func (m *AggregateMapper) Open() error {
 		return err
 	}
 
+	step, err := m.stmt.GroupByStep()
+	if err != nil {
+		return err
+	}
+
 	m.intervalSize = d.Nanoseconds()
+	m.intervalStep = step.Nanoseconds()
 	if m.qmin == 0 || m.intervalSize == 0 {
 		m.intervalN = 1
 		m.intervalSize = m.qmax - m.qmin
+		m.intervalStep = m.intervalSize
 	} else {
-		intervalTop := m.qmax/m.intervalSize*m.intervalSize + m.intervalSize
-		intervalBottom := m.qmin / m.intervalSize * m.intervalSize
-		m.intervalN = int((intervalTop - intervalBottom) / m.intervalSize)
+		intervalTop := m.qmax/m.intervalStep*m.intervalStep + m.intervalStep
+		intervalBottom := m.qmin / m.intervalStep * m.intervalStep
+		m.intervalN = int((intervalTop - intervalBottom) / m.intervalStep)
 	}
 
 	if m.stmt.Limit > 0 || m.stmt.Offset > 0 {
@@ -588,7 +766,7 @@ func (m *AggregateMapper) Open() error {
 	// Ensure that the start time for the results is on the start of the window.
 	m.qminWindow = m.qmin
 	if m.intervalSize > 0 && m.intervalN > 1 {
-		m.qminWindow = m.qminWindow / m.intervalSize * m.intervalSize
+		m.qminWindow = m.qminWindow / m.intervalStep * m.intervalStep
 	}
 
 	// Get a read-only transaction.
@@ -636,6 +814,15 @@ func (m *AggregateMapper) openMeasurement(mm *Measurement) error {
 	}
 	tagSets = m.stmt.LimitTagSets(tagSets)
 
+	// Calls without a field read all of the measurement's fields.
+	fields := slices.Union(selectFields, m.fieldNames, false)
+	for i, name := range fields {
+		if name == "" {
+			fields = slices.Union(append(fields[:i], fields[i+1:]...), mm.FieldNames(), false)
+			break
+		}
+	}
+
 	// Create all cursors for reading the data from this shard.
 	for _, t := range tagSets {
 		cursorSet := CursorSet{
@@ -649,7 +836,6 @@ func (m *AggregateMapper) openMeasurement(mm *Measurement) error {
 		}
 
 		for i, key := range t.SeriesKeys {
-			fields := slices.Union(selectFields, m.fieldNames, false)
 			c := m.tx.Cursor(key, fields, m.shard.FieldCodec(mm.Name), true)
 			if c == nil {
 				continue
@@ -674,6 +860,7 @@ func (m *AggregateMapper) initializeMapFunctions() error {
 	aggregates := m.stmt.FunctionCalls()
 	m.mapFuncs = make([]mapFunc, len(aggregates))
 	m.fieldNames = make([]string, len(m.mapFuncs))
+	m.numeric = make([]bool, len(m.mapFuncs))
 
 	for i, c := range aggregates {
 		mfn, err := initializeMapFunc(c)
@@ -682,11 +869,17 @@ func (m *AggregateMapper) initializeMapFunctions() error {
 		}
 		m.mapFuncs[i] = mfn
 
+		// Calls without a field, like min_timestamp(), read all of them.
+		if len(c.Args) == 0 {
+			continue
+		}
+
 		// Check for calls like `derivative(lmean(value), 1d)`
 		var nested *influxql.Call = c
 		if fn, ok := c.Args[0].(*influxql.Call); ok {
 			nested = fn
 		}
+		m.numeric[i] = IsNumeric(nested)
 		switch lit := nested.Args[0].(type) {
 		case *influxql.VarRef:
 			m.fieldNames[i] = lit.Val
@@ -695,6 +888,13 @@ func (m *AggregateMapper) initializeMapFunctions() error {
 				return fmt.Errorf("aggregate call didn't contain a field %s", c.String())
 			}
 			m.fieldNames[i] = lit.Val
+		case *influxql.BinaryExpr:
+			// Conditions, such as count(value > 100), compare the field on the left.
+			ref, ok := lit.LHS.(*influxql.VarRef)
+			if !ok {
+				return fmt.Errorf("aggregate call didn't contain a field %s", c.String())
+			}
+			m.fieldNames[i] = ref.Val
 		default:
 			return fmt.Errorf("aggregate call didn't contain a field %s", c.String())
 		}
@@ -758,6 +958,11 @@ func (m *AggregateMapper) NextChunk() (interface{}, error) {
 		qmax = m.qmax + 1
 	}
 
+	var calls []*influxql.Call
+	if m.tap != nil {
+		calls = m.stmt.FunctionCalls()
+	}
+
 	for _, c := range cursorSet.Cursors {
 		mapperValue := &MapperValue{
 			Time:  tmin,
@@ -766,9 +971,27 @@ func (m *AggregateMapper) NextChunk() (interface{}, error) {
 
 		for i := range m.mapFuncs {
 			// Build a map input from the cursor.
+			items, nulls, err := readMapItems(c, m.fieldNames[i], qmin, qmin, qmax, m.deadline)
+			if err != nil {
+				return nil, err
+			}
 			input := &MapInput{
 				TMin:  -1,
-				Items: readMapItems(c, m.fieldNames[i], qmin, qmin, qmax),
+				TMax:  qmax,
+				Items: items,
+				Nulls: nulls,
+			}
+
+			// Count the data aggregates silently skip or convert.
+			m.shard.statMap.Add(statAggregateNullsSkipped, int64(nulls))
+			if m.numeric[i] {
+				m.shard.statMap.Add(statAggregateCoercions, countLossyIntegers(items))
+			}
+
+			if m.tap != nil {
+				for _, item := range items {
+					m.tap(calls[i], cursorSet.Key, item)
+				}
 			}
 			if len(m.stmt.Dimensions) > 0 && !m.stmt.HasTimeFieldSpecified() {
 				input.TMin = tmin
@@ -787,10 +1010,16 @@ func (m *AggregateMapper) NextChunk() (interface{}, error) {
 	return output, nil
 }
 
-func readMapItems(c *TagsCursor, field string, seek, tmin, tmax int64) []MapItem {
-	var items []MapItem
+// readMapItems reads the values of the field from the cursor, and returns the number of
+// points skipped for not holding the field.  A timeout QueryError is returned if the
+// deadline, when not zero, passes before reading is complete.
+func readMapItems(c *TagsCursor, field string, seek, tmin, tmax int64, deadline time.Time) (items []MapItem, nulls int, err error) {
 	var seeked bool
 	for {
+		if expired(deadline) {
+			return nil, 0, newQueryTimeout()
+		}
+
 		var timestamp int64
 		var value interface{}
 		if !seeked {
@@ -802,7 +1031,7 @@ func readMapItems(c *TagsCursor, field string, seek, tmin, tmax int64) []MapItem
 
 		// We're done if the point is outside the query's time range [tmin:tmax).
 		if timestamp != tmin && (timestamp < tmin || timestamp >= tmax) {
-			return items
+			return items, nulls, nil
 		}
 
 		// Convert values to fields map.
@@ -811,8 +1040,9 @@ func readMapItems(c *TagsCursor, field string, seek, tmin, tmax int64) []MapItem
 			fields = map[string]interface{}{"": value}
 		}
 
-		// Value didn't match, look for the next one.
+		// The point holds none of the fields read, look for the next one.
 		if value == nil {
+			nulls++
 			continue
 		}
 
@@ -831,10 +1061,11 @@ func readMapItems(c *TagsCursor, field string, seek, tmin, tmax int64) []MapItem
 		}
 
 		// Filter out single field, if specified.
-		if m, ok := value.(map[string]interface{}); ok {
+		if m, ok := value.(map[string]interface{}); ok && field != "" {
 			value = m[field]
 		}
 		if value == nil {
+			nulls++
 			continue
 		}
 
@@ -847,10 +1078,25 @@ func readMapItems(c *TagsCursor, field string, seek, tmin, tmax int64) []MapItem
 	}
 }
 
+// maxExactInteger is the largest magnitude of integers that convert exactly to floats.
+const maxExactInteger = 1 << 53
+
+// countLossyIntegers returns the number of integer values too large to convert exactly to
+// floats, as numeric aggregates do.
+func countLossyIntegers(items []MapItem) int64 {
+	var n int64
+	for _, item := range items {
+		if v, ok := item.Value.(int64); ok && (v > maxExactInteger || v < -maxExactInteger) {
+			n++
+		}
+	}
+	return n
+}
+
 // nextInterval returns the next interval for which to return data.
 // If start is less than 0 there are no more intervals.
 func (m *AggregateMapper) nextInterval() (start, end int64) {
-	t := m.qminWindow + int64(m.interval+m.stmt.Offset)*m.intervalSize
+	t := m.qminWindow + int64(m.interval+m.stmt.Offset)*m.intervalStep
 
 	// On to next interval.
 	m.interval++
@@ -0,0 +1,440 @@
+package tsdb
+
+import (
+	"expvar"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/models"
+)
+
+// Ensure the executor splits the values of a call with several columns into columns.
+func TestAggregateExecutor_Columns(t *testing.T) {
+	stmt := mustParseSelectStatement(`SELECT mean(value, true) FROM cpu`)
+	e := NewAggregateExecutor(stmt, []Mapper{
+		newTestAggregateMapper(&meanMapOutput{Count: 2, Total: 6}),
+		newTestAggregateMapper(&meanMapOutput{Count: 1, Total: 3}),
+	})
+
+	rows := readRows(e.Execute())
+	exp := []*models.Row{{
+		Name:    "cpu",
+		Columns: []string{"time", "mean", "count"},
+		Values:  [][]interface{}{{time.Unix(0, 0).UTC(), 3.0, int64(3)}},
+	}}
+	if !reflect.DeepEqual(rows, exp) {
+		t.Fatalf("rows mismatch:\n got %v\n exp %v", rows, exp)
+	}
+}
+
+// Ensure the executor outputs a row for each point of a call that outputs a value for each
+// point.
+func TestAggregateExecutor_Points(t *testing.T) {
+	for _, test := range []struct {
+		order string
+		exp   [][]interface{}
+	}{
+		{order: "ASC", exp: [][]interface{}{{time.Unix(0, 1).UTC(), 10.0}, {time.Unix(0, 2).UTC(), 20.0}}},
+		{order: "DESC", exp: [][]interface{}{{time.Unix(0, 2).UTC(), 20.0}, {time.Unix(0, 1).UTC(), 10.0}}},
+	} {
+		stmt := mustParseSelectStatement(`SELECT ewma(value, 0.5) FROM cpu ORDER BY time ` + test.order)
+		e := NewAggregateExecutor(stmt, []Mapper{
+			newTestAggregateMapper(MapRawQuery(&MapInput{Items: []MapItem{{Timestamp: 1, Value: 10.0}, {Timestamp: 2, Value: 30.0}}})),
+		})
+
+		rows := readRows(e.Execute())
+		exp := []*models.Row{{
+			Name:    "cpu",
+			Columns: []string{"time", "ewma"},
+			Values:  test.exp,
+		}}
+		if !reflect.DeepEqual(rows, exp) {
+			t.Fatalf("%s: rows mismatch:\n got %v\n exp %v", test.order, rows, exp)
+		}
+	}
+}
+
+// Ensure the executor outputs a row for each state of state_duration().
+func TestAggregateExecutor_StateDuration(t *testing.T) {
+	stmt := mustParseSelectStatement(`SELECT state_duration(up) FROM cpu`)
+	e := NewAggregateExecutor(stmt, []Mapper{
+		newTestAggregateMapper(MapStateDuration(&MapInput{
+			TMax:  10,
+			Items: []MapItem{{Timestamp: 0, Value: true}, {Timestamp: 3, Value: false}, {Timestamp: 7, Value: true}},
+		})),
+	})
+
+	rows := readRows(e.Execute())
+	exp := []*models.Row{{
+		Name:    "cpu",
+		Columns: []string{"time", "state", "duration"},
+		Values: [][]interface{}{
+			{time.Unix(0, 0).UTC(), true, int64(6)},
+			{time.Unix(0, 0).UTC(), false, int64(4)},
+		},
+	}}
+	if !reflect.DeepEqual(rows, exp) {
+		t.Fatalf("rows mismatch:\n got %v\n exp %v", rows, exp)
+	}
+}
+
+// Ensure the executor outputs the differences between the values of consecutive intervals
+// for bucket_delta().
+func TestAggregateExecutor_BucketDelta(t *testing.T) {
+	minute := int64(time.Minute)
+	for _, test := range []struct {
+		order string
+		exp   [][]interface{}
+	}{
+		{
+			order: "ASC",
+			exp: [][]interface{}{
+				{time.Unix(0, minute).UTC(), 2.0},
+				{time.Unix(0, 2*minute).UTC(), nil},
+				{time.Unix(0, 3*minute).UTC(), nil},
+				{time.Unix(0, 4*minute).UTC(), -5.0},
+			},
+		},
+		{
+			order: "DESC",
+			exp: [][]interface{}{
+				{time.Unix(0, 4*minute).UTC(), -5.0},
+				{time.Unix(0, 3*minute).UTC(), nil},
+				{time.Unix(0, 2*minute).UTC(), nil},
+				{time.Unix(0, minute).UTC(), 2.0},
+			},
+		},
+	} {
+		stmt := mustParseSelectStatement(`SELECT bucket_delta(max(value)) FROM cpu WHERE time >= '1970-01-01T00:00:00Z' AND time < '1970-01-01T00:05:00Z' GROUP BY time(1m) ORDER BY time ` + test.order)
+		mapMax := func(t int64, v float64) []interface{} {
+			return []interface{}{MapMax(&MapInput{Items: []MapItem{{Timestamp: t, Value: v}}}, "value")}
+		}
+		m := &testAggregateMapper{chunks: []*MapperOutput{{
+			Name: "cpu",
+			Values: []*MapperValue{
+				{Time: 0, Value: mapMax(0, 1)},
+				{Time: minute, Value: mapMax(minute, 3)},
+				{Time: 2 * minute, Value: []interface{}{nil}},
+				{Time: 3 * minute, Value: mapMax(3*minute, 9)},
+				{Time: 4 * minute, Value: mapMax(4*minute, 4)},
+			},
+			cursorKey: "cpu",
+		}}}
+
+		rows := readRows(NewAggregateExecutor(stmt, []Mapper{m}).Execute())
+		exp := []*models.Row{{
+			Name:    "cpu",
+			Columns: []string{"time", "bucket_delta"},
+			Values:  test.exp,
+		}}
+		if !reflect.DeepEqual(rows, exp) {
+			t.Fatalf("%s: rows mismatch:\n got %v\n exp %v", test.order, rows, exp)
+		}
+	}
+}
+
+// Ensure GROUP BY time with a step reads overlapping intervals, so a point counts in each
+// interval holding it.
+func TestAggregateMapper_OverlappingIntervals(t *testing.T) {
+	stmt := mustParseSelectStatement(`SELECT mean(value) FROM cpu WHERE time >= '1970-01-01T00:01:00Z' AND time < '1970-01-01T00:15:00Z' GROUP BY time(10m, 1m)`)
+	m := &AggregateMapper{stmt: stmt}
+	m.qmin, m.qmax = influxql.TimeRangeAsEpochNano(stmt.Condition)
+
+	d, _ := stmt.GroupByInterval()
+	step, err := stmt.GroupByStep()
+	if err != nil {
+		t.Fatal(err)
+	} else if step != time.Minute {
+		t.Fatalf("step mismatch: got %s, exp %s", step, time.Minute)
+	}
+	m.intervalSize, m.intervalStep = d.Nanoseconds(), step.Nanoseconds()
+	m.intervalN = int((m.qmax/m.intervalStep*m.intervalStep + m.intervalStep - m.qmin/m.intervalStep*m.intervalStep) / m.intervalStep)
+	m.qminWindow = m.qmin / m.intervalStep * m.intervalStep
+
+	// Find the intervals holding a point at 9m30s.
+	p := int64(9*time.Minute + 30*time.Second)
+	var starts []time.Duration
+	for {
+		tmin, tmax := m.nextInterval()
+		if tmin < 0 {
+			break
+		}
+		if tmax-tmin != int64(10*time.Minute) {
+			t.Fatalf("interval size mismatch: got %s", time.Duration(tmax-tmin))
+		}
+		if p >= tmin && p < tmax {
+			starts = append(starts, time.Duration(tmin))
+		}
+	}
+
+	var exp []time.Duration
+	for i := 1; i <= 9; i++ {
+		exp = append(exp, time.Duration(i)*time.Minute)
+	}
+	if !reflect.DeepEqual(starts, exp) {
+		t.Fatalf("intervals mismatch: got %v, exp %v", starts, exp)
+	}
+}
+
+// Ensure an aggregate query reading a never ending stream of chunks is aborted at its
+// deadline.
+func TestAggregateExecutor_Deadline(t *testing.T) {
+	stmt := mustParseSelectStatement(`SELECT count(value) FROM cpu`)
+	e := NewAggregateExecutor(stmt, []Mapper{&slowAggregateMapper{}})
+	e.SetDeadline(time.Now().Add(50 * time.Millisecond))
+
+	start := time.Now()
+	if row := <-e.Execute(); !isQueryTimeout(row.Err) {
+		t.Fatalf("unexpected row: %v", row)
+	} else if d := time.Since(start); d > time.Second {
+		t.Fatalf("aborted too late: %s", d)
+	}
+}
+
+// Ensure a mapper reading a slow stream of points is aborted at its deadline part of the
+// way through a chunk.
+func TestAggregateMapper_Deadline(t *testing.T) {
+	// Reading every point would take 10s.
+	c := &slowCursor{}
+	for i := 0; i < 10000; i++ {
+		c.keys = append(c.keys, int64(i))
+		c.values = append(c.values, float64(i))
+	}
+
+	m := &AggregateMapper{
+		shard: &Shard{statMap: new(expvar.Map).Init()},
+		stmt:  mustParseSelectStatement(`SELECT count(value) FROM cpu`),
+		cursors: []CursorSet{{
+			Measurement: "cpu",
+			Key:         "cpu",
+			Cursors:     []*TagsCursor{NewTagsCursor(c, nil, nil)},
+		}},
+		qmax:         int64(len(c.keys)),
+		intervalN:    1,
+		intervalSize: int64(len(c.keys)) + 1,
+		intervalStep: int64(len(c.keys)) + 1,
+	}
+	if err := m.initializeMapFunctions(); err != nil {
+		t.Fatal(err)
+	}
+	m.SetDeadline(time.Now().Add(50 * time.Millisecond))
+
+	start := time.Now()
+	if _, err := m.NextChunk(); !isQueryTimeout(err) {
+		t.Fatalf("error mismatch: got %v, exp a query timeout", err)
+	} else if d := time.Since(start); d > time.Second {
+		t.Fatalf("aborted too late: %s", d)
+	}
+	if c.i == len(c.keys) {
+		t.Fatalf("every point read before aborting")
+	}
+}
+
+// isQueryTimeout returns true if err is the QueryError of a query running past its
+// deadline.
+func isQueryTimeout(err error) bool {
+	e, ok := err.(*QueryError)
+	return ok && e.Timeout
+}
+
+// slowCursor is a testCursor taking a millisecond to read each point after the first.
+type slowCursor struct {
+	testCursor
+}
+
+func (c *slowCursor) Next() (int64, interface{}) {
+	time.Sleep(time.Millisecond)
+	return c.testCursor.Next()
+}
+
+// slowAggregateMapper is a mapper slowly returning chunks of a single tag set forever.
+type slowAggregateMapper struct {
+	testAggregateMapper
+}
+
+func (m *slowAggregateMapper) NextChunk() (interface{}, error) {
+	time.Sleep(time.Millisecond)
+	return &MapperOutput{
+		Name:      "cpu",
+		Values:    []*MapperValue{{Time: 0, Value: []interface{}{MapCount(&MapInput{})}}},
+		cursorKey: "cpu",
+	}, nil
+}
+
+// Ensure the tap of a mapper sees each value read for each aggregate once.
+func TestAggregateMapper_Tap(t *testing.T) {
+	m := &AggregateMapper{
+		shard: &Shard{statMap: new(expvar.Map).Init()},
+		stmt:  mustParseSelectStatement(`SELECT count(value), max(value) FROM cpu`),
+		cursors: []CursorSet{{
+			Measurement: "cpu",
+			Key:         "cpu|host|serverA",
+			Cursors: []*TagsCursor{
+				NewTagsCursor(&testCursor{keys: []int64{1, 2}, values: []interface{}{10.0, 20.0}}, nil, nil),
+			},
+		}},
+		qmax:         10,
+		intervalN:    1,
+		intervalSize: 10,
+		intervalStep: 10,
+	}
+	if err := m.initializeMapFunctions(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	m.SetTap(func(call *influxql.Call, key string, item MapItem) {
+		got = append(got, fmt.Sprintf("%s %s %d=%v", call.Name, key, item.Timestamp, item.Value))
+	})
+	if _, err := m.NextChunk(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{
+		"count cpu|host|serverA 1=10",
+		"count cpu|host|serverA 2=20",
+		"max cpu|host|serverA 1=10",
+		"max cpu|host|serverA 2=20",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("tapped values mismatch:\n got %v\n exp %v", got, exp)
+	}
+}
+
+// Ensure reading map items counts the points lacking the field, but not the points the
+// condition filters out.
+func TestReadMapItems_Nulls(t *testing.T) {
+	c := NewTagsCursor(&testCursor{
+		keys: []int64{1, 2, 3, 4, 5},
+		values: []interface{}{
+			map[string]interface{}{"value": 1.0, "host": 1.0},
+			map[string]interface{}{"host": 1.0},
+			map[string]interface{}{"value": 3.0, "host": 2.0},
+			map[string]interface{}{"host": 1.0},
+			nil,
+		},
+	}, mustParseCondition("host = 1"), nil)
+
+	items, nulls, err := readMapItems(c, "value", 0, 0, 10, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(items) != 1 || items[0].Timestamp != 1 || items[0].Value != 1.0 {
+		t.Fatalf("items mismatch: got %v", items)
+	} else if nulls != 3 {
+		t.Fatalf("nulls mismatch: got %d, exp 3", nulls)
+	}
+}
+
+// Ensure calls without a field, like min_timestamp(), read points holding any field.
+func TestReadMapItems_AnyField(t *testing.T) {
+	c := NewTagsCursor(&testCursor{
+		keys: []int64{1, 2, 3},
+		values: []interface{}{
+			map[string]interface{}{"value": 1.0},
+			nil,
+			map[string]interface{}{"host": 1.0},
+		},
+	}, nil, nil)
+
+	items, nulls, err := readMapItems(c, "", 0, 0, 10, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(items) != 2 || items[0].Timestamp != 1 || items[1].Timestamp != 3 {
+		t.Fatalf("items mismatch: got %v", items)
+	} else if nulls != 1 {
+		t.Fatalf("nulls mismatch: got %d, exp 1", nulls)
+	}
+	if got := ReduceMinTimestamp([]interface{}{MapMinTimestamp(&MapInput{Items: items})}); got != int64(1) {
+		t.Fatalf("ReduceMinTimestamp mismatch: got %v, exp 1", got)
+	}
+}
+
+// Ensure only integers too large to convert exactly to floats count as lossy.
+func TestCountLossyIntegers(t *testing.T) {
+	items := []MapItem{
+		{Value: int64(1)},
+		{Value: int64(1 << 53)},
+		{Value: int64(1<<53 + 1)},
+		{Value: int64(-1<<53 - 1)},
+		{Value: float64(1 << 60)},
+	}
+	if n := countLossyIntegers(items); n != 2 {
+		t.Fatalf("count mismatch: got %d, exp 2", n)
+	}
+}
+
+// testCursor is a cursor over slices of keys and values, in ascending order.
+type testCursor struct {
+	keys   []int64
+	values []interface{}
+	i      int
+}
+
+func (c *testCursor) SeekTo(seek int64) (int64, interface{}) {
+	c.i = sort.Search(len(c.keys), func(i int) bool { return c.keys[i] >= seek })
+	return c.Next()
+}
+
+func (c *testCursor) Next() (int64, interface{}) {
+	if c.i >= len(c.keys) {
+		return EOF, nil
+	}
+	c.i++
+	return c.keys[c.i-1], c.values[c.i-1]
+}
+
+func (c *testCursor) Ascending() bool { return true }
+
+// testAggregateMapper is a mapper returning a single chunk holding the outputs of a
+// call, for testing the executor without shards.
+type testAggregateMapper struct {
+	chunks []*MapperOutput
+}
+
+// newTestAggregateMapper returns a mapper with one output of the measurement cpu at time
+// zero, with a map output for each call of the statement.
+func newTestAggregateMapper(values ...interface{}) *testAggregateMapper {
+	return &testAggregateMapper{
+		chunks: []*MapperOutput{{
+			Name:      "cpu",
+			Values:    []*MapperValue{{Time: 0, Value: values}},
+			cursorKey: "cpu",
+		}},
+	}
+}
+
+func (m *testAggregateMapper) Open() error       { return nil }
+func (m *testAggregateMapper) TagSets() []string { return []string{"cpu"} }
+func (m *testAggregateMapper) Fields() []string  { return nil }
+func (m *testAggregateMapper) Close()            {}
+
+func (m *testAggregateMapper) NextChunk() (interface{}, error) {
+	if len(m.chunks) == 0 {
+		return nil, nil
+	}
+	chunk := m.chunks[0]
+	m.chunks = m.chunks[1:]
+	return chunk, nil
+}
+
+// readRows reads all the rows from ch.
+func readRows(ch <-chan *models.Row) []*models.Row {
+	var rows []*models.Row
+	for row := range ch {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// mustParseSelectStatement parses a select statement, panicking on error.
+func mustParseSelectStatement(s string) *influxql.SelectStatement {
+	stmt, err := influxql.ParseStatement(s)
+	if err != nil {
+		panic(err)
+	}
+	return stmt.(*influxql.SelectStatement)
+}
@@ -99,6 +99,10 @@ type Config struct {
 
 	// Query logging
 	QueryLogEnabled bool `toml:"query-log-enabled"`
+
+	// QueryTimeout is how long an aggregate query may run before it's aborted.  Zero
+	// disables the timeout.
+	QueryTimeout toml.Duration `toml:"query-timeout"`
 }
 
 func NewConfig() Config {
@@ -15,15 +15,23 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	// "github.com/davecgh/go-spew/spew"
 	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/models"
 )
 
+// now returns the current time for functions relative to the time the query runs, such
+// as last_age().  Tests replace it with a fixed clock.
+var now = time.Now
+
 // MapInput represents a collection of values to be processed by the mapper.
 type MapInput struct {
 	TMin  int64
+	TMax  int64 // End of the interval, exclusive.
 	Items []MapItem
+	Nulls int // Number of points skipped for not holding the field.
 }
 
 // MapItem represents a single item in a collection that's processed by the mapper.
@@ -46,6 +54,11 @@ type mapFunc func(*MapInput) interface{}
 // reduceFunc represents a function used for reducing mapper output.
 type reduceFunc func([]interface{}) interface{}
 
+// columnValues are the values of a reducer whose call outputs several columns, in the
+// order of the call's columns.  Such reducers return a value for each column, even if
+// it's nil, so each row has all the columns.
+type columnValues []interface{}
+
 // UnmarshalFunc represents a function that can take bytes from a mapper from remote
 // server and marshal it into an interface the reducer can use
 type UnmarshalFunc func([]byte) (interface{}, error)
@@ -68,6 +81,11 @@ func initializeMapFunc(c *influxql.Call) (mapFunc, error) {
 				return MapCountDistinct, nil
 			}
 		}
+		if cond, ok := c.Args[0].(*influxql.BinaryExpr); ok {
+			return func(input *MapInput) interface{} {
+				return MapCountIf(input, cond)
+			}, nil
+		}
 		return MapCount, nil
 	case "distinct":
 		return MapDistinct, nil
@@ -75,7 +93,7 @@ func initializeMapFunc(c *influxql.Call) (mapFunc, error) {
 		return MapSum, nil
 	case "mean":
 		return MapMean, nil
-	case "median":
+	case "median", "mad":
 		return MapStddev, nil
 	case "min":
 		return func(input *MapInput) interface{} {
@@ -89,14 +107,25 @@ func initializeMapFunc(c *influxql.Call) (mapFunc, error) {
 		return MapSpread, nil
 	case "stddev":
 		return MapStddev, nil
-	case "first":
+	case "summary":
+		return MapSummary, nil
+	case "range_detail":
+		return MapRangeDetail, nil
+	case "first", "last":
+		if orderField := c.OrderField(); orderField != "" {
+			last := c.Name == "last"
+			return func(input *MapInput) interface{} {
+				return MapOrderedSelect(input, c.Fields()[0], orderField, last)
+			}, nil
+		}
+		if c.Name == "last" {
+			return func(input *MapInput) interface{} {
+				return MapLast(input, c.Fields()[0])
+			}, nil
+		}
 		return func(input *MapInput) interface{} {
 			return MapFirst(input, c.Fields()[0])
 		}, nil
-	case "last":
-		return func(input *MapInput) interface{} {
-			return MapLast(input, c.Fields()[0])
-		}, nil
 
 	case "top", "bottom":
 		// Capture information from the call that the Map function will require
@@ -107,8 +136,54 @@ func initializeMapFunc(c *influxql.Call) (mapFunc, error) {
 		return func(input *MapInput) interface{} {
 			return MapTopBottom(input, limit, fields, len(c.Args), c.Name)
 		}, nil
-	case "percentile":
+	case "percentile", "percentiles", "mode_count", "entropy", "iqr":
 		return MapEcho, nil
+	case "last_age", "max_timestamp":
+		return MapMaxTimestamp, nil
+	case "min_timestamp":
+		return MapMinTimestamp, nil
+	case "linear_regression", "trend":
+		return MapRegression, nil
+	case "resets", "ewma", "time_above", "zscore", "post_gap_first", "nth", "abs_diff_sum", "longest_increasing_run", "moving_min", "moving_max", "tw_stddev", "normalize":
+		return MapRawQuery, nil
+	case "autocorr":
+		return MapAutocorr, nil
+	case "crossings":
+		lit, _ := c.Args[1].(*influxql.NumberLiteral)
+		threshold := lit.Val
+		return func(input *MapInput) interface{} {
+			return MapCrossings(input, threshold)
+		}, nil
+	case "percent_change":
+		return MapEndpoints, nil
+	case "sample_rate":
+		return MapSampleRate, nil
+	case "null_fraction":
+		return MapNullFraction, nil
+	case "coverage", "active_buckets":
+		lit, _ := c.Args[1].(*influxql.DurationLiteral)
+		interval := lit.Val.Nanoseconds()
+		return func(input *MapInput) interface{} {
+			return MapBuckets(input, interval)
+		}, nil
+	case "gap_count":
+		return MapTimestamps, nil
+	case "cardinality":
+		return MapSeriesKeys, nil
+	case "state_duration":
+		return MapStateDuration, nil
+	case "nearest":
+		lit, _ := c.Args[1].(*influxql.NumberLiteral)
+		target := lit.Val
+		return func(input *MapInput) interface{} {
+			return MapNearest(input, target)
+		}, nil
+	case "ratio_count":
+		num, _ := c.Args[0].(*influxql.BinaryExpr)
+		den, _ := c.Args[1].(*influxql.BinaryExpr)
+		return func(input *MapInput) interface{} {
+			return MapRatioCount(input, num, den)
+		}, nil
 	case "derivative", "non_negative_derivative":
 		// If the arg is another aggregate e.g. derivative(mean(value)), then
 		// use the map func for that nested aggregate
@@ -116,6 +191,19 @@ func initializeMapFunc(c *influxql.Call) (mapFunc, error) {
 			return initializeMapFunc(fn)
 		}
 		return MapRawQuery, nil
+	case "bucket_delta":
+		// The differences are between the values of the nested aggregate, e.g. bucket_delta(mean(value)).
+		fn, _ := c.Args[0].(*influxql.Call)
+		return initializeMapFunc(fn)
+	case "min_points":
+		fn, _ := c.Args[0].(*influxql.Call)
+		mapFn, err := initializeMapFunc(fn)
+		if err != nil {
+			return nil, err
+		}
+		return func(input *MapInput) interface{} {
+			return MapMinPoints(input, mapFn)
+		}, nil
 	default:
 		return nil, fmt.Errorf("function not found: %q", c.Name)
 	}
@@ -140,9 +228,14 @@ func initializeReduceFunc(c *influxql.Call) (reduceFunc, error) {
 	case "sum":
 		return ReduceSum, nil
 	case "mean":
+		if lit, ok := c.Args[len(c.Args)-1].(*influxql.BooleanLiteral); ok && lit.Val {
+			return ReduceMeanCount, nil
+		}
 		return ReduceMean, nil
 	case "median":
 		return ReduceMedian, nil
+	case "mad":
+		return ReduceMAD, nil
 	case "min":
 		return ReduceMin, nil
 	case "max":
@@ -151,10 +244,21 @@ func initializeReduceFunc(c *influxql.Call) (reduceFunc, error) {
 		return ReduceSpread, nil
 	case "stddev":
 		return ReduceStddev, nil
-	case "first":
+	case "summary":
+		return ReduceSummary, nil
+	case "range_detail":
+		return ReduceRangeDetail, nil
+	case "first", "last":
+		if c.OrderField() != "" {
+			last := c.Name == "last"
+			return func(values []interface{}) interface{} {
+				return ReduceOrderedSelect(values, last)
+			}, nil
+		}
+		if c.Name == "last" {
+			return ReduceLast, nil
+		}
 		return ReduceFirst, nil
-	case "last":
-		return ReduceLast, nil
 	case "top", "bottom":
 		return func(values []interface{}) interface{} {
 			lit, _ := c.Args[len(c.Args)-1].(*influxql.NumberLiteral)
@@ -170,6 +274,110 @@ func initializeReduceFunc(c *influxql.Call) (reduceFunc, error) {
 			percentile := lit.Val
 			return ReducePercentile(values, percentile)
 		}, nil
+	case "percentiles":
+		percentiles := make([]float64, len(c.Args)-1)
+		for i, arg := range c.Args[1:] {
+			lit, _ := arg.(*influxql.NumberLiteral)
+			percentiles[i] = lit.Val
+		}
+		return func(values []interface{}) interface{} {
+			return ReducePercentiles(values, percentiles)
+		}, nil
+	case "last_age":
+		// Ages are relative to the time the query runs, so they're the same for each bucket.
+		t := now()
+		return func(values []interface{}) interface{} {
+			return ReduceLastAge(values, t)
+		}, nil
+	case "min_timestamp":
+		return ReduceMinTimestamp, nil
+	case "linear_regression":
+		return ReduceLinearRegression, nil
+	case "trend":
+		return ReduceTrend, nil
+	case "max_timestamp":
+		return ReduceMaxTimestamp, nil
+	case "coverage":
+		return ReduceCoverage, nil
+	case "active_buckets":
+		return ReduceActiveBuckets, nil
+	case "resets":
+		return ReduceResets, nil
+	case "sample_rate":
+		return ReduceSampleRate, nil
+	case "null_fraction":
+		return ReduceNullFraction, nil
+	case "gap_count":
+		lit, _ := c.Args[1].(*influxql.DurationLiteral)
+		threshold := lit.Val.Nanoseconds()
+		return func(values []interface{}) interface{} {
+			return ReduceGapCount(values, threshold)
+		}, nil
+	case "zscore":
+		return ReduceZScore, nil
+	case "percent_change":
+		return ReducePercentChange, nil
+	case "mode_count":
+		return ReduceModeCount, nil
+	case "entropy":
+		return ReduceEntropy, nil
+	case "abs_diff_sum":
+		return ReduceAbsDiffSum, nil
+	case "cardinality":
+		return ReduceCardinality, nil
+	case "iqr":
+		return ReduceIQR, nil
+	case "autocorr":
+		return ReduceAutocorr, nil
+	case "tw_stddev":
+		return ReduceTimeWeightedStddev, nil
+	case "normalize":
+		return ReduceNormalize, nil
+	case "state_duration":
+		return ReduceStateDuration, nil
+	case "moving_min", "moving_max":
+		lit, _ := c.Args[1].(*influxql.NumberLiteral)
+		n := int(lit.Val)
+		max := c.Name == "moving_max"
+		return func(values []interface{}) interface{} {
+			return ReduceMovingExtreme(values, n, max)
+		}, nil
+	case "crossings":
+		return ReduceCrossings, nil
+	case "nearest":
+		lit, _ := c.Args[1].(*influxql.NumberLiteral)
+		target := lit.Val
+		return func(values []interface{}) interface{} {
+			return ReduceNearest(values, target)
+		}, nil
+	case "longest_increasing_run":
+		return ReduceLongestIncreasingRun, nil
+	case "ratio_count":
+		return ReduceRatioCount, nil
+	case "nth":
+		lit, _ := c.Args[1].(*influxql.NumberLiteral)
+		n := int(lit.Val)
+		return func(values []interface{}) interface{} {
+			return ReduceNth(values, n)
+		}, nil
+	case "post_gap_first":
+		lit, _ := c.Args[1].(*influxql.DurationLiteral)
+		threshold := lit.Val.Nanoseconds()
+		return func(values []interface{}) interface{} {
+			return ReducePostGapFirst(values, threshold)
+		}, nil
+	case "time_above":
+		lit, _ := c.Args[1].(*influxql.NumberLiteral)
+		threshold := lit.Val
+		return func(values []interface{}) interface{} {
+			return ReduceTimeAbove(values, threshold)
+		}, nil
+	case "ewma":
+		lit, _ := c.Args[1].(*influxql.NumberLiteral)
+		alpha := lit.Val
+		return func(values []interface{}) interface{} {
+			return ReduceEWMA(values, alpha)
+		}, nil
 	case "derivative", "non_negative_derivative":
 		// If the arg is another aggregate e.g. derivative(mean(value)), then
 		// use the map func for that nested aggregate
@@ -177,6 +385,20 @@ func initializeReduceFunc(c *influxql.Call) (reduceFunc, error) {
 			return initializeReduceFunc(fn)
 		}
 		return nil, fmt.Errorf("expected function argument to %s", c.Name)
+	case "bucket_delta":
+		fn, _ := c.Args[0].(*influxql.Call)
+		return initializeReduceFunc(fn)
+	case "min_points":
+		fn, _ := c.Args[0].(*influxql.Call)
+		reduceFn, err := initializeReduceFunc(fn)
+		if err != nil {
+			return nil, err
+		}
+		lit, _ := c.Args[1].(*influxql.NumberLiteral)
+		n := int64(lit.Val)
+		return func(values []interface{}) interface{} {
+			return ReduceMinPoints(values, n, reduceFn)
+		}, nil
 	default:
 		return nil, fmt.Errorf("function not found: %q", c.Name)
 	}
@@ -194,6 +416,34 @@ func InitializeUnmarshaller(c *influxql.Call) (UnmarshalFunc, error) {
 
 	// Retrieve marshal function by name
 	switch c.Name {
+	case "bucket_delta":
+		// Mappers output the values of the nested aggregate.
+		fn, _ := c.Args[0].(*influxql.Call)
+		return InitializeUnmarshaller(fn)
+	case "min_points":
+		fn, _ := c.Args[0].(*influxql.Call)
+		unmarshal, err := InitializeUnmarshaller(fn)
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) (interface{}, error) {
+			var o struct {
+				Count int64
+				Value json.RawMessage
+			}
+			if err := json.Unmarshal(b, &o); err != nil {
+				return nil, err
+			}
+			val := &minPointsMapOutput{Count: o.Count}
+			if len(o.Value) > 0 && string(o.Value) != "null" {
+				v, err := unmarshal(o.Value)
+				if err != nil {
+					return nil, err
+				}
+				val.Value = v
+			}
+			return val, nil
+		}, nil
 	case "mean":
 		return func(b []byte) (interface{}, error) {
 			var o meanMapOutput
@@ -206,6 +456,96 @@ func InitializeUnmarshaller(c *influxql.Call) (UnmarshalFunc, error) {
 			err := json.Unmarshal(b, &o)
 			return &o, err
 		}, nil
+	case "summary":
+		return func(b []byte) (interface{}, error) {
+			var o summaryMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "range_detail":
+		return func(b []byte) (interface{}, error) {
+			var o rangeDetailMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "resets", "ewma", "time_above", "zscore", "post_gap_first", "percent_change", "nth", "abs_diff_sum", "longest_increasing_run", "moving_min", "moving_max", "tw_stddev", "normalize":
+		return func(b []byte) (interface{}, error) {
+			a := make([]*rawQueryMapOutput, 0)
+			err := json.Unmarshal(b, &a)
+			return a, err
+		}, nil
+	case "autocorr":
+		return func(b []byte) (interface{}, error) {
+			var o autocorrMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "crossings":
+		return func(b []byte) (interface{}, error) {
+			var o crossingsMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "state_duration":
+		return func(b []byte) (interface{}, error) {
+			var o stateDurationMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "linear_regression", "trend":
+		return func(b []byte) (interface{}, error) {
+			var o regressionMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "nearest":
+		return func(b []byte) (interface{}, error) {
+			var o nearestMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "ratio_count":
+		return func(b []byte) (interface{}, error) {
+			var o ratioCountMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "sample_rate":
+		return func(b []byte) (interface{}, error) {
+			var o sampleRateMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "null_fraction":
+		return func(b []byte) (interface{}, error) {
+			var o nullFractionMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "last_age", "min_timestamp", "max_timestamp":
+		return func(b []byte) (interface{}, error) {
+			var val int64
+			err := json.Unmarshal(b, &val)
+			return val, err
+		}, nil
+	case "coverage", "active_buckets":
+		return func(b []byte) (interface{}, error) {
+			var val bucketSet
+			err := json.Unmarshal(b, &val)
+			return val, err
+		}, nil
+	case "cardinality":
+		return func(b []byte) (interface{}, error) {
+			var val []string
+			err := json.Unmarshal(b, &val)
+			return val, err
+		}, nil
+	case "gap_count":
+		return func(b []byte) (interface{}, error) {
+			var val int64Slice
+			err := json.Unmarshal(b, &val)
+			return val, err
+		}, nil
 	case "distinct":
 		return func(b []byte) (interface{}, error) {
 			var val InterfaceValues
@@ -230,7 +570,7 @@ func InitializeUnmarshaller(c *influxql.Call) (UnmarshalFunc, error) {
 			err := json.Unmarshal(b, &val)
 			return val, err
 		}, nil
-	case "median":
+	case "median", "mad":
 		return func(b []byte) (interface{}, error) {
 			a := make([]float64, 0)
 			err := json.Unmarshal(b, &a)
@@ -257,6 +597,81 @@ func MapCount(input *MapInput) interface{} {
 	return nil
 }
 
+// MapCountIf computes the number of values in an iterator meeting a condition, such as
+// value > 100, comparing the field with a number.
+func MapCountIf(input *MapInput, cond *influxql.BinaryExpr) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+
+	name := cond.LHS.(*influxql.VarRef).Val
+	m := make(map[string]interface{}, 1)
+
+	var n int64
+	for _, item := range input.Items {
+		// Compare as floats, since the number the field is compared with is a float.
+		v, _, ok := decodeValueAndNumberType(item.Value)
+		if !ok {
+			continue
+		}
+		m[name] = v
+		if influxql.EvalBool(cond, m) {
+			n++
+		}
+	}
+	return n
+}
+
+type ratioCountMapOutput struct {
+	Numerator   int64
+	Denominator int64
+}
+
+// MapRatioCount computes the number of values in an iterator meeting each of two conditions
+// of the same field, such as status >= 500 and status >= 0.
+func MapRatioCount(input *MapInput, num, den *influxql.BinaryExpr) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+
+	name := num.LHS.(*influxql.VarRef).Val
+	m := make(map[string]interface{}, 1)
+
+	out := &ratioCountMapOutput{}
+	for _, item := range input.Items {
+		v, _, ok := decodeValueAndNumberType(item.Value)
+		if !ok {
+			continue
+		}
+		m[name] = v
+		if influxql.EvalBool(num, m) {
+			out.Numerator++
+		}
+		if influxql.EvalBool(den, m) {
+			out.Denominator++
+		}
+	}
+	return out
+}
+
+// ReduceRatioCount computes the ratio of the number of values meeting the first condition
+// to the number meeting the second.  There is no ratio if no values meet the second.
+func ReduceRatioCount(values []interface{}) interface{} {
+	var num, den int64
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*ratioCountMapOutput)
+		num += val.Numerator
+		den += val.Denominator
+	}
+	if den == 0 {
+		return nil
+	}
+	return float64(num) / float64(den)
+}
+
 type InterfaceValues []interface{}
 
 func (d InterfaceValues) Len() int      { return len(d) }
@@ -466,6 +881,23 @@ func ReduceMean(values []interface{}) interface{} {
 	return total / float64(count)
 }
 
+// ReduceMeanCount computes the mean of values for each key, and the number of values
+// averaged.
+func ReduceMeanCount(values []interface{}) interface{} {
+	var total float64
+	var count int
+	for _, v := range values {
+		if v, _ := v.(*meanMapOutput); v != nil {
+			count += v.Count
+			total += v.Total
+		}
+	}
+	if count == 0 {
+		return columnValues{nil, nil}
+	}
+	return columnValues{total / float64(count), int64(count)}
+}
+
 // ReduceMedian computes the median of values
 func ReduceMedian(values []interface{}) interface{} {
 	var data []float64
@@ -495,6 +927,26 @@ func ReduceMedian(values []interface{}) interface{} {
 	return sortedRange[0]
 }
 
+// ReduceMAD computes the median absolute deviation of the values, the median of the
+// distances of the values from their median.
+func ReduceMAD(values []interface{}) interface{} {
+	median, ok := ReduceMedian(values).(float64)
+	if !ok {
+		return nil
+	}
+
+	var deviations []float64
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		for _, v := range value.([]float64) {
+			deviations = append(deviations, math.Abs(v-median))
+		}
+	}
+	return ReduceMedian([]interface{}{deviations})
+}
+
 // getSortedRange returns a sorted subset of data. By using discardLowerRange and discardUpperRange to get the target
 // subset (unsorted) and then just sorting that subset, the work can be reduced from O(N lg N), where N is len(data), to
 // O(N + count lg count) for the average case
@@ -926,61 +1378,348 @@ func ReduceStddev(values []interface{}) interface{} {
 	return stddev
 }
 
-type firstLastMapOutput struct {
-	Time   int64
-	Value  interface{}
-	Fields map[string]interface{}
-	Tags   map[string]string
+type summaryMapOutput struct {
+	Count    int64
+	Sum      float64
+	Min, Max float64
+	Type     NumberType
 }
 
-// MapFirst collects the values to pass to the reducer
-// This function assumes time ordered input
-func MapFirst(input *MapInput, fieldName string) interface{} {
+// MapSummary collects the count, sum and extremes of the values in a single pass.
+func MapSummary(input *MapInput) interface{} {
 	if len(input.Items) == 0 {
 		return nil
 	}
 
-	k, v := input.Items[0].Timestamp, input.Items[0].Value
-	tags := input.Items[0].Tags
-	fields := input.Items[0].Fields
-	if n, ok := v.(map[string]interface{}); ok {
-		v = n[fieldName]
+	out := &summaryMapOutput{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, item := range input.Items {
+		var val float64
+		switch v := item.Value.(type) {
+		case float64:
+			val = v
+		case int64:
+			val = float64(v)
+			out.Type = Int64Type
+		default:
+			continue
+		}
+		out.Count++
+		out.Sum += val
+		out.Min = math.Min(out.Min, val)
+		out.Max = math.Max(out.Max, val)
 	}
+	return out
+}
 
-	// Find greatest value at same timestamp.
-	for _, item := range input.Items[1:] {
-		nextk, nextv := item.Timestamp, item.Value
-		if nextk != k {
-			break
+// ReduceSummary computes the count, min, max and mean of values.
+func ReduceSummary(values []interface{}) interface{} {
+	result := &summaryMapOutput{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, v := range values {
+		if v == nil {
+			continue
 		}
-		if n, ok := nextv.(map[string]interface{}); ok {
-			nextv = n[fieldName]
+		val := v.(*summaryMapOutput)
+		if val.Count == 0 {
+			continue
+		}
+		result.Count += val.Count
+		result.Sum += val.Sum
+		result.Min = math.Min(result.Min, val.Min)
+		result.Max = math.Max(result.Max, val.Max)
+		if val.Type == Int64Type {
+			result.Type = Int64Type
 		}
+	}
+	if result.Count == 0 {
+		return columnValues{nil, nil, nil, nil}
+	}
 
-		if greaterThan(nextv, v) {
-			fields = item.Fields
-			tags = item.Tags
-			v = nextv
+	mean := result.Sum / float64(result.Count)
+	if result.Type == Int64Type {
+		return columnValues{result.Count, int64(result.Min), int64(result.Max), mean}
+	}
+	return columnValues{result.Count, result.Min, result.Max, mean}
+}
+
+type rangeDetailMapOutput struct {
+	Min, Max         float64
+	MinTime, MaxTime int64
+	Type             NumberType
+}
+
+// MapRangeDetail collects the extremes of the values and the times of their first
+// occurrences in a single pass.
+func MapRangeDetail(input *MapInput) interface{} {
+	var out *rangeDetailMapOutput
+	for _, item := range input.Items {
+		val, typ, ok := decodeValueAndNumberType(item.Value)
+		if !ok {
+			continue
+		}
+		p := &rangeDetailMapOutput{Min: val, Max: val, MinTime: item.Timestamp, MaxTime: item.Timestamp}
+		if out == nil {
+			out = p
+		} else {
+			out.merge(p)
+		}
+		if typ == Int64Type {
+			out.Type = Int64Type
 		}
 	}
-	return &firstLastMapOutput{Time: k, Value: v, Fields: fields, Tags: tags}
+	if out == nil {
+		return nil
+	}
+	return out
 }
 
-// ReduceFirst computes the first of value.
-func ReduceFirst(values []interface{}) interface{} {
-	out := &firstLastMapOutput{}
-	pointsYielded := false
+// merge extends the range to include other's.  Extremes that are equal keep the earliest time.
+func (o *rangeDetailMapOutput) merge(other *rangeDetailMapOutput) {
+	if other.Min < o.Min || (other.Min == o.Min && other.MinTime < o.MinTime) {
+		o.Min, o.MinTime = other.Min, other.MinTime
+	}
+	if other.Max > o.Max || (other.Max == o.Max && other.MaxTime < o.MaxTime) {
+		o.Max, o.MaxTime = other.Max, other.MaxTime
+	}
+}
 
+// ReduceRangeDetail computes the min and max of values and the times they were written.
+func ReduceRangeDetail(values []interface{}) interface{} {
+	var result *rangeDetailMapOutput
 	for _, v := range values {
 		if v == nil {
 			continue
 		}
-		val := v.(*firstLastMapOutput)
-		// Initialize first
-		if !pointsYielded {
-			out.Time = val.Time
-			out.Value = val.Value
-			out.Fields = val.Fields
+		val := v.(*rangeDetailMapOutput)
+		if result == nil {
+			result = &rangeDetailMapOutput{}
+			*result = *val
+			continue
+		}
+		if val.Type == Int64Type {
+			result.Type = Int64Type
+		}
+		result.merge(val)
+	}
+	if result == nil {
+		return columnValues{nil, nil, nil, nil}
+	}
+
+	if result.Type == Int64Type {
+		return columnValues{int64(result.Min), result.MinTime, int64(result.Max), result.MaxTime}
+	}
+	return columnValues{result.Min, result.MinTime, result.Max, result.MaxTime}
+}
+
+// minPointsMapOutput holds the map output of the aggregate nested in min_points().
+type minPointsMapOutput struct {
+	Count int64
+	Value interface{}
+}
+
+// MapMinPoints runs the map function of the aggregate nested in min_points(), and counts
+// the values it read.
+func MapMinPoints(input *MapInput, fn mapFunc) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+	return &minPointsMapOutput{Count: int64(len(input.Items)), Value: fn(input)}
+}
+
+// ReduceMinPoints runs the reduce function of the aggregate nested in min_points() if at
+// least n values were read, and returns nil otherwise.
+func ReduceMinPoints(values []interface{}, n int64, fn reduceFunc) interface{} {
+	var count int64
+	var nested []interface{}
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*minPointsMapOutput)
+		count += val.Count
+		nested = append(nested, val.Value)
+	}
+	if count < n {
+		return nil
+	}
+	return fn(nested)
+}
+
+// regressionMapOutput holds the sums for a least-squares fit of values against time.  Times
+// are in seconds since Start, rather than since the epoch, so their squares keep their
+// precision.
+type regressionMapOutput struct {
+	Count int64
+	Start int64
+	SumT  float64
+	SumV  float64
+	SumTV float64
+	SumTT float64
+	SumVV float64
+}
+
+// MapRegression accumulates the sums for a least-squares fit of values against time.
+func MapRegression(input *MapInput) interface{} {
+	var out *regressionMapOutput
+	for _, item := range input.Items {
+		v, _, ok := decodeValueAndNumberType(item.Value)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = &regressionMapOutput{Start: item.Timestamp}
+		}
+		t := time.Duration(item.Timestamp - out.Start).Seconds()
+		out.Count++
+		out.SumT += t
+		out.SumV += v
+		out.SumTV += t * v
+		out.SumTT += t * t
+		out.SumVV += v * v
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// reduceRegression merges the sums output by MapRegression, with times since the earliest start.
+func reduceRegression(values []interface{}) *regressionMapOutput {
+	var outputs []*regressionMapOutput
+	var result *regressionMapOutput
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*regressionMapOutput)
+		outputs = append(outputs, val)
+		if result == nil || val.Start < result.Start {
+			result = &regressionMapOutput{Start: val.Start}
+		}
+	}
+	if result == nil {
+		return nil
+	}
+
+	for _, val := range outputs {
+		// Shift the times by the difference in start: t' = t + d.
+		d := time.Duration(val.Start - result.Start).Seconds()
+		n := float64(val.Count)
+		result.Count += val.Count
+		result.SumT += val.SumT + n*d
+		result.SumV += val.SumV
+		result.SumTV += val.SumTV + d*val.SumV
+		result.SumTT += val.SumTT + 2*d*val.SumT + n*d*d
+		result.SumVV += val.SumVV
+	}
+	return result
+}
+
+// slope returns the slope of the least-squares line through the values, per second, and
+// false if there aren't two values at different times to fit a line through.
+func (o *regressionMapOutput) slope() (float64, bool) {
+	n := float64(o.Count)
+	denom := n*o.SumTT - o.SumT*o.SumT
+	if o.Count < 2 || denom == 0 {
+		return 0, false
+	}
+	return (n*o.SumTV - o.SumT*o.SumV) / denom, true
+}
+
+// ReduceLinearRegression computes the slope of the least-squares line through the values,
+// in units per second.
+func ReduceLinearRegression(values []interface{}) interface{} {
+	result := reduceRegression(values)
+	if result == nil {
+		return nil
+	}
+	slope, ok := result.slope()
+	if !ok {
+		return nil
+	}
+	return slope
+}
+
+// ReduceTrend computes the slope of the least-squares line through the values, per
+// second, the line's value at the time of the first value, and the coefficient of
+// determination, R², of the fit.  Values that don't vary fit the line exactly, with an
+// R² of 1.
+func ReduceTrend(values []interface{}) interface{} {
+	result := reduceRegression(values)
+	if result == nil {
+		return columnValues{nil, nil, nil}
+	}
+	slope, ok := result.slope()
+	if !ok {
+		return columnValues{nil, nil, nil}
+	}
+
+	n := float64(result.Count)
+	intercept := (result.SumV - slope*result.SumT) / n
+
+	r2 := 1.0
+	if varV := n*result.SumVV - result.SumV*result.SumV; varV > 0 {
+		cov := n*result.SumTV - result.SumT*result.SumV
+		r2 = cov * cov / ((n*result.SumTT - result.SumT*result.SumT) * varV)
+	}
+	return columnValues{slope, intercept, r2}
+}
+
+type firstLastMapOutput struct {
+	Time   int64
+	Order  float64 // Value of the ordering field, if there is one.
+	Value  interface{}
+	Fields map[string]interface{}
+	Tags   map[string]string
+}
+
+// MapFirst collects the values to pass to the reducer
+// This function assumes time ordered input
+func MapFirst(input *MapInput, fieldName string) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+
+	k, v := input.Items[0].Timestamp, input.Items[0].Value
+	tags := input.Items[0].Tags
+	fields := input.Items[0].Fields
+	if n, ok := v.(map[string]interface{}); ok {
+		v = n[fieldName]
+	}
+
+	// Find greatest value at same timestamp.
+	for _, item := range input.Items[1:] {
+		nextk, nextv := item.Timestamp, item.Value
+		if nextk != k {
+			break
+		}
+		if n, ok := nextv.(map[string]interface{}); ok {
+			nextv = n[fieldName]
+		}
+
+		if greaterThan(nextv, v) {
+			fields = item.Fields
+			tags = item.Tags
+			v = nextv
+		}
+	}
+	return &firstLastMapOutput{Time: k, Value: v, Fields: fields, Tags: tags}
+}
+
+// ReduceFirst computes the first of value.
+func ReduceFirst(values []interface{}) interface{} {
+	out := &firstLastMapOutput{}
+	pointsYielded := false
+
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*firstLastMapOutput)
+		// Initialize first
+		if !pointsYielded {
+			out.Time = val.Time
+			out.Value = val.Value
+			out.Fields = val.Fields
 			out.Tags = val.Tags
 			pointsYielded = true
 		}
@@ -1083,6 +1822,68 @@ func ReduceLast(values []interface{}) interface{} {
 	return nil
 }
 
+// MapOrderedSelect selects the point with the lowest value of orderField, or the highest
+// if last is set, for first() and last() with an ordering field.  Points that don't hold
+// the ordering field as a number are skipped.
+func MapOrderedSelect(input *MapInput, fieldName, orderField string, last bool) interface{} {
+	var out *firstLastMapOutput
+	for _, item := range input.Items {
+		order, _, ok := decodeValueAndNumberType(item.Fields[orderField])
+		if !ok {
+			continue
+		}
+
+		v := item.Value
+		if m, ok := v.(map[string]interface{}); ok {
+			v = m[fieldName]
+		}
+		o := &firstLastMapOutput{Time: item.Timestamp, Order: order, Value: v, Fields: item.Fields, Tags: item.Tags}
+		if out == nil || orderedBefore(o, out, last) {
+			out = o
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// orderedBefore returns whether first(), or last() if last is set, selects a over b.
+// Points with the same ordering field value are ordered by time, and then the greater
+// value is selected, as when ordering by time alone.
+func orderedBefore(a, b *firstLastMapOutput, last bool) bool {
+	if a.Order != b.Order {
+		return (a.Order < b.Order) != last
+	}
+	if a.Time != b.Time {
+		return (a.Time < b.Time) != last
+	}
+	return greaterThan(a.Value, b.Value)
+}
+
+// ReduceOrderedSelect selects the point output by MapOrderedSelect with the lowest value
+// of the ordering field, or the highest if last is set.
+func ReduceOrderedSelect(values []interface{}, last bool) interface{} {
+	var out *firstLastMapOutput
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if val := v.(*firstLastMapOutput); out == nil || orderedBefore(val, out, last) {
+			out = val
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return PositionPoint{
+		Time:   out.Time,
+		Value:  out.Value,
+		Fields: out.Fields,
+		Tags:   out.Tags,
+	}
+}
+
 type positionOut struct {
 	points   PositionPoints
 	callArgs []string // ordered args in the call
@@ -1629,8 +2430,46 @@ func MapEcho(input *MapInput) interface{} {
 }
 
 // ReducePercentile computes the percentile of values for each key.
+// The 0th percentile is the minimum and the 100th is the maximum.
 func ReducePercentile(values []interface{}, percentile float64) interface{} {
+	allValues := sortedEchoValues(values)
+	if len(allValues) == 0 {
+		return nil
+	}
+	return allValues[percentileIndex(len(allValues), percentile)]
+}
+
+// ReducePercentiles computes several percentiles of values for each key, sorting the
+// values once.
+func ReducePercentiles(values []interface{}, percentiles []float64) interface{} {
+	allValues := sortedEchoValues(values)
+
+	out := make(columnValues, len(percentiles))
+	if len(allValues) == 0 {
+		return out
+	}
+	for i, p := range percentiles {
+		out[i] = allValues[percentileIndex(len(allValues), p)]
+	}
+	return out
+}
+
+// ReduceIQR computes the interquartile range of values, the difference between the 75th
+// and 25th percentiles.  There is no range for fewer than four values.
+func ReduceIQR(values []interface{}) interface{} {
+	allValues := sortedEchoValues(values)
+	if len(allValues) < 4 {
+		return nil
+	}
+
+	q1 := allValues[percentileIndex(len(allValues), 25)]
+	q3 := allValues[percentileIndex(len(allValues), 75)]
+	return q3 - q1
+}
 
+// sortedEchoValues returns the numeric values output by MapEcho, as floats, in ascending
+// order.
+func sortedEchoValues(values []interface{}) []float64 {
 	var allValues []float64
 
 	for _, v := range values {
@@ -1650,20 +2489,1075 @@ func ReducePercentile(values []interface{}, percentile float64) interface{} {
 	}
 
 	sort.Float64s(allValues)
-	length := len(allValues)
+	return allValues
+}
+
+// percentileIndex returns the index of a percentile in a sorted set of length values.
+func percentileIndex(length int, percentile float64) int {
 	index := int(math.Floor(float64(length)*percentile/100.0+0.5)) - 1
 
-	if index < 0 || index >= len(allValues) {
+	// Clamp the rank so low percentiles of small sets, like the 0th, select the
+	// minimum rather than falling off the front of the set.
+	if index < 0 {
+		return 0
+	} else if index >= length {
+		return length - 1
+	}
+	return index
+}
+
+// MapMinTimestamp collects the time of the earliest value.
+func MapMinTimestamp(input *MapInput) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+
+	min := input.Items[0].Timestamp
+	for _, item := range input.Items[1:] {
+		if item.Timestamp < min {
+			min = item.Timestamp
+		}
+	}
+	return min
+}
+
+// ReduceMinTimestamp computes the time of the earliest value, in nanoseconds since the epoch.
+func ReduceMinTimestamp(values []interface{}) interface{} {
+	var min int64
+	var found bool
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if t := v.(int64); !found || t < min {
+			min, found = t, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return min
+}
+
+// MapMaxTimestamp collects the time of the latest value.
+func MapMaxTimestamp(input *MapInput) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+
+	max := input.Items[0].Timestamp
+	for _, item := range input.Items[1:] {
+		if item.Timestamp > max {
+			max = item.Timestamp
+		}
+	}
+	return max
+}
+
+// reduceMaxTimestamp returns the time of the latest value, and false if there are no values.
+func reduceMaxTimestamp(values []interface{}) (int64, bool) {
+	var max int64
+	var found bool
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if t := v.(int64); !found || t > max {
+			max, found = t, true
+		}
+	}
+	return max, found
+}
+
+// ReduceMaxTimestamp computes the time of the latest value, in nanoseconds since the epoch.
+func ReduceMaxTimestamp(values []interface{}) interface{} {
+	max, ok := reduceMaxTimestamp(values)
+	if !ok {
+		return nil
+	}
+	return max
+}
+
+// ReduceLastAge computes how long before now the latest value was written, in nanoseconds.
+func ReduceLastAge(values []interface{}, now time.Time) interface{} {
+	max, ok := reduceMaxTimestamp(values)
+	if !ok {
+		return nil
+	}
+	return now.UnixNano() - max
+}
+
+type sampleRateMapOutput struct {
+	Count    int64
+	Min, Max int64
+}
+
+// MapSampleRate collects the number of values and the times of the first and last.
+func MapSampleRate(input *MapInput) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+
+	out := &sampleRateMapOutput{Min: input.Items[0].Timestamp, Max: input.Items[0].Timestamp}
+	for _, item := range input.Items {
+		out.Count++
+		if item.Timestamp < out.Min {
+			out.Min = item.Timestamp
+		}
+		if item.Timestamp > out.Max {
+			out.Max = item.Timestamp
+		}
+	}
+	return out
+}
+
+// ReduceSampleRate computes the number of values written per second between the first
+// and last.
+func ReduceSampleRate(values []interface{}) interface{} {
+	var result *sampleRateMapOutput
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*sampleRateMapOutput)
+		if result == nil {
+			result = &sampleRateMapOutput{Min: val.Min, Max: val.Max}
+		}
+		result.Count += val.Count
+		if val.Min < result.Min {
+			result.Min = val.Min
+		}
+		if val.Max > result.Max {
+			result.Max = val.Max
+		}
+	}
+
+	// A single instant has no rate.
+	if result == nil || result.Max == result.Min {
+		return nil
+	}
+	return float64(result.Count) / time.Duration(result.Max-result.Min).Seconds()
+}
+
+type nullFractionMapOutput struct {
+	Nulls int64
+	Count int64
+}
+
+// MapNullFraction collects the number of points, and of those not holding the field.
+func MapNullFraction(input *MapInput) interface{} {
+	if len(input.Items) == 0 && input.Nulls == 0 {
 		return nil
 	}
+	return &nullFractionMapOutput{
+		Nulls: int64(input.Nulls),
+		Count: int64(len(input.Items) + input.Nulls),
+	}
+}
 
-	return allValues[index]
+// ReduceNullFraction computes the fraction of points not holding the field.
+func ReduceNullFraction(values []interface{}) interface{} {
+	var nulls, count int64
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*nullFractionMapOutput)
+		nulls += val.Nulls
+		count += val.Count
+	}
+	if count == 0 {
+		return nil
+	}
+	return float64(nulls) / float64(count)
+}
+
+type nearestMapOutput struct {
+	Time  int64
+	Value float64
+	Type  NumberType
+}
+
+// closer returns true if o is closer to the target than other, or as close but earlier.
+func (o *nearestMapOutput) closer(other *nearestMapOutput, target float64) bool {
+	d, otherD := math.Abs(o.Value-target), math.Abs(other.Value-target)
+	return d < otherD || (d == otherD && o.Time < other.Time)
+}
+
+// MapNearest finds the value closest to the target, without collecting the values.
+func MapNearest(input *MapInput, target float64) interface{} {
+	var out *nearestMapOutput
+	for _, item := range input.Items {
+		val, typ, ok := decodeValueAndNumberType(item.Value)
+		if !ok {
+			continue
+		}
+		o := &nearestMapOutput{Time: item.Timestamp, Value: val, Type: typ}
+		if out == nil || o.closer(out, target) {
+			out = o
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// ReduceNearest returns the value closest to the target, where the earliest of values as
+// close wins.
+func ReduceNearest(values []interface{}, target float64) interface{} {
+	var result *nearestMapOutput
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*nearestMapOutput)
+		if result == nil || val.closer(result, target) {
+			result = val
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	if result.Type == Int64Type {
+		return int64(result.Value)
+	}
+	return result.Value
+}
+
+// bucketSet is the sorted, distinct indexes of the intervals of time holding values.
+type bucketSet []int64
+
+func (a bucketSet) Len() int           { return len(a) }
+func (a bucketSet) Less(i, j int) bool { return a[i] < a[j] }
+func (a bucketSet) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// MapBuckets collects the intervals of time, of the given size, holding values.
+func MapBuckets(input *MapInput, interval int64) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+
+	var out bucketSet
+	for _, item := range input.Items {
+		// Floor rather than truncate, so times before the epoch share buckets correctly.
+		bucket := item.Timestamp / interval
+		if item.Timestamp%interval < 0 {
+			bucket--
+		}
+
+		// Items are in time order, so values of the same bucket are adjacent.
+		if len(out) == 0 || out[len(out)-1] != bucket {
+			out = append(out, bucket)
+		}
+	}
+	return out
+}
+
+// reduceBuckets merges the bucket sets output by MapBuckets.
+func reduceBuckets(values []interface{}) bucketSet {
+	index := make(map[int64]struct{})
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, bucket := range v.(bucketSet) {
+			index[bucket] = struct{}{}
+		}
+	}
+
+	buckets := make(bucketSet, 0, len(index))
+	for bucket := range index {
+		buckets = append(buckets, bucket)
+	}
+	sort.Sort(buckets)
+	return buckets
+}
+
+// ReduceCoverage computes the fraction of the intervals between the first and last
+// values that hold values.
+func ReduceCoverage(values []interface{}) interface{} {
+	buckets := reduceBuckets(values)
+	if len(buckets) == 0 {
+		return nil
+	}
+	total := buckets[len(buckets)-1] - buckets[0] + 1
+	return float64(len(buckets)) / float64(total)
+}
+
+// timeValue is a numeric value and the time it was written.
+type timeValue struct {
+	Time  int64
+	Value float64
+}
+
+type timeValues []timeValue
+
+func (a timeValues) Len() int           { return len(a) }
+func (a timeValues) Less(i, j int) bool { return a[i].Time < a[j].Time }
+func (a timeValues) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// reduceTimeValues merges the values output by MapRawQuery for each series into a single
+// time ordered set, for aggregates that depend on the order of the values.  Values that
+// aren't numeric are skipped.
+func reduceTimeValues(values []interface{}) timeValues {
+	var a timeValues
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, o := range v.([]*rawQueryMapOutput) {
+			if val, _, ok := decodeValueAndNumberType(o.Values); ok {
+				a = append(a, timeValue{Time: o.Time, Value: val})
+			}
+		}
+	}
+	sort.Stable(a)
+	return a
+}
+
+// eachTimeValue calls fn with each numeric value output by MapRawQuery, in the order
+// reduceTimeValues would return them.  Each output is sorted by time if it isn't already,
+// and the outputs are merged as they are read rather than copied into a single set.
+func eachTimeValue(values []interface{}, fn func(v timeValue)) {
+	var outputs []rawOutputs
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		a := rawOutputs(v.([]*rawQueryMapOutput))
+		if !sort.IsSorted(a) {
+			a = append(rawOutputs(nil), a...)
+			sort.Stable(a)
+		}
+		if len(a) > 0 {
+			outputs = append(outputs, a)
+		}
+	}
+
+	for len(outputs) > 0 {
+		// Take the earliest value at the front of an output, from the first on ties.
+		next := 0
+		for i := 1; i < len(outputs); i++ {
+			if outputs[i][0].Time < outputs[next][0].Time {
+				next = i
+			}
+		}
+		o := outputs[next][0]
+		if outputs[next] = outputs[next][1:]; len(outputs[next]) == 0 {
+			outputs = append(outputs[:next], outputs[next+1:]...)
+		}
+
+		if val, _, ok := decodeValueAndNumberType(o.Values); ok {
+			fn(timeValue{Time: o.Time, Value: val})
+		}
+	}
+}
+
+// ReduceResets computes the number of times values decreased, such as when a counter is reset.
+func ReduceResets(values []interface{}) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) == 0 {
+		return nil
+	}
+
+	var n int64
+	for i := 1; i < len(a); i++ {
+		if a[i].Value < a[i-1].Value {
+			n++
+		}
+	}
+	return n
+}
+
+// ReduceActiveBuckets computes the number of intervals holding values.
+func ReduceActiveBuckets(values []interface{}) interface{} {
+	buckets := reduceBuckets(values)
+	if len(buckets) == 0 {
+		return nil
+	}
+	return int64(len(buckets))
+}
+
+// MapSeriesKeys collects the keys of the tags of the series holding values.
+func MapSeriesKeys(input *MapInput) interface{} {
+	index := make(map[string]struct{})
+	for _, item := range input.Items {
+		index[string(models.Tags(item.Tags).HashKey())] = struct{}{}
+	}
+	if len(index) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ReduceCardinality computes the number of distinct series holding values.
+func ReduceCardinality(values []interface{}) interface{} {
+	index := make(map[string]struct{})
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, key := range v.([]string) {
+			index[key] = struct{}{}
+		}
+	}
+	if len(index) == 0 {
+		return nil
+	}
+	return int64(len(index))
+}
+
+// MapTimestamps collects the times of the values.
+func MapTimestamps(input *MapInput) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+
+	out := make(int64Slice, len(input.Items))
+	for i, item := range input.Items {
+		out[i] = item.Timestamp
+	}
+	return out
+}
+
+// ReduceGapCount computes the number of gaps between consecutive values longer than the
+// threshold, such as when a sensor stops reporting.
+func ReduceGapCount(values []interface{}, threshold int64) interface{} {
+	var times int64Slice
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		times = append(times, v.(int64Slice)...)
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	sort.Sort(times)
+
+	var n int64
+	for i := 1; i < len(times); i++ {
+		if times[i]-times[i-1] > threshold {
+			n++
+		}
+	}
+	return n
+}
+
+// ReduceTimeAbove computes the fraction of the time between the first and last values
+// that the values, interpolated linearly between points, are above the threshold.  A single
+// value is above the threshold all or none of the time.
+func ReduceTimeAbove(values []interface{}, threshold float64) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) == 0 {
+		return nil
+	}
+
+	span := a[len(a)-1].Time - a[0].Time
+	if span == 0 {
+		if a[0].Value > threshold {
+			return 1.0
+		}
+		return 0.0
+	}
+
+	var above float64
+	for i := 1; i < len(a); i++ {
+		prev, cur := a[i-1], a[i]
+		dt := float64(cur.Time - prev.Time)
+		switch {
+		case prev.Value > threshold && cur.Value > threshold:
+			above += dt
+		case prev.Value > threshold:
+			// Falls below the threshold where the line between the values crosses it.
+			above += dt * (prev.Value - threshold) / (prev.Value - cur.Value)
+		case cur.Value > threshold:
+			above += dt * (cur.Value - threshold) / (cur.Value - prev.Value)
+		}
+	}
+	return above / float64(span)
+}
+
+// ReduceEWMA computes the exponentially weighted moving average at each value, where
+// alpha is the weight of the latest value.  The average starts at the first value, and
+// only the average is kept as the values are read in time order.
+func ReduceEWMA(values []interface{}, alpha float64) interface{} {
+	var points PositionPoints
+	var avg float64
+	eachTimeValue(values, func(v timeValue) {
+		if len(points) == 0 {
+			avg = v.Value
+		}
+		avg = alpha*v.Value + (1-alpha)*avg
+		points = append(points, PositionPoint{Time: v.Time, Value: avg})
+	})
+	if len(points) == 0 {
+		return nil
+	}
+	return points
+}
+
+// ReduceZScore computes the number of standard deviations each value is from the mean of
+// the values.  There are no scores if the values don't vary.
+func ReduceZScore(values []interface{}) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) < 2 {
+		return nil
+	}
+
+	// Welford's method computes the mean and variance in a single pass.
+	var mean, m2 float64
+	for i, v := range a {
+		d := v.Value - mean
+		mean += d / float64(i+1)
+		m2 += d * (v.Value - mean)
+	}
+	stddev := math.Sqrt(m2 / float64(len(a)-1))
+	if stddev == 0 {
+		return nil
+	}
+
+	points := make(PositionPoints, len(a))
+	for i, v := range a {
+		points[i] = PositionPoint{Time: v.Time, Value: (v.Value - mean) / stddev}
+	}
+	return points
+}
+
+// reduceRawOutputs merges the values output by MapRawQuery for each series into a single
+// time ordered set, keeping values of any type.
+func reduceRawOutputs(values []interface{}) rawOutputs {
+	var a rawOutputs
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		a = append(a, v.([]*rawQueryMapOutput)...)
+	}
+	sort.Stable(a)
+	return a
+}
+
+// ReducePostGapFirst returns the values following gaps between consecutive values longer
+// than the threshold, such as the first value after a sensor stops reporting.
+func ReducePostGapFirst(values []interface{}, threshold int64) interface{} {
+	a := reduceRawOutputs(values)
+
+	var points PositionPoints
+	for i := 1; i < len(a); i++ {
+		if a[i].Time-a[i-1].Time > threshold {
+			points = append(points, PositionPoint{Time: a[i].Time, Value: a[i].Values})
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	return points
+}
+
+// MapEndpoints collects the first and last numeric values, in the format output by
+// MapRawQuery, for aggregates comparing them.
+func MapEndpoints(input *MapInput) interface{} {
+	var out []*rawQueryMapOutput
+	for _, item := range input.Items {
+		if _, _, ok := decodeValueAndNumberType(item.Value); !ok {
+			continue
+		}
+		// Items are in time order, so the latest value replaces the last.
+		o := &rawQueryMapOutput{item.Timestamp, item.Value}
+		if len(out) < 2 {
+			out = append(out, o)
+		} else {
+			out[1] = o
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// ReducePercentChange computes the change from the first to the last value, as a
+// percentage of the first value.  There is no change from a first value of zero.
+func ReducePercentChange(values []interface{}) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) == 0 {
+		return nil
+	}
+	first, last := a[0].Value, a[len(a)-1].Value
+	if first == 0 {
+		return nil
+	}
+	return (last - first) / first * 100
+}
+
+// ReduceNth returns the value at the offset n, in time order, where negative offsets count
+// back from the last value.  There is no value if the offset is out of range.
+func ReduceNth(values []interface{}, n int) interface{} {
+	a := reduceRawOutputs(values)
+	if n < 0 {
+		n += len(a)
+	}
+	if n < 0 || n >= len(a) {
+		return nil
+	}
+	return a[n].Values
+}
+
+// reduceFrequencies counts the number of times each value output by MapEcho occurs, and
+// the number of values.
+func reduceFrequencies(values []interface{}) (map[interface{}]int64, int64) {
+	counts := make(map[interface{}]int64)
+	var n int64
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, val := range v.([]interface{}) {
+			counts[val]++
+			n++
+		}
+	}
+	return counts, n
+}
+
+// ReduceModeCount computes the number of times the most common value occurs.
+func ReduceModeCount(values []interface{}) interface{} {
+	counts, n := reduceFrequencies(values)
+	if n == 0 {
+		return nil
+	}
+
+	var max int64
+	for _, count := range counts {
+		if count > max {
+			max = count
+		}
+	}
+	return max
+}
+
+// ReduceEntropy computes the Shannon entropy, in bits, of the distribution of the values.
+func ReduceEntropy(values []interface{}) interface{} {
+	counts, n := reduceFrequencies(values)
+	if n == 0 {
+		return nil
+	}
+
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// ReduceAbsDiffSum computes the sum of the absolute differences between consecutive
+// values, a measure of how much the values move.
+func ReduceAbsDiffSum(values []interface{}) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) < 2 {
+		return nil
+	}
+
+	var sum float64
+	for i := 1; i < len(a); i++ {
+		sum += math.Abs(a[i].Value - a[i-1].Value)
+	}
+	return sum
+}
+
+// ReduceLongestIncreasingRun computes the number of values in the longest run of
+// consecutive values that each increase on the previous one.
+func ReduceLongestIncreasingRun(values []interface{}) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) == 0 {
+		return nil
+	}
+
+	longest, run := int64(1), int64(1)
+	for i := 1; i < len(a); i++ {
+		if a[i].Value > a[i-1].Value {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+	return longest
+}
+
+// crossingsMapOutput is the number of times the values of an interval crossed the
+// threshold, and the sides of it of the first and last values not equal to it, for
+// crossings().  A side is 1 above the threshold, -1 below it, and 0 if there is none.
+type crossingsMapOutput struct {
+	Count     int64
+	Time      int64 // Time of the first value.
+	FirstSide int
+	LastSide  int
+}
+
+// crossingSide returns the side of the threshold v is on.
+func crossingSide(v, threshold float64) int {
+	switch {
+	case v > threshold:
+		return 1
+	case v < threshold:
+		return -1
+	}
+	return 0
+}
+
+// mapItems sorts the items of a MapInput by time.
+type mapItems []MapItem
+
+func (a mapItems) Len() int           { return len(a) }
+func (a mapItems) Less(i, j int) bool { return a[i].Timestamp < a[j].Timestamp }
+func (a mapItems) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// MapCrossings counts the number of times the numeric values of the interval cross the
+// threshold, keeping only the side of the last value not equal to it.  Items are sorted
+// by time first if they aren't in time order.
+func MapCrossings(input *MapInput, threshold float64) interface{} {
+	items := input.Items
+	for i := 1; i < len(items); i++ {
+		if items[i].Timestamp < items[i-1].Timestamp {
+			items = append([]MapItem(nil), items...)
+			sort.Stable(mapItems(items))
+			break
+		}
+	}
+
+	var out *crossingsMapOutput
+	for _, item := range items {
+		v, _, ok := decodeValueAndNumberType(item.Value)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = &crossingsMapOutput{Time: item.Timestamp}
+		}
+
+		side := crossingSide(v, threshold)
+		if side == 0 {
+			continue
+		}
+		if out.FirstSide == 0 {
+			out.FirstSide = side
+		} else if side != out.LastSide {
+			out.Count++
+		}
+		out.LastSide = side
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// crossingsMapOutputs sorts the outputs of MapCrossings by the time of their first value.
+type crossingsMapOutputs []*crossingsMapOutput
+
+func (a crossingsMapOutputs) Len() int           { return len(a) }
+func (a crossingsMapOutputs) Less(i, j int) bool { return a[i].Time < a[j].Time }
+func (a crossingsMapOutputs) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// ReduceCrossings computes the number of times the values cross the threshold, from below
+// to above it or from above to below it.  Values equal to the threshold don't cross it.
+// Mappers cover separate times, so their counts are summed in time order, along with a
+// crossing wherever one ends on the other side of the threshold to where the next begins.
+func ReduceCrossings(values []interface{}) interface{} {
+	var a crossingsMapOutputs
+	for _, v := range values {
+		if v != nil {
+			a = append(a, v.(*crossingsMapOutput))
+		}
+	}
+	if len(a) == 0 {
+		return nil
+	}
+	sort.Stable(a)
+
+	var n int64
+	var side int
+	for _, o := range a {
+		n += o.Count
+		if o.FirstSide == 0 {
+			continue
+		}
+		if side != 0 && o.FirstSide != side {
+			n++
+		}
+		side = o.LastSide
+	}
+	return n
+}
+
+// ReduceMovingExtreme computes the minimum, or the maximum if max is set, of each window of
+// n consecutive values, at the time of the window's last value.
+func ReduceMovingExtreme(values []interface{}, n int, max bool) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) < n {
+		return nil
+	}
+
+	// The window's extreme is at the front of a queue of the indexes of the values that may
+	// become the extreme as the window moves, so each value is added and removed once.
+	var queue []int
+	points := make(PositionPoints, 0, len(a)-n+1)
+	for i, v := range a {
+		for len(queue) > 0 {
+			last := a[queue[len(queue)-1]].Value
+			if (max && last > v.Value) || (!max && last < v.Value) {
+				break
+			}
+			queue = queue[:len(queue)-1]
+		}
+		queue = append(queue, i)
+		if queue[0] <= i-n {
+			queue = queue[1:]
+		}
+		if i >= n-1 {
+			points = append(points, PositionPoint{Time: v.Time, Value: a[queue[0]].Value})
+		}
+	}
+	return points
+}
+
+// autocorrMapOutput is the sums of an interval's values needed for autocorr(), along
+// with its first and last values, so consecutive intervals can be combined.
+type autocorrMapOutput struct {
+	Count       int64
+	Sum         float64
+	SumSquares  float64
+	SumProducts float64 // Sum of the products of each value and the one before it.
+	First       float64
+	Last        float64
+	Time        int64 // Time of the first value.
+}
+
+// MapAutocorr sums the numeric values of the interval, their squares, and the products of
+// consecutive values.  Items are sorted by time first if they aren't in time order.
+func MapAutocorr(input *MapInput) interface{} {
+	items := input.Items
+	for i := 1; i < len(items); i++ {
+		if items[i].Timestamp < items[i-1].Timestamp {
+			items = append([]MapItem(nil), items...)
+			sort.Stable(mapItems(items))
+			break
+		}
+	}
+
+	var out *autocorrMapOutput
+	for _, item := range items {
+		v, _, ok := decodeValueAndNumberType(item.Value)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = &autocorrMapOutput{First: v, Time: item.Timestamp}
+		} else {
+			out.SumProducts += v * out.Last
+		}
+		out.Count++
+		out.Sum += v
+		out.SumSquares += v * v
+		out.Last = v
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// autocorrMapOutputs sorts the outputs of MapAutocorr by the time of their first value.
+type autocorrMapOutputs []*autocorrMapOutput
+
+func (a autocorrMapOutputs) Len() int           { return len(a) }
+func (a autocorrMapOutputs) Less(i, j int) bool { return a[i].Time < a[j].Time }
+func (a autocorrMapOutputs) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// ReduceAutocorr computes the correlation of consecutive values, the autocorrelation at a
+// lag of one value.  There is none for fewer than two values or values that don't vary.
+// Mappers cover separate times, so their sums are combined in time order, with the last
+// value of each and the first of the next as consecutive values.
+func ReduceAutocorr(values []interface{}) interface{} {
+	var a autocorrMapOutputs
+	for _, v := range values {
+		if v != nil {
+			a = append(a, v.(*autocorrMapOutput))
+		}
+	}
+	if len(a) == 0 {
+		return nil
+	}
+	sort.Stable(a)
+
+	total := autocorrMapOutput{First: a[0].First, Last: a[len(a)-1].Last}
+	for i, o := range a {
+		total.Count += o.Count
+		total.Sum += o.Sum
+		total.SumSquares += o.SumSquares
+		total.SumProducts += o.SumProducts
+		if i > 0 {
+			total.SumProducts += a[i-1].Last * o.First
+		}
+	}
+	if total.Count < 2 {
+		return nil
+	}
+
+	// Expand the sums of the deviations from the mean.  Every value but the last is the
+	// earlier of a consecutive pair, and every value but the first the later.
+	n := float64(total.Count)
+	mean := total.Sum / n
+	variance := total.SumSquares - n*mean*mean
+	cov := total.SumProducts - mean*(2*total.Sum-total.First-total.Last) + (n-1)*mean*mean
+
+	// Rounding leaves a little variance in values that don't vary.
+	if variance <= total.SumSquares*1e-12 {
+		return nil
+	}
+	return cov / variance
+}
+
+// ReduceTimeWeightedStddev computes the standard deviation of the values, each weighted by
+// the time it represents: half the time since the previous value and half the time until
+// the next.  There is none for fewer than two values or values written at the same time.
+func ReduceTimeWeightedStddev(values []interface{}) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) < 2 {
+		return nil
+	}
+	span := float64(a[len(a)-1].Time - a[0].Time)
+	if span == 0 {
+		return nil
+	}
+
+	weights := make([]float64, len(a))
+	for i := 1; i < len(a); i++ {
+		half := float64(a[i].Time-a[i-1].Time) / 2
+		weights[i-1] += half
+		weights[i] += half
+	}
+
+	// The weights total the span of the values.
+	var mean float64
+	for i, v := range a {
+		mean += weights[i] * v.Value
+	}
+	mean /= span
+
+	var variance float64
+	for i, v := range a {
+		d := v.Value - mean
+		variance += weights[i] * d * d
+	}
+	return math.Sqrt(variance / span)
+}
+
+// ReduceNormalize scales each value to between 0, for the minimum, and 1, for the maximum.
+// Values that don't vary are all 0.
+func ReduceNormalize(values []interface{}) interface{} {
+	a := reduceTimeValues(values)
+	if len(a) == 0 {
+		return nil
+	}
+
+	min, max := a[0].Value, a[0].Value
+	for _, v := range a[1:] {
+		min = math.Min(min, v.Value)
+		max = math.Max(max, v.Value)
+	}
+
+	points := make(PositionPoints, len(a))
+	for i, v := range a {
+		var scaled float64
+		if max > min {
+			scaled = (v.Value - min) / (max - min)
+		}
+		points[i] = PositionPoint{Time: v.Time, Value: scaled}
+	}
+	return points
+}
+
+// stateDurationMapOutput is the values of a series, in the format output by MapRawQuery,
+// and the end of their interval, until which the last value holds its state.
+type stateDurationMapOutput struct {
+	Values []*rawQueryMapOutput
+	TMax   int64
+}
+
+// MapStateDuration collects the values of the interval, of any type, for state_duration().
+func MapStateDuration(input *MapInput) interface{} {
+	if len(input.Items) == 0 {
+		return nil
+	}
+	return &stateDurationMapOutput{
+		Values: MapRawQuery(input).([]*rawQueryMapOutput),
+		TMax:   input.TMax,
+	}
+}
+
+// stateDurations are the states and durations output by state_duration(), in the order
+// the states were first held.  The executor outputs a row for each.
+type stateDurations []columnValues
+
+// ReduceStateDuration returns the time, in nanoseconds, the series held each state.  A
+// value holds its state until the time of the next value, and the last until the end of
+// the interval.
+func ReduceStateDuration(values []interface{}) interface{} {
+	var a rawOutputs
+	var tmax int64
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*stateDurationMapOutput)
+		a = append(a, val.Values...)
+		if val.TMax > tmax {
+			tmax = val.TMax
+		}
+	}
+	if len(a) == 0 {
+		return columnValues{nil, nil}
+	}
+	sort.Stable(a)
+
+	var result stateDurations
+	index := make(map[interface{}]int)
+	for i, v := range a {
+		j, ok := index[v.Values]
+		if !ok {
+			j = len(result)
+			index[v.Values] = j
+			result = append(result, columnValues{v.Values, int64(0)})
+		}
+
+		end := tmax
+		if i < len(a)-1 {
+			end = a[i+1].Time
+		}
+		if end > v.Time {
+			result[j][1] = result[j][1].(int64) + end - v.Time
+		}
+	}
+	return result
 }
 
 // IsNumeric returns whether a given aggregate can only be run on numeric fields.
 func IsNumeric(c *influxql.Call) bool {
 	switch c.Name {
-	case "count", "first", "last", "distinct":
+	case "count", "first", "last", "distinct", "last_age", "sample_rate", "min_timestamp", "max_timestamp", "coverage", "active_buckets", "gap_count", "post_gap_first", "nth", "mode_count", "entropy", "cardinality", "state_duration", "null_fraction":
 		return false
 	default:
 		return true
@@ -1,6 +1,9 @@
 package tsdb
 
 import (
+	"encoding/json"
+	"math"
+	"math/rand"
 	"reflect"
 	"testing"
 	"time"
@@ -94,6 +97,1248 @@ func TestInitializeMapFuncDerivative(t *testing.T) {
 	}
 }
 
+func TestReduceMeanCount(t *testing.T) {
+	values := []interface{}{
+		&meanMapOutput{Count: 2, Total: 6},
+		nil,
+		&meanMapOutput{Count: 1, Total: 6, ResultType: Int64Type},
+	}
+	if got, exp := ReduceMeanCount(values), (columnValues{4.0, int64(3)}); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("ReduceMeanCount mismatch: got %v, exp %v", got, exp)
+	}
+
+	// Without values each column is nil, so the row still has every column.
+	if got, exp := ReduceMeanCount([]interface{}{nil}), (columnValues{nil, nil}); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("ReduceMeanCount(nil) mismatch: got %v, exp %v", got, exp)
+	}
+}
+
+// Ensure each column of summary() matches the aggregate computing it alone.
+func TestReduceSummary(t *testing.T) {
+	inputs := []*MapInput{
+		{Items: []MapItem{{Timestamp: 1, Value: int64(4)}, {Timestamp: 2, Value: int64(-2)}}},
+		{},
+		{Items: []MapItem{{Timestamp: 3, Value: int64(9)}}},
+	}
+
+	var summaries, counts, mins, maxes, means []interface{}
+	for _, input := range inputs {
+		summaries = append(summaries, MapSummary(input))
+		counts = append(counts, MapCount(input))
+		mins = append(mins, MapMin(input, "value"))
+		maxes = append(maxes, MapMax(input, "value"))
+		means = append(means, MapMean(input))
+	}
+
+	got, ok := ReduceSummary(summaries).(columnValues)
+	if !ok || len(got) != 4 {
+		t.Fatalf("ReduceSummary mismatch: got %v, exp 4 columns", got)
+	}
+	if exp := ReduceSum(counts).(float64); float64(got[0].(int64)) != exp {
+		t.Errorf("count mismatch: got %v, exp %v", got[0], exp)
+	}
+	if exp := ReduceMin(mins).(PositionPoint).Value; got[1] != exp {
+		t.Errorf("min mismatch: got %v, exp %v", got[1], exp)
+	}
+	if exp := ReduceMax(maxes).(PositionPoint).Value; got[2] != exp {
+		t.Errorf("max mismatch: got %v, exp %v", got[2], exp)
+	}
+	if exp := ReduceMean(means); got[3] != exp {
+		t.Errorf("mean mismatch: got %v, exp %v", got[3], exp)
+	}
+
+	if got, exp := ReduceSummary([]interface{}{nil}), (columnValues{nil, nil, nil, nil}); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("ReduceSummary(nil) mismatch: got %v, exp %v", got, exp)
+	}
+}
+
+func TestReduceCoverage(t *testing.T) {
+	minute := int64(time.Minute)
+	tests := []struct {
+		name   string
+		inputs []*MapInput
+		exp    interface{}
+	}{
+		{
+			name: "full",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: 1.0}, {Timestamp: 30 * int64(time.Second), Value: 1.0}, {Timestamp: minute, Value: 1.0}}},
+				{Items: []MapItem{{Timestamp: 2 * minute, Value: 1.0}}},
+			},
+			exp: 1.0,
+		},
+		{
+			name: "partial",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: 1.0}, {Timestamp: minute, Value: 1.0}}},
+				{Items: []MapItem{{Timestamp: minute + 1, Value: 1.0}, {Timestamp: 3 * minute, Value: 1.0}}},
+			},
+			exp: 0.75,
+		},
+		{
+			name:   "empty",
+			inputs: []*MapInput{{}},
+			exp:    nil,
+		},
+	}
+
+	for _, test := range tests {
+		var values []interface{}
+		for _, input := range test.inputs {
+			values = append(values, MapBuckets(input, minute))
+		}
+		if got := ReduceCoverage(values); got != test.exp {
+			t.Errorf("%s: ReduceCoverage mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceCardinality(t *testing.T) {
+	mapSeries := func(tags ...map[string]string) interface{} {
+		input := &MapInput{}
+		for i, t := range tags {
+			input.Items = append(input.Items, MapItem{Timestamp: int64(i), Value: 1.0, Tags: t})
+		}
+		return MapSeriesKeys(input)
+	}
+
+	values := []interface{}{
+		mapSeries(map[string]string{"host": "a", "region": "west"}, map[string]string{"host": "a", "region": "west"}),
+		mapSeries(map[string]string{"host": "b", "region": "west"}),
+		nil,
+		// The same series, read from another shard.
+		mapSeries(map[string]string{"region": "west", "host": "a"}),
+		mapSeries(map[string]string{"host": "a"}),
+		mapSeries(map[string]string{}),
+	}
+	if got := ReduceCardinality(values); got != int64(4) {
+		t.Errorf("ReduceCardinality mismatch: got %v, exp 4", got)
+	}
+
+	if got := ReduceCardinality([]interface{}{mapSeries(), nil}); got != nil {
+		t.Errorf("ReduceCardinality mismatch: got %v, exp nil", got)
+	}
+}
+
+func TestReduceGapCount(t *testing.T) {
+	minute := int64(time.Minute)
+	tests := []struct {
+		name   string
+		inputs []*MapInput
+		exp    interface{}
+	}{
+		{
+			name: "no gaps",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: 1.0}, {Timestamp: minute, Value: 1.0}, {Timestamp: 2 * minute, Value: 1.0}}},
+			},
+			exp: int64(0),
+		},
+		{
+			name: "one large gap",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: 1.0}, {Timestamp: minute, Value: 1.0}}},
+				{Items: []MapItem{{Timestamp: 30 * minute, Value: "up"}}},
+			},
+			exp: int64(1),
+		},
+		{
+			name: "several small gaps",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: 1.0}, {Timestamp: 4 * minute, Value: 1.0}, {Timestamp: 8 * minute, Value: 1.0}}},
+				{Items: []MapItem{{Timestamp: 2 * minute, Value: 1.0}, {Timestamp: 5 * minute, Value: 1.0}}},
+			},
+			exp: int64(0),
+		},
+		{
+			name: "gap at threshold",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: 1.0}, {Timestamp: 5 * minute, Value: 1.0}, {Timestamp: 11 * minute, Value: 1.0}}},
+			},
+			exp: int64(1),
+		},
+		{
+			name:   "empty",
+			inputs: []*MapInput{{}},
+			exp:    nil,
+		},
+	}
+
+	for _, test := range tests {
+		var values []interface{}
+		for _, input := range test.inputs {
+			values = append(values, MapTimestamps(input))
+		}
+		if got := ReduceGapCount(values, 5*minute); got != test.exp {
+			t.Errorf("%s: ReduceGapCount mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceLastAge(t *testing.T) {
+	now := time.Unix(100, 0)
+	values := []interface{}{
+		MapMaxTimestamp(&MapInput{Items: []MapItem{{Timestamp: int64(10 * time.Second), Value: 1.0}, {Timestamp: int64(40 * time.Second), Value: 1.0}}}),
+		MapMaxTimestamp(&MapInput{}),
+		MapMaxTimestamp(&MapInput{Items: []MapItem{{Timestamp: int64(70 * time.Second), Value: "up"}}}),
+	}
+	if got, exp := ReduceLastAge(values, now), int64(30*time.Second); got != exp {
+		t.Fatalf("ReduceLastAge mismatch: got %v, exp %v", got, exp)
+	}
+
+	if got := ReduceLastAge([]interface{}{nil}, now); got != nil {
+		t.Fatalf("ReduceLastAge(nil) mismatch: got %v, exp nil", got)
+	}
+}
+
+// Ensure last_age() measures ages from the time the query runs.
+func TestReduceLastAge_Clock(t *testing.T) {
+	defer func(fn func() time.Time) { now = fn }(now)
+	now = func() time.Time { return time.Unix(100, 0) }
+
+	fn, err := initializeReduceFunc(&influxql.Call{Name: "last_age", Args: []influxql.Expr{&influxql.VarRef{Val: "value"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clock is read once, so every bucket is aged from the same time.
+	now = func() time.Time { return time.Unix(200, 0) }
+	values := []interface{}{
+		MapMaxTimestamp(&MapInput{Items: []MapItem{{Timestamp: int64(75 * time.Second), Value: 1.0}}}),
+	}
+	if got, exp := fn(values), int64(25*time.Second); got != exp {
+		t.Fatalf("last_age mismatch: got %v, exp %v", got, exp)
+	}
+}
+
+// mapRawValues returns the output of MapRawQuery for a series with the values written at
+// the given times, in the order given.
+func mapRawValues(times []int64, values ...interface{}) interface{} {
+	input := &MapInput{}
+	for i, v := range values {
+		input.Items = append(input.Items, MapItem{Timestamp: times[i], Value: v})
+	}
+	return MapRawQuery(input)
+}
+
+func TestReduceTimeAbove(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{nil}, exp: nil},
+		{name: "always above", values: []interface{}{mapRawValues([]int64{0, 10, 20}, 150.0, int64(200), 101.0)}, exp: 1.0},
+		{name: "always below", values: []interface{}{mapRawValues([]int64{0, 10, 20}, 50.0, int64(100), 0.0)}, exp: 0.0},
+		// Crosses 100 a quarter of the way from 50 at 0 to 250 at 20.
+		{name: "single crossing", values: []interface{}{mapRawValues([]int64{0, 20}, 50.0, 250.0)}, exp: 0.75},
+		{
+			// Above from 15 to 40, but for touching the threshold at 30, as the values interleave by time.
+			name: "interleaved",
+			values: []interface{}{
+				mapRawValues([]int64{0, 20, 40}, 0.0, 200.0, 200.0),
+				mapRawValues([]int64{10, 30}, 0.0, 100.0),
+			},
+			exp: 0.625,
+		},
+		{name: "single value", values: []interface{}{mapRawValues([]int64{5}, 101.0)}, exp: 1.0},
+	}
+
+	for _, test := range tests {
+		if got := ReduceTimeAbove(test.values, 100); got != test.exp {
+			t.Errorf("%s: ReduceTimeAbove mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceZScore(t *testing.T) {
+	// The values have a mean of 5 and, like stddev(), a sample standard deviation of sqrt(32/7).
+	values := []interface{}{
+		mapRawValues([]int64{1, 2, 3, 4}, 2.0, int64(4), 4.0, int64(4)),
+		mapRawValues([]int64{5, 6, 7, 8}, 5.0, 5.0, int64(7), 9.0),
+	}
+	stddev := math.Sqrt(32.0 / 7)
+
+	points, ok := ReduceZScore(values).(PositionPoints)
+	if !ok {
+		t.Fatalf("ReduceZScore mismatch: got %v", ReduceZScore(values))
+	}
+	exp := []float64{-3, -1, -1, -1, 0, 0, 2, 4}
+	if len(points) != len(exp) {
+		t.Fatalf("ReduceZScore mismatch: got %d points, exp %d", len(points), len(exp))
+	}
+	for i, p := range points {
+		if p.Time != int64(i+1) {
+			t.Errorf("point %d: time mismatch: got %d, exp %d", i, p.Time, i+1)
+		}
+		if v := p.Value.(float64); math.Abs(v-exp[i]/stddev) > 1e-9 {
+			t.Errorf("point %d: value mismatch: got %v, exp %v", i, v, exp[i]/stddev)
+		}
+	}
+
+	// Values that don't vary have no scores.
+	if got := ReduceZScore([]interface{}{mapRawValues([]int64{1, 2}, 3.0, 3.0)}); got != nil {
+		t.Errorf("ReduceZScore mismatch: got %v, exp nil", got)
+	}
+	if got := ReduceZScore([]interface{}{mapRawValues([]int64{1}, 3.0)}); got != nil {
+		t.Errorf("ReduceZScore mismatch: got %v, exp nil", got)
+	}
+}
+
+func TestReducePostGapFirst(t *testing.T) {
+	minute := int64(time.Minute)
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{nil}, exp: nil},
+		{name: "none", values: []interface{}{mapRawValues([]int64{0, minute, 2 * minute}, 1.0, 2.0, 3.0)}, exp: nil},
+		{
+			name:   "one",
+			values: []interface{}{mapRawValues([]int64{0, minute, 10 * minute}, 1.0, 2.0, "up")},
+			exp:    PositionPoints{{Time: 10 * minute, Value: "up"}},
+		},
+		{
+			// Values of separate mappers interleave by time before gaps are found.
+			name: "several",
+			values: []interface{}{
+				mapRawValues([]int64{0, 10 * minute, 30 * minute}, 1.0, 2.0, 3.0),
+				mapRawValues([]int64{minute, 20 * minute}, int64(4), int64(5)),
+			},
+			exp: PositionPoints{
+				{Time: 10 * minute, Value: 2.0},
+				{Time: 20 * minute, Value: int64(5)},
+				{Time: 30 * minute, Value: 3.0},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if got := ReducePostGapFirst(test.values, 5*minute); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: ReducePostGapFirst mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReducePercentChange(t *testing.T) {
+	mapEndpoints := func(times []int64, values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: times[i], Value: v})
+		}
+		return MapEndpoints(input)
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{mapEndpoints(nil)}, exp: nil},
+		{name: "positive", values: []interface{}{mapEndpoints([]int64{1, 2, 3}, 50.0, 10.0, int64(75))}, exp: 50.0},
+		{name: "negative", values: []interface{}{mapEndpoints([]int64{1, 2, 3}, int64(200), "down", 50.0)}, exp: -75.0},
+		{name: "zero base", values: []interface{}{mapEndpoints([]int64{1, 2}, 0.0, 10.0)}, exp: nil},
+		{
+			// The endpoints of separate mappers are compared by time.
+			name: "several mappers",
+			values: []interface{}{
+				mapEndpoints([]int64{2, 3}, 1.0, 2.0),
+				nil,
+				mapEndpoints([]int64{1, 4}, 4.0, 5.0),
+			},
+			exp: 25.0,
+		},
+	}
+
+	for _, test := range tests {
+		if got := ReducePercentChange(test.values); got != test.exp {
+			t.Errorf("%s: ReducePercentChange mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceNth(t *testing.T) {
+	// Values of separate mappers interleave by time.
+	values := []interface{}{
+		mapRawValues([]int64{1, 3}, 10.0, "c"),
+		nil,
+		mapRawValues([]int64{2, 4}, int64(20), true),
+	}
+
+	tests := []struct {
+		n   int
+		exp interface{}
+	}{
+		{n: 0, exp: 10.0},
+		{n: 2, exp: "c"},
+		{n: -1, exp: true},
+		{n: -4, exp: 10.0},
+		{n: 4, exp: nil},
+		{n: -5, exp: nil},
+	}
+
+	for _, test := range tests {
+		if got := ReduceNth(values, test.n); got != test.exp {
+			t.Errorf("%d: ReduceNth mismatch: got %v, exp %v", test.n, got, test.exp)
+		}
+	}
+}
+
+func TestReduceModeCount(t *testing.T) {
+	mapEcho := func(values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: int64(i), Value: v})
+		}
+		return MapEcho(input)
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{mapEcho(), nil}, exp: nil},
+		{name: "clear mode", values: []interface{}{mapEcho(1.0, "a", 1.0), mapEcho(int64(1), 1.0, 2.0)}, exp: int64(3)},
+		{name: "tie", values: []interface{}{mapEcho("a", "b", "a"), mapEcho("b", true)}, exp: int64(2)},
+		{name: "uniform", values: []interface{}{mapEcho(1.0, 2.0, 3.0), mapEcho(4.0)}, exp: int64(1)},
+	}
+
+	for _, test := range tests {
+		if got := ReduceModeCount(test.values); got != test.exp {
+			t.Errorf("%s: ReduceModeCount mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceAbsDiffSum(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{nil}, exp: nil},
+		{name: "single", values: []interface{}{mapRawValues([]int64{1}, 5.0)}, exp: nil},
+		// The sum of a monotonic series is the difference between the last and first values.
+		{name: "monotonic", values: []interface{}{mapRawValues([]int64{1, 2, 3, 4}, 2.0, int64(3), 7.5, int64(10))}, exp: 8.0},
+		{name: "oscillating", values: []interface{}{mapRawValues([]int64{1, 2, 3, 4}, 0.0, 5.0, -5.0, 5.0)}, exp: 25.0},
+		{
+			// Values of separate mappers interleave by time before they're compared.
+			name: "interleaved",
+			values: []interface{}{
+				mapRawValues([]int64{1, 3}, 0.0, 0.0),
+				mapRawValues([]int64{2, 4}, 1.0, 1.0),
+			},
+			exp: 3.0,
+		},
+	}
+
+	for _, test := range tests {
+		if got := ReduceAbsDiffSum(test.values); got != test.exp {
+			t.Errorf("%s: ReduceAbsDiffSum mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceEntropy(t *testing.T) {
+	mapEcho := func(values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: int64(i), Value: v})
+		}
+		return MapEcho(input)
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{mapEcho(), nil}, exp: nil},
+		{name: "single value", values: []interface{}{mapEcho("a", "a"), mapEcho("a")}, exp: 0.0},
+		{name: "uniform two values", values: []interface{}{mapEcho(1.0, 2.0), mapEcho(2.0, 1.0)}, exp: 1.0},
+		{name: "uniform four values", values: []interface{}{mapEcho("a", "b", "c"), mapEcho(true)}, exp: 2.0},
+		// A quarter and three quarters: -(0.25*log2(0.25) + 0.75*log2(0.75)).
+		{name: "skewed", values: []interface{}{mapEcho(int64(1), int64(2), int64(2), int64(2))}, exp: 0.5 + 0.75*math.Log2(4.0/3)},
+	}
+
+	for _, test := range tests {
+		got := ReduceEntropy(test.values)
+		if test.exp == nil {
+			if got != nil {
+				t.Errorf("%s: ReduceEntropy mismatch: got %v, exp nil", test.name, got)
+			}
+			continue
+		}
+		// The order of summing the values' terms varies.
+		if v, ok := got.(float64); !ok || math.Abs(v-test.exp.(float64)) > 1e-12 {
+			t.Errorf("%s: ReduceEntropy mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceLongestIncreasingRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{nil}, exp: nil},
+		{name: "monotonic", values: []interface{}{mapRawValues([]int64{1, 2, 3, 4}, 1.0, int64(2), 2.5, int64(3))}, exp: int64(4)},
+		{name: "flat", values: []interface{}{mapRawValues([]int64{1, 2, 3}, 5.0, 5.0, 5.0)}, exp: int64(1)},
+		{name: "zig-zag", values: []interface{}{mapRawValues([]int64{1, 2, 3, 4, 5, 6, 7}, 1.0, 3.0, 2.0, 4.0, 6.0, 8.0, 0.0)}, exp: int64(4)},
+		{
+			// Values of separate mappers interleave by time before they're compared.
+			name: "interleaved",
+			values: []interface{}{
+				mapRawValues([]int64{1, 3, 5}, 1.0, 3.0, 0.0),
+				mapRawValues([]int64{2, 4}, 2.0, 4.0),
+			},
+			exp: int64(4),
+		},
+	}
+
+	for _, test := range tests {
+		if got := ReduceLongestIncreasingRun(test.values); got != test.exp {
+			t.Errorf("%s: ReduceLongestIncreasingRun mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceMAD(t *testing.T) {
+	mapValues := func(values ...float64) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: int64(i), Value: v})
+		}
+		return MapStddev(input)
+	}
+
+	if got := ReduceMAD([]interface{}{mapValues(), nil}); got != nil {
+		t.Errorf("ReduceMAD mismatch: got %v, exp nil", got)
+	}
+
+	// The median is 3, and the median of the deviations 0, 1, 1, 2, 6 is 1.
+	values := []interface{}{mapValues(1, 2, 3), mapValues(4, 9)}
+	if got := ReduceMAD(values); got != 1.0 {
+		t.Errorf("ReduceMAD mismatch: got %v, exp 1", got)
+	}
+
+	// An outlier moves the standard deviation much further than the median absolute deviation.
+	outlier := []interface{}{mapValues(1, 2, 3), mapValues(4, 1000)}
+	mad, stddev := ReduceMAD(outlier).(float64), ReduceStddev(outlier).(float64)
+	if mad != 1.0 {
+		t.Errorf("ReduceMAD mismatch: got %v, exp 1", mad)
+	}
+	if before := ReduceStddev(values).(float64); stddev < 100*before {
+		t.Errorf("stddev %v unexpectedly close to %v", stddev, before)
+	}
+}
+
+// Ensure first() and last() with an ordering field select by it rather than by time.
+func TestReduceOrderedSelect(t *testing.T) {
+	mapOrdered := func(last bool, times []int64, seqs []interface{}, values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			fields := map[string]interface{}{"value": v}
+			if seqs[i] != nil {
+				fields["seq"] = seqs[i]
+			}
+			input.Items = append(input.Items, MapItem{Timestamp: times[i], Value: v, Fields: fields})
+		}
+		return MapOrderedSelect(input, "value", "seq", last)
+	}
+
+	for _, test := range []struct {
+		name string
+		last bool
+		exp  PositionPoint
+	}{
+		// The lowest seq is in the second mapper, on a later point than the first's.
+		{name: "first", exp: PositionPoint{Time: 6, Value: 60.0}},
+		// The highest seq is on two points at the same time, so the greater value wins.
+		{name: "last", last: true, exp: PositionPoint{Time: 2, Value: 25.0}},
+	} {
+		values := []interface{}{
+			mapOrdered(test.last, []int64{1, 2, 2, 3}, []interface{}{int64(5), 9.0, int64(9), nil}, 10.0, 20.0, 25.0, 30.0),
+			nil,
+			mapOrdered(test.last, []int64{6, 7}, []interface{}{int64(1), "a"}, 60.0, 70.0),
+		}
+		got, ok := ReduceOrderedSelect(values, test.last).(PositionPoint)
+		if !ok || got.Time != test.exp.Time || got.Value != test.exp.Value {
+			t.Errorf("%s: ReduceOrderedSelect mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+
+	// Points without the ordering field aren't selected.
+	if got := ReduceOrderedSelect([]interface{}{mapOrdered(false, []int64{1}, []interface{}{nil}, 1.0)}, false); got != nil {
+		t.Errorf("ReduceOrderedSelect mismatch: got %v, exp nil", got)
+	}
+}
+
+func TestReduceNearest(t *testing.T) {
+	mapNearest := func(target float64, times []int64, values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: times[i], Value: v})
+		}
+		return MapNearest(input, target)
+	}
+
+	tests := []struct {
+		name   string
+		target float64
+		exp    interface{}
+	}{
+		{name: "below", target: -100, exp: int64(1)},
+		{name: "within", target: 6.9, exp: 7.0},
+		{name: "above", target: 100, exp: 20.0},
+		// 4 and 6 are as close to 5, and 6 was written first.
+		{name: "tie", target: 5, exp: int64(6)},
+	}
+
+	for _, test := range tests {
+		values := []interface{}{
+			mapNearest(test.target, []int64{3, 4, 5}, 7.0, int64(4), "a"),
+			nil,
+			mapNearest(test.target, []int64{1, 2, 6}, int64(6), int64(1), 20.0),
+		}
+		if got := ReduceNearest(values, test.target); got != test.exp {
+			t.Errorf("%s: ReduceNearest mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+
+	if got := ReduceNearest([]interface{}{mapNearest(1, nil)}, 1); got != nil {
+		t.Errorf("ReduceNearest mismatch: got %v, exp nil", got)
+	}
+}
+
+func TestReduceCrossings(t *testing.T) {
+	mapCrossings := func(times []int64, values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: times[i], Value: v})
+		}
+		return MapCrossings(input, 10)
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{nil, mapCrossings([]int64{1}, "a")}, exp: nil},
+		{name: "none", values: []interface{}{mapCrossings([]int64{1, 2, 3}, 1.0, int64(5), 9.0)}, exp: int64(0)},
+		{name: "oscillation", values: []interface{}{mapCrossings([]int64{1, 2, 3, 4, 5}, 0.0, 20.0, int64(0), 20.0, 0.0)}, exp: int64(4)},
+		{name: "touches", values: []interface{}{mapCrossings([]int64{1, 2, 3, 4}, 0.0, 10.0, int64(5), int64(10))}, exp: int64(0)},
+		{name: "crosses through", values: []interface{}{mapCrossings([]int64{1, 2, 3}, 0.0, 10.0, 20.0)}, exp: int64(1)},
+		{name: "unordered", values: []interface{}{mapCrossings([]int64{3, 1, 2}, 0.0, 0.0, 20.0)}, exp: int64(2)},
+		{
+			// Mappers are combined in time order, crossing where one ends on the other
+			// side of the threshold to where the next begins.
+			name: "across mappers",
+			values: []interface{}{
+				mapCrossings([]int64{5, 6}, 20.0, 0.0),
+				nil,
+				mapCrossings([]int64{3, 4}, 10.0, 10.0),
+				mapCrossings([]int64{1, 2}, 0.0, 20.0),
+			},
+			exp: int64(2),
+		},
+	}
+
+	for _, test := range tests {
+		if got := ReduceCrossings(test.values); got != test.exp {
+			t.Errorf("%s: ReduceCrossings mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceIQR(t *testing.T) {
+	mapEcho := func(values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: int64(i), Value: v})
+		}
+		return MapEcho(input)
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "too few", values: []interface{}{mapEcho(1.0, 2.0), mapEcho(int64(3)), nil}, exp: nil},
+		// The 25th percentile of 1 to 8 is 2 and the 75th is 6.
+		{name: "known", values: []interface{}{mapEcho(8.0, 1.0, 3.0, 5.0), mapEcho(int64(2), int64(4), int64(6), 7.0)}, exp: 4.0},
+		// An outlier doesn't move the quartiles.
+		{name: "outlier", values: []interface{}{mapEcho(1000.0, 1.0, 3.0, 5.0), mapEcho(int64(2), int64(4), int64(6), 7.0)}, exp: 4.0},
+	}
+
+	for _, test := range tests {
+		if got := ReduceIQR(test.values); got != test.exp {
+			t.Errorf("%s: ReduceIQR mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceMovingExtreme(t *testing.T) {
+	times := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	data := []float64{5, 3, 8, 8, 1, 9, 2, 7, 7, 4}
+	var values []interface{}
+	for i := range times {
+		// Split the values between two mappers, interleaved by time.
+		if i%2 == 0 {
+			values = append(values, mapRawValues(times[i:i+1], data[i]))
+		} else {
+			values = append(values, mapRawValues(times[i:i+1], int64(data[i])))
+		}
+	}
+
+	for _, max := range []bool{false, true} {
+		for n := 1; n <= len(data)+1; n++ {
+			// Compare against recomputing the extreme of each window.
+			var exp interface{}
+			if n <= len(data) {
+				points := PositionPoints{}
+				for i := n - 1; i < len(data); i++ {
+					extreme := data[i]
+					for _, v := range data[i-n+1 : i] {
+						if (max && v > extreme) || (!max && v < extreme) {
+							extreme = v
+						}
+					}
+					points = append(points, PositionPoint{Time: times[i], Value: extreme})
+				}
+				exp = points
+			}
+
+			if got := ReduceMovingExtreme(values, n, max); !reflect.DeepEqual(got, exp) {
+				t.Errorf("n=%d max=%v: ReduceMovingExtreme mismatch: got %v, exp %v", n, max, got, exp)
+			}
+		}
+	}
+}
+
+func TestReduceAutocorr(t *testing.T) {
+	mapAutocorr := func(times []int64, values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: times[i], Value: v})
+		}
+		return MapAutocorr(input)
+	}
+
+	if got := ReduceAutocorr([]interface{}{mapAutocorr([]int64{1}, 1.0), nil}); got != nil {
+		t.Errorf("ReduceAutocorr mismatch: got %v, exp nil", got)
+	}
+	if got := ReduceAutocorr([]interface{}{mapAutocorr([]int64{1, 2}, 1.0, int64(1))}); got != nil {
+		t.Errorf("ReduceAutocorr mismatch: got %v, exp nil", got)
+	}
+	if got := ReduceAutocorr([]interface{}{mapAutocorr([]int64{1, 2, 3}, 0.1, 0.1, 0.1)}); got != nil {
+		t.Errorf("ReduceAutocorr mismatch: got %v, exp nil", got)
+	}
+
+	// The deviations of 1 to 10 from their mean of 5.5 give 57.75 / 82.5, whether the
+	// values are in one mapper or several, in any order.
+	ramp := []interface{}{
+		mapAutocorr([]int64{6, 8, 7, 9, 10}, 6.0, 8.0, 7.0, 9.0, 10.0),
+		nil,
+		mapAutocorr([]int64{1, 2, 3, 4, 5}, int64(1), int64(2), int64(3), int64(4), int64(5)),
+	}
+	if got := ReduceAutocorr(ramp).(float64); math.Abs(got-0.7) > 1e-9 {
+		t.Errorf("ReduceAutocorr mismatch: got %v, exp 0.7", got)
+	}
+	ramp = []interface{}{mapAutocorr([]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0)}
+	if got := ReduceAutocorr(ramp).(float64); math.Abs(got-0.7) > 1e-9 {
+		t.Errorf("ReduceAutocorr mismatch: got %v, exp 0.7", got)
+	}
+
+	// Independent values are barely correlated.
+	rnd := rand.New(rand.NewSource(1))
+	input := &MapInput{}
+	for i := 0; i < 10000; i++ {
+		input.Items = append(input.Items, MapItem{Timestamp: int64(i), Value: rnd.Float64()})
+	}
+	if got := ReduceAutocorr([]interface{}{MapAutocorr(input)}).(float64); math.Abs(got) > 0.05 {
+		t.Errorf("ReduceAutocorr mismatch: got %v, exp about 0", got)
+	}
+}
+
+func TestReduceTimeWeightedStddev(t *testing.T) {
+	if got := ReduceTimeWeightedStddev([]interface{}{mapRawValues([]int64{1}, 1.0), nil}); got != nil {
+		t.Errorf("ReduceTimeWeightedStddev mismatch: got %v, exp nil", got)
+	}
+	if got := ReduceTimeWeightedStddev([]interface{}{mapRawValues([]int64{1, 1}, 1.0, 2.0)}); got != nil {
+		t.Errorf("ReduceTimeWeightedStddev mismatch: got %v, exp nil", got)
+	}
+
+	// Three zeros sampled densely represent 1.5 of the 10 time units, so the weights are
+	// 0.5, 1, 4.5 and 4, for a mean of 4 and a variance of (6 * 16 + 4 * 36) / 10.
+	values := []interface{}{
+		mapRawValues([]int64{0, 2}, 0.0, int64(0)),
+		mapRawValues([]int64{1, 10}, 0.0, 10.0),
+	}
+	got := ReduceTimeWeightedStddev(values).(float64)
+	if exp := math.Sqrt(24); math.Abs(got-exp) > 1e-9 {
+		t.Errorf("ReduceTimeWeightedStddev mismatch: got %v, exp %v", got, exp)
+	}
+
+	// Unweighted, the dense zeros pull the mean down to 2.5, for a standard deviation of 5.
+	input := &MapInput{Items: []MapItem{{Value: 0.0}, {Value: 0.0}, {Value: 0.0}, {Value: 10.0}}}
+	if stddev := ReduceStddev([]interface{}{MapStddev(input)}).(float64); stddev != 5 {
+		t.Errorf("ReduceStddev mismatch: got %v, exp 5", stddev)
+	}
+}
+
+func TestReduceNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{nil}, exp: nil},
+		{
+			// Values of separate mappers interleave by time.
+			name: "ramp",
+			values: []interface{}{
+				mapRawValues([]int64{1, 3, 5}, 10.0, 20.0, 30.0),
+				mapRawValues([]int64{2, 4}, int64(15), int64(25)),
+			},
+			exp: PositionPoints{
+				{Time: 1, Value: 0.0},
+				{Time: 2, Value: 0.25},
+				{Time: 3, Value: 0.5},
+				{Time: 4, Value: 0.75},
+				{Time: 5, Value: 1.0},
+			},
+		},
+		{
+			name:   "constant",
+			values: []interface{}{mapRawValues([]int64{1, 2}, 7.0, int64(7))},
+			exp:    PositionPoints{{Time: 1, Value: 0.0}, {Time: 2, Value: 0.0}},
+		},
+	}
+
+	for _, test := range tests {
+		if got := ReduceNormalize(test.values); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: ReduceNormalize mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceStateDuration(t *testing.T) {
+	// mapStates returns the output of MapStateDuration for an interval ending at 10.
+	mapStates := func(times []int64, values ...interface{}) interface{} {
+		input := &MapInput{TMax: 10}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: times[i], Value: v})
+		}
+		return MapStateDuration(input)
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{nil}, exp: columnValues{nil, nil}},
+		{
+			// Values of separate mappers interleave by time, and the last state lasts
+			// until the end of the interval.
+			name: "up down",
+			values: []interface{}{
+				mapStates([]int64{0, 4}, true, true),
+				mapStates([]int64{3, 6}, false, false),
+			},
+			exp: stateDurations{{true, int64(5)}, {false, int64(5)}},
+		},
+		{
+			name:   "single",
+			values: []interface{}{mapStates([]int64{2}, "idle")},
+			exp:    stateDurations{{"idle", int64(8)}},
+		},
+	}
+
+	for _, test := range tests {
+		if got := ReduceStateDuration(test.values); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: ReduceStateDuration mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceEWMA(t *testing.T) {
+	// Values of separate mappers interleave by time before they're averaged.
+	values := []interface{}{
+		mapRawValues([]int64{1, 3}, 10.0, int64(20)),
+		nil,
+		mapRawValues([]int64{2, 4}, int64(30), 10.0),
+	}
+
+	// With alpha 0.5: 10, 0.5*30+0.5*10 = 20, 0.5*20+0.5*20 = 20, 0.5*10+0.5*20 = 15.
+	exp := PositionPoints{
+		{Time: 1, Value: 10.0},
+		{Time: 2, Value: 20.0},
+		{Time: 3, Value: 20.0},
+		{Time: 4, Value: 15.0},
+	}
+	if got := ReduceEWMA(values, 0.5); !reflect.DeepEqual(got, exp) {
+		t.Errorf("ReduceEWMA mismatch: got %v, exp %v", got, exp)
+	}
+
+	// An alpha of 1 doesn't smooth the values.
+	exp = PositionPoints{
+		{Time: 1, Value: 10.0},
+		{Time: 2, Value: 30.0},
+		{Time: 3, Value: 20.0},
+		{Time: 4, Value: 10.0},
+	}
+	if got := ReduceEWMA(values, 1); !reflect.DeepEqual(got, exp) {
+		t.Errorf("ReduceEWMA mismatch: got %v, exp %v", got, exp)
+	}
+
+	// Values out of order within a mapper are sorted first, and values that aren't
+	// numeric are skipped.
+	values = []interface{}{
+		mapRawValues([]int64{3, 1, 5}, int64(20), 10.0, "a"),
+		mapRawValues([]int64{4, 2}, 10.0, int64(30)),
+	}
+	exp = PositionPoints{
+		{Time: 1, Value: 10.0},
+		{Time: 2, Value: 20.0},
+		{Time: 3, Value: 20.0},
+		{Time: 4, Value: 15.0},
+	}
+	if got := ReduceEWMA(values, 0.5); !reflect.DeepEqual(got, exp) {
+		t.Errorf("ReduceEWMA mismatch: got %v, exp %v", got, exp)
+	}
+
+	if got := ReduceEWMA([]interface{}{nil, mapRawValues([]int64{1}, "a")}, 0.5); got != nil {
+		t.Errorf("ReduceEWMA mismatch: got %v, exp nil", got)
+	}
+}
+
+func TestReduceResets(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{nil}, exp: nil},
+		{name: "none", values: []interface{}{mapRawValues([]int64{1, 2, 3}, int64(1), int64(1), int64(5))}, exp: int64(0)},
+		{name: "one", values: []interface{}{mapRawValues([]int64{1, 2, 3}, 4.0, 9.0, 2.0)}, exp: int64(1)},
+		{name: "several", values: []interface{}{mapRawValues([]int64{1, 2, 3, 4, 5}, int64(10), int64(0), int64(6), int64(2), int64(0))}, exp: int64(3)},
+		{
+			// Values of separate mappers interleave by time before resets are counted.
+			name: "interleaved",
+			values: []interface{}{
+				mapRawValues([]int64{1, 3, 5}, int64(1), int64(3), int64(0)),
+				mapRawValues([]int64{2, 4, 6}, int64(2), int64(4), int64(1)),
+			},
+			exp: int64(1),
+		},
+	}
+
+	for _, test := range tests {
+		if got := ReduceResets(test.values); got != test.exp {
+			t.Errorf("%s: ReduceResets mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceSampleRate(t *testing.T) {
+	second := int64(time.Second)
+	tests := []struct {
+		name   string
+		inputs []*MapInput
+		exp    interface{}
+	}{
+		{
+			name: "even",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: 1.0}, {Timestamp: 2 * second, Value: 1.0}}},
+				{Items: []MapItem{{Timestamp: 4 * second, Value: 1.0}, {Timestamp: 6 * second, Value: 1.0}, {Timestamp: 8 * second, Value: 1.0}}},
+			},
+			exp: 5.0 / 8,
+		},
+		{
+			name: "uneven",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: "a"}, {Timestamp: second / 2, Value: "b"}, {Timestamp: second, Value: "c"}}},
+				{},
+				{Items: []MapItem{{Timestamp: 10 * second, Value: "d"}}},
+			},
+			exp: 0.4,
+		},
+		{
+			name:   "instant",
+			inputs: []*MapInput{{Items: []MapItem{{Timestamp: second, Value: 1.0}, {Timestamp: second, Value: 2.0}}}},
+			exp:    nil,
+		},
+	}
+
+	for _, test := range tests {
+		var values []interface{}
+		for _, input := range test.inputs {
+			values = append(values, MapSampleRate(input))
+		}
+		if got := ReduceSampleRate(values); got != test.exp {
+			t.Errorf("%s: ReduceSampleRate mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+// Ensure min_points() only outputs the nested aggregate of intervals with enough values,
+// including after its map outputs are sent between nodes.
+func TestReduceMinPoints(t *testing.T) {
+	call := &influxql.Call{
+		Name: "min_points",
+		Args: []influxql.Expr{
+			&influxql.Call{Name: "mean", Args: []influxql.Expr{&influxql.VarRef{Val: "value"}}},
+			&influxql.NumberLiteral{Val: 3},
+		},
+	}
+	mapFn, err := initializeMapFunc(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFn, err := initializeReduceFunc(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// remote returns the map output as it's received from another node.
+	remote := func(v interface{}) interface{} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err = unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	items := func(values ...float64) *MapInput {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: int64(i), Value: v})
+		}
+		return input
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{mapFn(items())}, exp: nil},
+		{name: "below", values: []interface{}{mapFn(items(1, 2)), nil}, exp: nil},
+		{name: "exact", values: []interface{}{mapFn(items(1, 2)), remote(mapFn(items(6)))}, exp: 3.0},
+		{name: "above", values: []interface{}{mapFn(items(1, 2, 3, 6))}, exp: 3.0},
+	}
+
+	for _, test := range tests {
+		if got := reduceFn(test.values); got != test.exp {
+			t.Errorf("%s: min_points mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceNullFraction(t *testing.T) {
+	items := []MapItem{{Timestamp: 1, Value: 1.0}, {Timestamp: 2, Value: 2.0}}
+	tests := []struct {
+		name   string
+		inputs []*MapInput
+		exp    interface{}
+	}{
+		{name: "empty", inputs: []*MapInput{{}}, exp: nil},
+		{name: "all null", inputs: []*MapInput{{Nulls: 3}}, exp: 1.0},
+		{name: "no null", inputs: []*MapInput{{Items: items}}, exp: 0.0},
+		{name: "mixed", inputs: []*MapInput{{Items: items, Nulls: 1}, {}, {Nulls: 1}}, exp: 0.5},
+	}
+
+	for _, test := range tests {
+		var values []interface{}
+		for _, input := range test.inputs {
+			values = append(values, MapNullFraction(input))
+		}
+		if got := ReduceNullFraction(values); got != test.exp {
+			t.Errorf("%s: ReduceNullFraction mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+// Ensure each column of range_detail() matches the min and max selectors.
+func TestReduceRangeDetail(t *testing.T) {
+	inputs := []*MapInput{
+		{Items: []MapItem{{Timestamp: 1, Value: 4.5}, {Timestamp: 2, Value: -2.0}, {Timestamp: 3, Value: 9.0}}},
+		{},
+		{Items: []MapItem{{Timestamp: 4, Value: 9.0}, {Timestamp: 5, Value: -3.5}}},
+	}
+
+	var details, mins, maxes []interface{}
+	for _, input := range inputs {
+		details = append(details, MapRangeDetail(input))
+		mins = append(mins, MapMin(input, "value"))
+		maxes = append(maxes, MapMax(input, "value"))
+	}
+
+	min, max := ReduceMin(mins).(PositionPoint), ReduceMax(maxes).(PositionPoint)
+	exp := columnValues{min.Value, min.Time, max.Value, max.Time}
+	if got := ReduceRangeDetail(details); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("ReduceRangeDetail mismatch: got %v, exp %v", got, exp)
+	}
+
+	// The max of 9 is written twice, and its first time is kept.
+	if max.Time != 3 {
+		t.Fatalf("max time mismatch: got %v, exp 3", max.Time)
+	}
+}
+
+func TestReduceMinMaxTimestamp(t *testing.T) {
+	inputs := []*MapInput{
+		{Items: []MapItem{{Timestamp: 20, Value: 1.0}, {Timestamp: 30, Value: 1.0}}},
+		{},
+		{Items: []MapItem{{Timestamp: 10, Value: "up"}, {Timestamp: 25, Value: "down"}}},
+	}
+
+	var mins, maxes []interface{}
+	for _, input := range inputs {
+		mins = append(mins, MapMinTimestamp(input))
+		maxes = append(maxes, MapMaxTimestamp(input))
+	}
+	if got, exp := ReduceMinTimestamp(mins), int64(10); got != exp {
+		t.Errorf("ReduceMinTimestamp mismatch: got %v, exp %v", got, exp)
+	}
+	if got, exp := ReduceMaxTimestamp(maxes), int64(30); got != exp {
+		t.Errorf("ReduceMaxTimestamp mismatch: got %v, exp %v", got, exp)
+	}
+
+	if got := ReduceMinTimestamp([]interface{}{nil}); got != nil {
+		t.Errorf("ReduceMinTimestamp(nil) mismatch: got %v, exp nil", got)
+	}
+	if got := ReduceMaxTimestamp([]interface{}{nil}); got != nil {
+		t.Errorf("ReduceMaxTimestamp(nil) mismatch: got %v, exp nil", got)
+	}
+}
+
+func TestReduceLinearRegression(t *testing.T) {
+	second := int64(time.Second)
+	start := time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	tests := []struct {
+		name   string
+		inputs []*MapInput
+		exp    interface{}
+	}{
+		{
+			// A ramp rising 2 per second, split between mappers with different starts.
+			name: "ramp",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: start + 4*second, Value: int64(9)}, {Timestamp: start + 6*second, Value: int64(13)}}},
+				{Items: []MapItem{{Timestamp: start, Value: 1.0}, {Timestamp: start + second, Value: 3.0}}},
+			},
+			exp: 2.0,
+		},
+		{
+			name:   "flat",
+			inputs: []*MapInput{{Items: []MapItem{{Timestamp: start, Value: 5.0}, {Timestamp: start + second, Value: 5.0}, {Timestamp: start + 3*second, Value: 5.0}}}},
+			exp:    0.0,
+		},
+		{
+			name:   "single",
+			inputs: []*MapInput{{Items: []MapItem{{Timestamp: start, Value: 5.0}}}, {}},
+			exp:    nil,
+		},
+	}
+
+	for _, test := range tests {
+		var values []interface{}
+		for _, input := range test.inputs {
+			values = append(values, MapRegression(input))
+		}
+		got := ReduceLinearRegression(values)
+		if f, ok := got.(float64); ok && test.exp != nil && math.Abs(f-test.exp.(float64)) < 1e-9 {
+			continue
+		}
+		if got != test.exp {
+			t.Errorf("%s: ReduceLinearRegression mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestReduceTrend(t *testing.T) {
+	second := int64(time.Second)
+	start := time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+
+	// The line v = 3 + 2t with noise of +1, -1, -1, +1, so the least-squares fit is the
+	// line itself.
+	noise := []float64{1, -1, -1, 1}
+	input := &MapInput{}
+	for i, e := range noise {
+		input.Items = append(input.Items, MapItem{Timestamp: start + int64(i)*second, Value: 3 + 2*float64(i) + e})
+	}
+	got, ok := ReduceTrend([]interface{}{MapRegression(input)}).(columnValues)
+	if !ok || len(got) != 3 {
+		t.Fatalf("ReduceTrend mismatch: got %v, exp 3 columns", got)
+	}
+
+	// R² = 1 - SSres/SStot: SSres is 4 from the noise and SStot is 24 around the mean of 6.
+	for i, exp := range []float64{2, 3, 1 - 4.0/24} {
+		if math.Abs(got[i].(float64)-exp) > 1e-9 {
+			t.Errorf("column %d mismatch: got %v, exp %v", i, got[i], exp)
+		}
+	}
+
+	if got, exp := ReduceTrend([]interface{}{nil}), (columnValues{nil, nil, nil}); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("ReduceTrend(nil) mismatch: got %v, exp %v", got, exp)
+	}
+}
+
+func TestReduceActiveBuckets(t *testing.T) {
+	minute := int64(time.Minute)
+	tests := []struct {
+		name   string
+		inputs []*MapInput
+		exp    interface{}
+	}{
+		{
+			// Values clustered in a minute count once, even across mappers.
+			name: "clustered",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 5 * minute, Value: 1.0}, {Timestamp: 5*minute + 10, Value: 1.0}}},
+				{Items: []MapItem{{Timestamp: 6*minute - 1, Value: 1.0}}},
+			},
+			exp: int64(1),
+		},
+		{
+			name: "spread",
+			inputs: []*MapInput{
+				{Items: []MapItem{{Timestamp: 0, Value: 1.0}, {Timestamp: 10 * minute, Value: 1.0}}},
+				{Items: []MapItem{{Timestamp: 20 * minute, Value: 1.0}, {Timestamp: 59 * minute, Value: 1.0}}},
+			},
+			exp: int64(4),
+		},
+		{name: "empty", inputs: []*MapInput{{}}, exp: nil},
+	}
+
+	for _, test := range tests {
+		var values []interface{}
+		for _, input := range test.inputs {
+			values = append(values, MapBuckets(input, minute))
+		}
+		if got := ReduceActiveBuckets(values); got != test.exp {
+			t.Errorf("%s: ReduceActiveBuckets mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
 func TestReducePercentileNil(t *testing.T) {
 
 	input := []interface{}{
@@ -107,6 +1352,57 @@ func TestReducePercentileNil(t *testing.T) {
 	}
 }
 
+func TestReducePercentile(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     []interface{}
+		percentile float64
+		exp        interface{}
+	}{
+		{name: "int p0", values: []interface{}{[]interface{}{int64(3), int64(1)}, []interface{}{int64(2)}}, percentile: 0, exp: float64(1)},
+		{name: "int p50", values: []interface{}{[]interface{}{int64(3), int64(1)}, []interface{}{int64(2)}}, percentile: 50, exp: float64(2)},
+		{name: "int p100", values: []interface{}{[]interface{}{int64(3), int64(1)}, []interface{}{int64(2)}}, percentile: 100, exp: float64(3)},
+		{name: "int single p0", values: []interface{}{[]interface{}{int64(7)}}, percentile: 0, exp: float64(7)},
+		{name: "int single p50", values: []interface{}{[]interface{}{int64(7)}}, percentile: 50, exp: float64(7)},
+		{name: "int single p100", values: []interface{}{[]interface{}{int64(7)}}, percentile: 100, exp: float64(7)},
+		{name: "float p0", values: []interface{}{[]interface{}{3.5, 1.5}, nil, []interface{}{2.5, 4.5}}, percentile: 0, exp: 1.5},
+		{name: "float p50", values: []interface{}{[]interface{}{3.5, 1.5}, nil, []interface{}{2.5, 4.5}}, percentile: 50, exp: 2.5},
+		{name: "float p100", values: []interface{}{[]interface{}{3.5, 1.5}, nil, []interface{}{2.5, 4.5}}, percentile: 100, exp: 4.5},
+		{name: "float single p0", values: []interface{}{[]interface{}{7.5}}, percentile: 0, exp: 7.5},
+		{name: "float single p50", values: []interface{}{[]interface{}{7.5}}, percentile: 50, exp: 7.5},
+		{name: "float single p100", values: []interface{}{[]interface{}{7.5}}, percentile: 100, exp: 7.5},
+	}
+
+	for _, test := range tests {
+		if got := ReducePercentile(test.values, test.percentile); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: ReducePercentile(%v) mismatch: got %v (%T), exp %v (%T)", test.name, test.percentile, got, got, test.exp, test.exp)
+		}
+	}
+}
+
+// Ensure each column of percentiles() matches percentile() of the same values.
+func TestReducePercentiles(t *testing.T) {
+	values := []interface{}{
+		MapEcho(&MapInput{Items: []MapItem{{Timestamp: 1, Value: 15.0}, {Timestamp: 2, Value: 20.0}, {Timestamp: 3, Value: 35.0}}}),
+		MapEcho(&MapInput{Items: []MapItem{{Timestamp: 4, Value: 40.0}, {Timestamp: 5, Value: 50.0}, {Timestamp: 6, Value: 5.0}}}),
+	}
+	percentiles := []float64{0, 50, 90, 95, 99, 100}
+
+	got, ok := ReducePercentiles(values, percentiles).(columnValues)
+	if !ok || len(got) != len(percentiles) {
+		t.Fatalf("ReducePercentiles mismatch: got %v, exp %d columns", got, len(percentiles))
+	}
+	for i, p := range percentiles {
+		if exp := ReducePercentile(values, p); got[i] != exp {
+			t.Errorf("p%v mismatch: got %v, exp %v", p, got[i], exp)
+		}
+	}
+
+	if got, exp := ReducePercentiles([]interface{}{nil}, []float64{50, 99}), (columnValues{nil, nil}); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("ReducePercentiles(nil) mismatch: got %v, exp %v", got, exp)
+	}
+}
+
 func TestMapDistinct(t *testing.T) {
 	const ( // prove that we're ignoring time
 		timeId1 = iota + 1
@@ -292,6 +1588,80 @@ func TestMapCountDistinct(t *testing.T) {
 	}
 }
 
+func TestMapCountIf(t *testing.T) {
+	input := &MapInput{
+		Items: []MapItem{
+			{Timestamp: 1, Value: float64(50)},
+			{Timestamp: 2, Value: int64(100)},
+			{Timestamp: 3, Value: float64(150.5)},
+			{Timestamp: 4, Value: int64(200)},
+		},
+	}
+
+	tests := []struct {
+		cond string
+		exp  int64
+	}{
+		{cond: `value > 100`, exp: 2},
+		{cond: `value >= 100`, exp: 3},
+		{cond: `value < 100`, exp: 1},
+		{cond: `value <= 100`, exp: 2},
+		{cond: `value = 100`, exp: 1},
+		{cond: `value != 100`, exp: 3},
+		{cond: `value > 1000`, exp: 0},
+	}
+
+	for _, test := range tests {
+		cond := mustParseCondition(test.cond)
+		if got := MapCountIf(input, cond); got != test.exp {
+			t.Errorf("%s: exp %v got %v", test.cond, test.exp, got)
+		}
+	}
+
+	if got := MapCountIf(&MapInput{}, mustParseCondition(`value > 1`)); got != nil {
+		t.Errorf("exp nil got %v", got)
+	}
+}
+
+// mustParseCondition parses a comparison, such as value > 1, or panics.
+func mustParseCondition(s string) *influxql.BinaryExpr {
+	expr, err := influxql.ParseExpr(s)
+	if err != nil {
+		panic(err)
+	}
+	return expr.(*influxql.BinaryExpr)
+}
+
+func TestReduceRatioCount(t *testing.T) {
+	num, den := mustParseCondition(`status >= 500`), mustParseCondition(`status >= 0`)
+	mapRatioCount := func(values ...interface{}) interface{} {
+		input := &MapInput{}
+		for i, v := range values {
+			input.Items = append(input.Items, MapItem{Timestamp: int64(i), Value: v})
+		}
+		return MapRatioCount(input, num, den)
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{name: "empty", values: []interface{}{mapRatioCount(), nil}, exp: nil},
+		{name: "none", values: []interface{}{mapRatioCount(int64(200), int64(404))}, exp: 0.0},
+		{name: "all", values: []interface{}{mapRatioCount(int64(500), 503.0), mapRatioCount(int64(502))}, exp: 1.0},
+		{name: "mixed", values: []interface{}{mapRatioCount(int64(200), int64(500)), mapRatioCount(int64(201), 503.0)}, exp: 0.5},
+		// Only values meeting the second condition count towards the ratio.
+		{name: "zero denominator", values: []interface{}{mapRatioCount(int64(-1))}, exp: nil},
+	}
+
+	for _, test := range tests {
+		if got := ReduceRatioCount(test.values); got != test.exp {
+			t.Errorf("%s: ReduceRatioCount mismatch: got %v, exp %v", test.name, got, test.exp)
+		}
+	}
+}
+
 func TestMapCountDistinctNil(t *testing.T) {
 	if values := MapCountDistinct(&MapInput{}); values != nil {
 		t.Errorf("Wrong values. exp nil got %v", spew.Sdump(values))
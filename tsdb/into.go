@@ -36,6 +36,11 @@ func convertRowToPoints(measurementName string, row *models.Row) ([]models.Point
 			}
 		}
 
+		// Drop empty buckets, since points need at least one field
+		if len(vals) == 0 {
+			continue
+		}
+
 		p, err := models.NewPoint(measurementName, row.Tags, vals, v[timeIndex].(time.Time))
 		if err != nil {
 			// Drop points that can't be stored
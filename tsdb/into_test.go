@@ -0,0 +1,57 @@
+package tsdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/models"
+)
+
+// Ensure the rows of a GROUP BY time aggregate convert to points of the target measurement.
+func TestConvertRowToPoints(t *testing.T) {
+	t0 := time.Unix(0, 0).UTC()
+	t1 := t0.Add(time.Minute)
+	t2 := t1.Add(time.Minute)
+	row := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "server01"},
+		Columns: []string{"time", "mean", "count"},
+		Values: [][]interface{}{
+			{t0, 1.5, int64(2)},
+			{t1, nil, nil},
+			{t2, 3.0, int64(1)},
+		},
+	}
+
+	points, err := convertRowToPoints("cpu_1m", row)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The empty bucket has no fields, so it's dropped.
+	if len(points) != 2 {
+		t.Fatalf("point count mismatch: got %d, exp 2", len(points))
+	}
+	for i, exp := range []struct {
+		time   time.Time
+		fields models.Fields
+	}{
+		{time: t0, fields: models.Fields{"mean": 1.5, "count": int64(2)}},
+		{time: t2, fields: models.Fields{"mean": 3.0, "count": int64(1)}},
+	} {
+		p := points[i]
+		if p.Name() != "cpu_1m" {
+			t.Errorf("%d. name mismatch: got %s, exp cpu_1m", i, p.Name())
+		}
+		if !p.Time().Equal(exp.time) {
+			t.Errorf("%d. time mismatch: got %s, exp %s", i, p.Time(), exp.time)
+		}
+		if !reflect.DeepEqual(p.Tags(), models.Tags{"host": "server01"}) {
+			t.Errorf("%d. tags mismatch: got %v", i, p.Tags())
+		}
+		if !reflect.DeepEqual(p.Fields(), exp.fields) {
+			t.Errorf("%d. fields mismatch: got %v, exp %v", i, p.Fields(), exp.fields)
+		}
+	}
+}
@@ -53,6 +53,9 @@ type QueryExecutor struct {
 	Logger          *log.Logger
 	QueryLogEnabled bool
 
+	// Aggregate queries running longer than QueryTimeout are aborted, if it's not zero.
+	QueryTimeout time.Duration
+
 	// the local data store
 	Store *Store
 }
@@ -299,7 +302,11 @@ func (q *QueryExecutor) PlanSelect(stmt *influxql.SelectStatement, chunkSize int
 	if (stmt.IsRawQuery && !stmt.HasDistinct()) || stmt.IsSimpleDerivative() {
 		return NewRawExecutor(stmt, mappers, chunkSize), nil
 	} else {
-		return NewAggregateExecutor(stmt, mappers), nil
+		e := NewAggregateExecutor(stmt, mappers)
+		if q.QueryTimeout > 0 {
+			e.SetDeadline(now.Add(q.QueryTimeout))
+		}
+		return e, nil
 	}
 }
 
@@ -252,10 +252,16 @@ func (e *RawExecutor) execute(out chan *models.Row) {
 				out <- &models.Row{Err: err}
 				return
 			}
-			rowWriter.transformer = &RawQueryDerivativeProcessor{
-				IsNonNegative:      e.stmt.FunctionCalls()[0].Name == "non_negative_derivative",
+			call := e.stmt.FunctionCalls()[0]
+			p := &RawQueryDerivativeProcessor{
+				IsNonNegative:      call.Name == "non_negative_derivative",
 				DerivativeInterval: interval,
+				OrderField:         call.OrderField(),
 			}
+			if p.OrderField != "" {
+				p.Field = call.Args[0].(*influxql.VarRef).Val
+			}
+			rowWriter.transformer = p
 		}
 
 		// Emit the data via the limiter.
@@ -542,24 +548,44 @@ type RawQueryDerivativeProcessor struct {
 	LastValueFromPreviousChunk *MapperValue
 	IsNonNegative              bool // Whether to drop negative differences
 	DerivativeInterval         time.Duration
+
+	// OrderField, if set, names a field whose values are used in place of the time of
+	// each point, as whole nanoseconds.  The values then hold a map of Field and OrderField.
+	OrderField string
+	Field      string
 }
 
-func (rqdp *RawQueryDerivativeProcessor) canProcess(input *MapperValue) bool {
+// point returns the value of input and the time to take its derivative at, and false if
+// either isn't numeric.
+func (rqdp *RawQueryDerivativeProcessor) point(input *MapperValue) (value float64, at int64, ok bool) {
 	// Cannot process a nil value
 	if input == nil {
-		return false
+		return 0, 0, false
 	}
 
-	// See if the field value is numeric, if it's not, we can't process the derivative
-	validType := false
-	switch input.Value.(type) {
-	case int64:
-		validType = true
-	case float64:
-		validType = true
+	v, at := input.Value, input.Time
+	if rqdp.OrderField != "" {
+		m, ok := input.Value.(map[string]interface{})
+		if !ok {
+			return 0, 0, false
+		}
+		switch order := m[rqdp.OrderField].(type) {
+		case int64:
+			at = order
+		case float64:
+			at = int64(order)
+		default:
+			return 0, 0, false
+		}
+		v = m[rqdp.Field]
 	}
 
-	return validType
+	// See if the field value is numeric, if it's not, we can't process the derivative
+	switch v.(type) {
+	case int64, float64:
+		return int64toFloat64(v), at, true
+	}
+	return 0, 0, false
 }
 
 func (rqdp *RawQueryDerivativeProcessor) Process(input []*MapperValue) []*MapperValue {
@@ -586,7 +612,9 @@ func (rqdp *RawQueryDerivativeProcessor) Process(input []*MapperValue) []*Mapper
 
 		// If we can't use the current or prev value (wrong time, nil), just append
 		// nil
-		if !rqdp.canProcess(v) || !rqdp.canProcess(rqdp.LastValueFromPreviousChunk) {
+		cur, curAt, ok := rqdp.point(v)
+		prev, prevAt, prevOK := rqdp.point(rqdp.LastValueFromPreviousChunk)
+		if !ok || !prevOK {
 			derivativeValues = append(derivativeValues, &MapperValue{
 				Time:  v.Time,
 				Value: nil,
@@ -596,9 +624,9 @@ func (rqdp *RawQueryDerivativeProcessor) Process(input []*MapperValue) []*Mapper
 
 		// Calculate the derivative of successive points by dividing the difference
 		// of each value by the elapsed time normalized to the interval
-		diff := int64toFloat64(v.Value) - int64toFloat64(rqdp.LastValueFromPreviousChunk.Value)
+		diff := cur - prev
 
-		elapsed := v.Time - rqdp.LastValueFromPreviousChunk.Time
+		elapsed := curAt - prevAt
 
 		value := 0.0
 		if elapsed > 0 {
@@ -728,7 +756,7 @@ func ProcessAggregateDerivative(results [][]interface{}, isNonNegative bool, int
 
 // derivativeInterval returns the time interval for the one (and only) derivative func
 func derivativeInterval(stmt *influxql.SelectStatement) (time.Duration, error) {
-	if len(stmt.FunctionCalls()[0].Args) == 2 {
+	if len(stmt.FunctionCalls()[0].Args) >= 2 {
 		return stmt.FunctionCalls()[0].Args[1].(*influxql.DurationLiteral).Val, nil
 	}
 	interval, err := stmt.GroupByInterval()
@@ -972,6 +972,29 @@ func TestRawQueryDerivative_Process_Bool(t *testing.T) {
 	}
 }
 
+// Ensure an ordering field is used in place of the time of each point.
+func TestRawQueryDerivative_Process_OrderField(t *testing.T) {
+	p := tsdb.RawQueryDerivativeProcessor{
+		DerivativeInterval: time.Nanosecond,
+		OrderField:         "seq",
+		Field:              "value",
+	}
+
+	results := p.Process([]*tsdb.MapperValue{
+		{Time: 10, Value: map[string]interface{}{"value": 1.0, "seq": int64(1)}},
+		{Time: 20, Value: map[string]interface{}{"value": 5.0, "seq": int64(3)}},
+		{Time: 30, Value: map[string]interface{}{"value": 6.0}},
+		{Time: 40, Value: map[string]interface{}{"value": int64(11), "seq": 8.0}},
+	})
+	if !reflect.DeepEqual(results, []*tsdb.MapperValue{
+		{Time: 20, Value: 2.0},
+		{Time: 30, Value: nil},
+		{Time: 40, Value: 1.2},
+	}) {
+		t.Fatalf("unexpected results: %s", spew.Sdump(results))
+	}
+}
+
 type testQEMetastore struct {
 	sgFunc func(database, policy string, min, max time.Time) (a []meta.ShardGroupInfo, err error)
 }
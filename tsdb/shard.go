@@ -26,6 +26,9 @@ const (
 	statWritePointsFail = "writePointsFail"
 	statWritePointsOK   = "writePointsOk"
 	statWriteBytes      = "writeBytes"
+
+	statAggregateNullsSkipped = "aggregateNullsSkipped" // points aggregates skipped for lacking the field
+	statAggregateCoercions    = "aggregateCoercions"    // integers numeric aggregates converted inexactly to floats
 )
 
 var (
@@ -291,6 +294,10 @@ func (s *Shard) ValidateAggregateFieldsInStatement(measurementName string, stmt
 	for _, a := range stmt.FunctionCalls() {
 		// Check for fields like `derivative(mean(value), 1d)`
 		var nested *influxql.Call = a
+		if len(nested.Args) == 0 {
+			// Calls without a field, like min_timestamp(), work on any field.
+			continue
+		}
 		if fn, ok := nested.Args[0].(*influxql.Call); ok {
 			nested = fn
 		}
@@ -313,6 +320,16 @@ func (s *Shard) ValidateAggregateFieldsInStatement(measurementName string, stmt
 					return err
 				}
 			}
+		case *influxql.BinaryExpr:
+			// Conditions, such as count(value > 100), compare a field with a number.
+			ref, ok := lit.LHS.(*influxql.VarRef)
+			if !ok {
+				return fmt.Errorf("aggregate call didn't contain a field %s", a.String())
+			}
+			f := m.Fields[ref.Val]
+			if err := validateType(a.Name, f.Name, f.Type); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("aggregate call didn't contain a field %s", a.String())
 		}
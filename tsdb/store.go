@@ -216,6 +216,33 @@ func (s *Store) Measurement(database, name string) *Measurement {
 	return db.Measurement(name)
 }
 
+// MeasurementFields returns the types of the fields of the measurement in the database's
+// shards on this node, keyed by field name, or false if none of them hold the measurement.
+func (s *Store) MeasurementFields(database, name string) (map[string]influxql.DataType, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	db := s.databaseIndexes[database]
+	if db == nil || db.Measurement(name) == nil {
+		return nil, false
+	}
+
+	fields := make(map[string]influxql.DataType)
+	for _, sh := range s.shards {
+		if sh.index != db {
+			continue
+		}
+		sh.mu.RLock()
+		if m := sh.measurementFields[name]; m != nil {
+			for _, f := range m.Fields {
+				fields[f.Name] = f.Type
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return fields, true
+}
+
 // DiskSize returns the size of all the shard files in bytes.  This size does not include the WAL size.
 func (s *Store) DiskSize() (int64, error) {
 	s.mu.RLock()